@@ -2,19 +2,36 @@ package main
 
 import (
 	"context"
-	"db-snapshot/capturer/mysql"
-	"db-snapshot/capturer/oceanbase"
-	"db-snapshot/capturer/oracle"
-	"db-snapshot/capturer/pgsql"
+	"db-snapshot/agent"
+	"db-snapshot/breaker"
+	"db-snapshot/capturer"
+	_ "db-snapshot/capturer/mysql"
+	_ "db-snapshot/capturer/oceanbase"
+	_ "db-snapshot/capturer/oracle"
+	_ "db-snapshot/capturer/pgsql"
+	"db-snapshot/cluster"
 	"db-snapshot/config"
+	"db-snapshot/connmgr"
+	"db-snapshot/coverage"
+	"db-snapshot/credential"
+	"db-snapshot/event"
 	"db-snapshot/http"
 	"db-snapshot/model"
+	"db-snapshot/pipeline"
+	"db-snapshot/recorder"
+	"db-snapshot/scheduler"
+	"db-snapshot/spool"
+	"db-snapshot/storage"
 	"db-snapshot/threading"
 	"db-snapshot/util"
 	"embed"
+	"errors"
 	"fmt"
 	"github.com/gookit/slog"
 	"gorm.io/gorm"
+	nethttp "net/http"
+	"os"
+	"strings"
 	"sync/atomic"
 	"time"
 )
@@ -53,7 +70,8 @@ func init() {
 
 func GetInstances() {
 
-	sql := "select inst_id,db_type,host,port,db_name from db_snapshot_config"
+	//分配给采集代理的实例由代理采集
+	sql := "select inst_id,db_type,host,port,db_name,monitor_user,monitor_password,enabled,interval_seconds,window_start,window_end,tier,agent,threshold_profile from db_snapshot_config where agent = ''"
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -63,134 +81,353 @@ func GetInstances() {
 		slog.Errorf("获取实例失败: %v", err)
 		return
 	}
+
+	err = credential.LoadDefaults(DB)
+	if err != nil {
+		slog.Errorf("获取默认监控账号失败: %v", err)
+	}
 	slog.Infof("获取实例成功, %d rows", len(rows))
-	if len(rows) > 0 {
-		Instances.Store(rows)
-		for _, v := range rows {
-			slog.Debugf("载入实例: %+v", *v)
+	//没有实例时也要替换，释放已删除或暂停的实例的连接池、熔断和黑匣子
+	LoadInstances(rows)
+}
+
+// LoadInstances 解析监控账号，替换采集的实例列表
+func LoadInstances(rows []*model.Instance) {
+	var err error
+	for _, v := range rows {
+		v.User, v.Password, err = credential.Resolve(v)
+		if err != nil {
+			slog.Errorf("[%s:%d] %v，使用全局监控账号", v.Host, v.Port, err)
+			v.User, v.Password = config.Get().MonitorCredential()
 		}
 	}
+	Instances.Store(rows)
+	for _, v := range rows {
+		slog.Debugf("载入实例: %d %s %s:%d/%s enabled=%v interval=%d window=%s-%s", v.InstId, v.DBType, v.Host, v.Port, v.DBName, v.Enabled, v.IntervalSeconds, v.WindowStart, v.WindowEnd)
+	}
+	syncOwned()
 }
 
-func NewCapturer(i *model.Instance) (c model.Capturer, err error) {
-	switch i.DBType {
-	case "mysql", "polar", "tdsqlc":
-		c = &mysql.Capturer{InstID: i.InstId, Host: i.Host, Port: i.Port, DBName: "information_schema"}
-	case "oracle":
-		c = &oracle.Capturer{InstID: i.InstId, Host: i.Host, Port: i.Port, DBName: i.DBName}
-	case "pgsql":
-		c = &pgsql.Capturer{InstID: i.InstId, Host: i.Host, Port: i.Port, DBName: "postgres"}
-	case "oceanbase":
-		c = &oceanbase.Capturer{InstID: i.InstId, Host: i.Host, Port: i.Port, DBName: "oceanbase"}
-	default:
-		return nil, fmt.Errorf("不支持该数据库类型: %s", i.DBType)
-	}
-	return
+// refreshInstances 使用当前的配置重新解析实例的监控账号，并同步黑匣子
+func refreshInstances() {
+	val := Instances.Load()
+	if val == nil {
+		return
+	}
+	//复制实例，不修改采集中的实例
+	list := val.([]*model.Instance)
+	rows := make([]*model.Instance, len(list))
+	for i, v := range list {
+		inst := *v
+		rows[i] = &inst
+	}
+	LoadInstances(rows)
 }
 
-func StartCapturer(i *model.Instance, db *gorm.DB) {
+// ownedInstances 返回本节点负责采集的实例，集群中其他节点负责的实例不采集
+func ownedInstances() []*model.Instance {
+	val := Instances.Load()
+	if val == nil {
+		return nil
+	}
+	return cluster.Filter(val.([]*model.Instance))
+}
+
+// syncOwned 按本节点负责的实例同步连接池、熔断状态和黑匣子，集群分配变化时调用
+func syncOwned() {
+	rows := ownedInstances()
+	if rows == nil {
+		return
+	}
+
+	//暂停的实例释放连接池
+	var enabled []*model.Instance
+	for _, v := range rows {
+		if v.Enabled {
+			enabled = append(enabled, v)
+		}
+	}
+	connmgr.Sync(enabled)
+	breaker.Sync(rows)
+	//黑匣子转储记录需要写入元数据库，代理模式不启用
+	if DB != nil {
+		recorder.Sync(DB, enabled)
+	}
+}
+
+// StartCapturer 采集一个实例的快照并调用save保存，返回快照汇总，采集失败时返回错误
+func StartCapturer(ctx context.Context, i *model.Instance, save func(context.Context, *model.Snapshot) error, run scheduler.Run) (sum *model.DBSnapshot, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			slog.Errorf("[%s:%d] 获取快照异常: %v", i.Host, i.Port, r)
+			sum, err = nil, fmt.Errorf("获取快照异常: %v", r)
 		}
 	}()
 
+	//熔断期间不连接实例，避免每次都等待连接超时
+	if !breaker.Allow(i) {
+		slog.Debugf("[%s:%d] 实例连接熔断中，跳过快照", i.Host, i.Port)
+		return nil, fmt.Errorf("%w: 实例连接熔断中", coverage.ErrConnect)
+	}
+
 	slog.Infof("[%s:%d] 开始快照", i.Host, i.Port)
 	t := time.Now()
-	c, err := NewCapturer(i)
+
+	//每次快照的截止时间不超过采集间隔，避免任务堆积
+	ctx, cancel := context.WithTimeout(ctx, run.Timeout)
+	defer cancel()
+
+	c, err := capturer.New(i)
 	if err != nil {
 		slog.Errorf("[%s:%d] %v", i.Host, i.Port, err)
-		return
+		return nil, err
 	}
-	err = c.Init()
+	err = c.Init(ctx)
 	if err != nil {
 		slog.Errorf("[%s:%d] 连接数据库超时: %v", i.Host, i.Port, err)
-		return
+		breaker.Failure(i, err)
+		return nil, fmt.Errorf("%w: %v", coverage.ErrConnect, err)
 	}
+	breaker.Success(i)
 	defer c.Close()
 
-	c.Capture(db)
+	snap := c.Capture(ctx)
+	if ctx.Err() != nil {
+		slog.Warnf("[%s:%d] 快照被中断: %v", i.Host, i.Port, ctx.Err())
+	}
+	snap.Summary.Burst = run.Burst
+	snap.Summary.Scheduled = !run.Expected.IsZero()
+	snap.Summary.SetRound(run.Round)
+	//快照数据已采集完成，保存结果不受截止时间影响
+	err = save(context.WithoutCancel(ctx), snap)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", coverage.ErrSave, err)
+	}
 	slog.Infof("[%s:%d] 快照完成，耗时%ds", i.Host, i.Port, int(time.Since(t).Seconds()))
-
+	return snap.Summary, nil
 }
 
 func main() {
+	//配置来源：默认值、配置文件、环境变量、命令行参数
+	cmd, src, err := config.ParseArgs(os.Args[1:])
+	if config.IsHelp(err) {
+		os.Exit(ExitOK)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(ExitError)
+	}
+	if cmd == config.CmdPrintConfig {
+		cfg, err := config.Load(src)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(ExitError)
+		}
+		cfg.Print(os.Stdout)
+		return
+	}
+	err = config.Init(src)
+	if err != nil {
+		slog.Errorf("%v", err)
+		os.Exit(ExitError)
+	}
+
 	// 进入工作目录
-	util.EnterWorkDir()
+	util.EnterWorkDir(config.Get().WorkDir)
+	//快照文件存储：本地目录或对象存储
+	err = storage.Init(&config.Get().Storage, config.Get().StorageSecretKey())
+	if err != nil {
+		slog.Errorf("初始化快照存储失败: %v", err)
+		os.Exit(ExitError)
+	}
 	//PrintEmbedFiles()
 	//采集间隔时间
-	var interval = time.Second * time.Duration(config.Global.Interval)
-	var parallel = config.Global.Parallel
+	var interval = time.Second * time.Duration(config.Get().Interval)
+	var parallel = config.Get().Parallel
 
-	var err error
-	DB, err = util.NewMysqlORM(&config.Global.DB)
+	var save func(context.Context, *model.Snapshot) error
+	isAgent := config.Get().Agent.IsAgent()
+	if isAgent {
+		//代理模式不连接元数据库，快照暂存在本地并推送到中心
+		slog.Infof("以代理模式运行，代理名称 %s，中心地址 %s", config.Get().Agent.Name, config.Get().Agent.Server)
+		save = func(ctx context.Context, snap *model.Snapshot) error {
+			return agent.Process(snap)
+		}
+	} else {
+		DB, err = util.NewMysqlORM(&config.Get().DB, func() string {
+			//重载配置后读取新配置中的密码
+			return config.Get().DBPassword()
+		})
+		if err != nil {
+			slog.Errorf("连接数据库报错: %s", err)
+			os.Exit(ExitError)
+		}
+		//元数据库不可用时快照汇总暂存到本地文件
+		err = spool.Start(DB)
+		if err != nil {
+			slog.Errorf("打开暂存文件失败: %v", err)
+			os.Exit(ExitError)
+		}
+		save = func(ctx context.Context, snap *model.Snapshot) error {
+			return pipeline.Process(ctx, DB, snap)
+		}
+	}
+	event.Start(DB)
+	downSince := coverage.Start(DB)
+	err = breaker.Init(DB)
 	if err != nil {
-		slog.Errorf("连接数据库报错: %s", err)
-		return
+		slog.Errorf("载入实例熔断状态失败: %v", err)
 	}
 
-	//启动http服务
-	go func() {
-		http.StartService(DB, config.Global.HttpPort, webFiles)
-	}()
+	pool := threading.NewPool(parallel, 1000)
+	pool.Start() //先执行Start，防止queue满导致堵塞
+
+	//集群模式下先确定本节点负责的实例，再开始调度
+	if !isAgent {
+		err = cluster.Start(DB, syncOwned)
+		if err != nil {
+			slog.Errorf("加入集群失败: %v", err)
+			os.Exit(ExitError)
+		}
+	}
+
+	sched := scheduler.New(interval, pool, ownedInstances, func(ctx context.Context, i *model.Instance, run scheduler.Run) (*model.DBSnapshot, error) {
+		return StartCapturer(ctx, i, save, run)
+	})
+	sched.Burst = &config.Get().Burst
+	sched.DownSince = downSince
+
+	//重载配置后调整采集间隔、高频采集和线程池，重新解析实例的监控账号
+	config.OnReload(func(old, cur *config.Config) {
+		sched.Reconfigure(time.Second*time.Duration(cur.Interval), &cur.Burst)
+		if cur.Parallel != old.Parallel {
+			if err := pool.Resize(cur.Parallel); err != nil {
+				slog.Errorf("调整线程池大小失败: %v", err)
+			}
+		}
+		refreshInstances()
+	})
+	config.Watch()
+
+	//启动http服务，代理模式由中心提供页面和接口
+	var srv *nethttp.Server
+	if !isAgent {
+		srv = http.NewServer(DB, config.Get().HttpPort, webFiles, sched, pool)
+		go func() {
+			err := srv.ListenAndServe()
+			if err != nil && !errors.Is(err, nethttp.ErrServerClosed) {
+				slog.Fatalf("启动http服务失败: %v", err)
+			}
+		}()
+	}
 
 	//载入实例
 	go func() {
 		reloadAt := time.Now().Add(-time.Hour)
-		for range config.Global.ReloadConfigChan {
-			if time.Since(reloadAt) >= 5*time.Second {
+		for range config.Get().ReloadConfigChan {
+			//距上次载入不足5秒时延后执行，等待期间的请求合并为一次，不会丢失
+			if wait := 5*time.Second - time.Since(reloadAt); wait > 0 {
+				time.Sleep(wait)
+			}
+			//重新解析密钥，密码轮换后无需重启
+			if err := config.Get().ResolveSecrets(); err != nil {
+				slog.Errorf("解析密钥失败，继续使用原密钥: %v", err)
+			}
+			if !isAgent {
 				GetInstances()
-				reloadAt = time.Now()
-			} else {
-				slog.Infof("不能频繁重载配置")
 			}
+			reloadAt = time.Now()
 		}
 	}()
 
 	//10分钟刷新一次实例
 	go func() {
 		for {
-			config.Global.ReloadConfigChan <- struct{}{}
+			config.Get().RequestReload()
 			time.Sleep(10 * time.Minute)
 		}
 	}()
 
-	pool := threading.NewPool(parallel, 1000)
-	pool.Start() //先执行Start，防止queue满导致堵塞
-
-	go func() {
-		addTasks := func() {
-			val := Instances.Load()
-			if val == nil {
-				slog.Warn("实例配置尚未加载，跳过本次快照")
-				return
-			}
-			curInstances := val.([]*model.Instance)
-			slog.Infof("开始执行%d个实例的快照任务", len(curInstances))
-			for _, inst := range curInstances {
-				pool.AddTask(func() {
-					StartCapturer(inst, DB)
-				})
-			}
+	//代理的实例由中心分配，每次心跳更新
+	if isAgent {
+		err = agent.Start(LoadInstances)
+		if err != nil {
+			slog.Errorf("启动代理失败: %v", err)
+			os.Exit(ExitError)
 		}
+	}
+
+	go sched.Run()
+
+	sig := <-threading.SignalChan
+	slog.Infof("收到%v信号，准备退出程序", sig)
+	os.Exit(shutdown(sched, pool, srv))
+}
+
+// 退出码
+const (
+	ExitOK          = 0 //所有快照正常结束
+	ExitError       = 1 //启动失败
+	ExitInterrupted = 2 //有快照被中断或未执行
+)
 
-		now := time.Now()
-		next := now.Truncate(time.Minute).Add(time.Minute)
-		sleep := time.Until(next)
-		time.Sleep(sleep)
+// shutdown 依次停止调度、线程池、http服务，保存未写入的数据后关闭连接，返回退出码，代理模式没有http服务和元数据库
+func shutdown(sched *scheduler.Scheduler, pool *threading.Pool, srv *nethttp.Server) int {
+	code := ExitOK
 
-		ticker := time.NewTicker(interval) //计时开始时刻对齐到00秒
-		defer ticker.Stop()
+	//停止投递新任务，释放租约后其他节点立即接管，等待执行中的快照，超时后取消
+	sched.Stop()
+	cluster.Stop()
+	res := pool.Shutdown(time.Second * time.Duration(config.Get().ShutdownGrace))
+	slog.Infof("线程池统计: %+v", pool.Stats())
+	//被取消的快照在StartCapturer中逐个记录"快照被中断"
+	if res.Cancelled > 0 || res.Dropped > 0 {
+		code = ExitInterrupted
+		slog.Warnf("%d个快照被取消，%d个快照未执行", res.Cancelled, res.Dropped)
+	}
+	if unfinished := sched.Inflight(); len(unfinished) > 0 {
+		code = ExitInterrupted
+		slog.Warnf("未完成的快照: %s", strings.Join(unfinished, ", "))
+		sched.Abandon()
+	}
 
-		addTasks() //立即执行第一次任务
-		for range ticker.C {
-			addTasks()
+	if srv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Errorf("关闭http服务失败: %v", err)
 		}
-	}()
+	}
 
-	pool.Join()
-	slog.Infof("程序退出成功")
+	recorder.StopAll()
+	if !event.Flush(5 * time.Second) {
+		slog.Warnf("部分事件未保存")
+	}
+	if !breaker.Flush(5 * time.Second) {
+		slog.Warnf("部分熔断状态未保存")
+	}
+	if !coverage.Flush(5 * time.Second) {
+		slog.Warnf("部分缺失记录未保存")
+	}
+	coverage.Stop()
+	spool.Close()
+	if config.Get().Agent.IsAgent() && !agent.Flush(5*time.Second) {
+		slog.Warnf("%d个快照暂存在本地，下次启动后继续推送", agent.Spooled())
+	}
+	connmgr.CloseAll()
+	if DB != nil {
+		if sqlDB, err := DB.DB(); err == nil {
+			sqlDB.Close()
+		}
+	}
 
+	if res.Abandoned {
+		slog.Errorf("程序退出，部分快照未能结束")
+	} else {
+		slog.Infof("程序退出成功")
+	}
+	slog.MustClose()
+	return code
 }
 
 //func PrintEmbedFiles() {
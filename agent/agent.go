@@ -0,0 +1,308 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"db-snapshot/config"
+	"db-snapshot/model"
+	"db-snapshot/pipeline"
+	"db-snapshot/storage"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gookit/slog"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 代理请求头，中心据此认证代理
+const (
+	HeaderName  = "X-Agent-Name"
+	HeaderToken = "X-Agent-Token"
+)
+
+const (
+	HeartbeatInterval = 30 * time.Second //代理心跳间隔，同时拉取分配的实例
+	OfflineAfter      = 90 * time.Second //超过该时间没有心跳视为离线
+	UploadInterval    = 5 * time.Second  //推送暂存快照的间隔
+	assignedFile      = "assigned.json"  //最后一次分配的实例，中心不可达时重启后继续采集
+)
+
+// 暂存快照的文件名，按时间排序即为采集顺序
+var spoolName = regexp.MustCompile(`^\d{8}_\d{6}_\d+\.json$`)
+
+var (
+	client   = &http.Client{Timeout: 30 * time.Second}
+	mu       sync.Mutex //推送和丢弃暂存快照互斥
+	notify   = make(chan struct{}, 1)
+	spooled  atomic.Int64
+	assigned atomic.Int64
+)
+
+// spoolEntry 暂存的快照汇总，快照文件保存在data目录，推送成功后删除
+type spoolEntry struct {
+	Summary *model.DBSnapshot
+	File    string
+}
+
+// rejectedError 中心拒绝的快照，重试也不会成功，直接丢弃
+type rejectedError struct {
+	err error
+}
+
+func (self *rejectedError) Error() string {
+	return self.err.Error()
+}
+
+// Start 启动心跳和推送，assign在中心分配的实例变化时调用，中心不可达时使用上次分配的实例
+func Start(assign func([]*model.Instance)) error {
+	dir := config.Get().Agent.SpoolDir
+	err := os.MkdirAll(dir, 0775)
+	if err != nil {
+		return fmt.Errorf("创建暂存目录失败: %w", err)
+	}
+	names, err := list()
+	if err != nil {
+		return err
+	}
+	spooled.Store(int64(len(names)))
+	if len(names) > 0 {
+		slog.Infof("%d个快照暂存在本地，等待推送", len(names))
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dir, assignedFile)); err == nil {
+		var rows []*model.Instance
+		if err := json.Unmarshal(data, &rows); err == nil {
+			slog.Infof("载入上次分配的实例, %d rows", len(rows))
+			assigned.Store(int64(len(rows)))
+			assign(rows)
+		}
+	}
+
+	go func() {
+		for {
+			heartbeat(assign)
+			time.Sleep(HeartbeatInterval)
+		}
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-notify:
+			case <-time.After(UploadInterval):
+			}
+			pushAll()
+		}
+	}()
+	return nil
+}
+
+// Process 保存快照文件并暂存快照汇总，由推送协程发送到中心
+func Process(snap *model.Snapshot) error {
+	file, err := pipeline.Save(snap)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(spoolEntry{Summary: snap.Summary, File: file})
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s_%d.json", snap.Time.Format("20060102_150405"), snap.Summary.InstID)
+	path := filepath.Join(config.Get().Agent.SpoolDir, name)
+	//先写临时文件再改名，推送协程不会读到写了一半的文件
+	err = os.WriteFile(path+".tmp", data, 0644)
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		slog.Errorf("[%s:%d] 暂存快照失败: %v", snap.Host, snap.Port, err)
+		return err
+	}
+	spooled.Add(1)
+
+	select {
+	case notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Spooled 返回本地暂存待推送的快照数
+func Spooled() int {
+	return int(spooled.Load())
+}
+
+// Flush 退出前推送暂存的快照，超时或中心不可达时返回false，未推送的快照下次启动后继续推送
+func Flush(timeout time.Duration) bool {
+	ch := make(chan bool, 1)
+	go func() {
+		ch <- pushAll()
+	}()
+	select {
+	case ok := <-ch:
+		return ok
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// heartbeat 上报代理状态，更新分配的实例
+func heartbeat(assign func([]*model.Instance)) {
+	var rows []*model.Instance
+	hb := model.AgentHeartbeat{Instances: int(assigned.Load()), Spooled: Spooled()}
+	err := post("/heartbeat", hb, &rows)
+	if err != nil {
+		slog.Warnf("代理心跳失败，继续采集上次分配的实例: %v", err)
+		return
+	}
+
+	//assign会填入解析后的监控账号，在此之前保存中心下发的密文
+	data, err := json.Marshal(rows)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(config.Get().Agent.SpoolDir, assignedFile), data, 0600)
+	}
+	if err != nil {
+		slog.Errorf("保存分配的实例失败: %v", err)
+	}
+	assigned.Store(int64(len(rows)))
+	assign(rows)
+}
+
+// pushAll 按采集顺序推送暂存的快照，中心不可达时停止，全部推送完成返回true
+func pushAll() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	names, err := list()
+	if err != nil {
+		slog.Errorf("读取暂存目录失败: %v", err)
+		return false
+	}
+	//超过暂存上限时丢弃最早的快照
+	if over := len(names) - config.Get().Agent.MaxSpool; over > 0 {
+		slog.Warnf("暂存快照超过%d个，丢弃最早的%d个", config.Get().Agent.MaxSpool, over)
+		for _, name := range names[:over] {
+			remove(name)
+		}
+		names = names[over:]
+	}
+
+	for i, name := range names {
+		err := push(name)
+		var rejected *rejectedError
+		switch {
+		case err == nil:
+			remove(name)
+		case errors.As(err, &rejected):
+			slog.Errorf("中心拒绝快照%s，丢弃: %v", name, err)
+			remove(name)
+		default:
+			slog.Warnf("推送快照失败，%d个快照暂存待重试: %v", len(names)-i, err)
+			return false
+		}
+	}
+	return true
+}
+
+// push 推送一个暂存的快照和快照文件
+func push(name string) error {
+	entry, err := read(name)
+	if err != nil {
+		return &rejectedError{err}
+	}
+	content, err := storage.ReadFile(context.Background(), entry.File+".br")
+	if err != nil {
+		slog.Warnf("读取快照文件失败，只推送快照汇总: %v", err)
+	}
+	return post("/ingest", model.AgentSnapshot{Summary: entry.Summary, File: entry.File, Content: content}, nil)
+}
+
+func read(name string) (*spoolEntry, error) {
+	data, err := os.ReadFile(filepath.Join(config.Get().Agent.SpoolDir, name))
+	if err != nil {
+		return nil, err
+	}
+	var entry spoolEntry
+	err = json.Unmarshal(data, &entry)
+	if err != nil || entry.Summary == nil {
+		return nil, fmt.Errorf("暂存文件%s格式错误: %v", name, err)
+	}
+	return &entry, nil
+}
+
+// remove 删除暂存的快照和本地快照文件
+func remove(name string) {
+	if entry, err := read(name); err == nil {
+		storage.Delete(context.Background(), entry.File+".br")
+	}
+	err := os.Remove(filepath.Join(config.Get().Agent.SpoolDir, name))
+	if err != nil {
+		slog.Errorf("删除暂存快照%s失败: %v", name, err)
+		return
+	}
+	spooled.Add(-1)
+}
+
+// list 返回按采集时间排序的暂存快照
+func list() ([]string, error) {
+	entries, err := os.ReadDir(config.Get().Agent.SpoolDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && spoolName.MatchString(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// post 调用中心的代理接口，中心拒绝的请求返回rejectedError
+func post(path string, body any, out any) error {
+	cfg := config.Get().Agent
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimRight(cfg.Server, "/") + "/db-snapshot/api/agent" + path
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderName, cfg.Name)
+	req.Header.Set(HeaderToken, config.Get().AgentToken())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("%s: %s", resp.Status, msg)
+		//认证失败和中心异常时保留快照重试
+		switch resp.StatusCode {
+		case http.StatusBadRequest, http.StatusForbidden, http.StatusRequestEntityTooLarge:
+			return &rejectedError{err}
+		}
+		return err
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package breaker
+
+import (
+	"context"
+	"db-snapshot/config"
+	"db-snapshot/event"
+	"db-snapshot/model"
+	"db-snapshot/util"
+	"fmt"
+	"github.com/gookit/slog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"sync"
+	"time"
+)
+
+// 熔断状态
+const (
+	Closed   = "closed"    //正常采集
+	Open     = "open"      //熔断，跳过采集直到下一次探测时间
+	HalfOpen = "half-open" //探测中，本次连接成功后关闭熔断
+)
+
+type breaker struct {
+	status model.InstanceStatus
+	probes int //熔断后连续探测失败次数，用于计算退避时间
+	next   time.Time
+}
+
+var (
+	mu       sync.Mutex
+	breakers = make(map[int]*breaker)
+	queue    = make(chan model.InstanceStatus, 1000) //按变化顺序保存熔断状态
+	pending  sync.WaitGroup
+)
+
+// Init 载入已保存的熔断状态并启动状态写入，重启后立即探测未恢复的实例
+// 代理模式没有元数据库，db为nil时熔断状态只保存在内存中
+func Init(db *gorm.DB) error {
+	go func() {
+		for st := range queue {
+			if db == nil {
+				pending.Done()
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			err := db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&st).Error
+			cancel()
+			if err != nil {
+				slog.Errorf("保存实例%d熔断状态失败: %v", st.InstID, err)
+			}
+			pending.Done()
+		}
+	}()
+
+	if db == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	var list []model.InstanceStatus
+	err := db.WithContext(ctx).Find(&list).Error
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, st := range list {
+		b := &breaker{status: st}
+		if st.State != Closed {
+			//重启后立即探测一次
+			b.status.State = Open
+			b.next = time.Now()
+		}
+		breakers[st.InstID] = b
+	}
+	return nil
+}
+
+// Allow 判断本次是否允许连接实例，熔断到期后转为探测
+func Allow(inst *model.Instance) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	b, ok := breakers[inst.InstId]
+	if !ok || b.status.State == Closed {
+		return true
+	}
+	if b.status.State == Open {
+		if time.Now().Before(b.next) {
+			return false
+		}
+		b.setState(HalfOpen)
+		slog.Infof("[%s:%d] 熔断到期，探测实例连接", inst.Host, inst.Port)
+		save(b.status)
+	}
+	return true
+}
+
+// IsClosed 实例是否未熔断，只读取状态，不触发探测；黑匣子等高频任务据此暂停连接，探测由定时快照负责
+func IsClosed(instId int) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	b, ok := breakers[instId]
+	return !ok || b.status.State == Closed
+}
+
+// Success 连接成功，关闭熔断
+func Success(inst *model.Instance) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	b, ok := breakers[inst.InstId]
+	if !ok || (b.status.State == Closed && b.status.Failures == 0) {
+		return
+	}
+	recovered := b.status.State != Closed
+	b.status.Failures = 0
+	b.probes = 0
+	b.next = time.Time{}
+	b.setState(Closed)
+	save(b.status)
+
+	if recovered {
+		slog.Infof("[%s:%d] 实例连接恢复，关闭熔断", inst.Host, inst.Port)
+		event.Record(inst.InstId, event.BreakerClose, time.Now(), "实例连接恢复，关闭熔断")
+	}
+}
+
+// Failure 连接失败，连续失败次数达到阈值或探测失败时熔断，退避时间指数增长
+func Failure(inst *model.Instance, err error) {
+	cfg := config.Get().Breaker
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	b, ok := breakers[inst.InstId]
+	if !ok {
+		b = &breaker{status: model.InstanceStatus{InstID: inst.InstId, State: Closed}}
+		b.status.Since = time.Now().Format("2006-01-02 15:04:05")
+		breakers[inst.InstId] = b
+	}
+	b.status.Failures++
+	b.status.LastError = err.Error()
+
+	switch {
+	case b.status.State == HalfOpen:
+		b.probes++
+	case b.status.State == Closed && b.status.Failures >= cfg.Failures:
+		b.probes = 0
+	default:
+		b.status.UpdateTime = time.Now().Format("2006-01-02 15:04:05")
+		save(b.status)
+		return
+	}
+
+	backoff := backoff(cfg, b.probes)
+	b.next = time.Now().Add(backoff)
+	next := b.next.Format("2006-01-02 15:04:05")
+	b.status.NextProbe = &next
+	b.setState(Open)
+	save(b.status)
+
+	msg := fmt.Sprintf("连续%d次连接失败，熔断%ds: %s", b.status.Failures, int(backoff.Seconds()), b.status.LastError)
+	slog.Warnf("[%s:%d] %s", inst.Host, inst.Port, msg)
+	event.Record(inst.InstId, event.BreakerOpen, time.Now(), msg)
+}
+
+// backoff 熔断后下一次探测的等待时间，每次探测失败翻倍，不超过max_backoff
+func backoff(cfg config.BreakerConfig, probes int) time.Duration {
+	d := time.Second * time.Duration(cfg.Backoff)
+	for i := 0; i < probes && d < time.Second*time.Duration(cfg.MaxBackoff); i++ {
+		d *= 2
+	}
+	return min(d, time.Second*time.Duration(cfg.MaxBackoff))
+}
+
+// Sync 清理已删除实例的熔断状态
+func Sync(instances []*model.Instance) {
+	seen := make(map[int]struct{}, len(instances))
+	for _, inst := range instances {
+		seen[inst.InstId] = struct{}{}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for instId := range breakers {
+		if _, ok := seen[instId]; !ok {
+			delete(breakers, instId)
+		}
+	}
+}
+
+func (self *breaker) setState(state string) {
+	now := time.Now().Format("2006-01-02 15:04:05")
+	if self.status.State != state {
+		self.status.State = state
+		self.status.Since = now
+	}
+	if state == Closed {
+		self.status.NextProbe = nil
+	}
+	self.status.UpdateTime = now
+}
+
+// save 异步保存熔断状态，不阻塞采集
+func save(st model.InstanceStatus) {
+	pending.Add(1)
+	select {
+	case queue <- st:
+	default:
+		pending.Done()
+		slog.Warnf("熔断状态队列已满，丢弃实例%d的状态", st.InstID)
+	}
+}
+
+// Flush 等待熔断状态写入完成，用于退出前保存，超时返回false
+func Flush(timeout time.Duration) bool {
+	return util.WaitTimeout(&pending, timeout)
+}
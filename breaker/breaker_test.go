@@ -0,0 +1,98 @@
+package breaker
+
+import (
+	"db-snapshot/config"
+	"db-snapshot/model"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	cfg := config.BreakerConfig{Failures: 3, Backoff: 60, MaxBackoff: 1800}
+	tests := []struct {
+		name   string
+		cfg    config.BreakerConfig
+		probes int
+		want   time.Duration
+	}{
+		{"首次熔断", cfg, 0, time.Minute},
+		{"探测失败1次", cfg, 1, 2 * time.Minute},
+		{"探测失败2次", cfg, 2, 4 * time.Minute},
+		{"探测失败4次", cfg, 4, 16 * time.Minute},
+		{"达到上限", cfg, 5, 30 * time.Minute},
+		{"多次失败不溢出", cfg, 100, 30 * time.Minute},
+		{"上限等于初始值", config.BreakerConfig{Backoff: 60, MaxBackoff: 60}, 3, time.Minute},
+		{"上限不是整数倍", config.BreakerConfig{Backoff: 60, MaxBackoff: 100}, 1, 100 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := backoff(tt.cfg, tt.probes); got != tt.want {
+				t.Errorf("backoff(%d) = %v, want %v", tt.probes, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransitions(t *testing.T) {
+	err := config.Init(config.Source{Flags: map[string]string{
+		"db.host": "127.0.0.1", "db.port": "3306", "db.database": "dbsnapshot",
+		"breaker.failures": "3", "breaker.backoff": "60", "breaker.max_backoff": "180",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst := &model.Instance{InstId: 1001, Host: "10.0.0.1", Port: 3306}
+	defer Sync(nil)
+	fail := errors.New("dial tcp: connection refused")
+
+	state := func() (string, time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		b := breakers[inst.InstId]
+		if b == nil {
+			return Closed, 0
+		}
+		return b.status.State, time.Until(b.next).Round(time.Second)
+	}
+	expire := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		breakers[inst.InstId].next = time.Now().Add(-time.Second)
+	}
+
+	steps := []struct {
+		name    string
+		do      func()
+		allow   bool
+		state   string
+		backoff time.Duration
+	}{
+		{"失败1次", func() { Failure(inst, fail) }, true, Closed, 0},
+		{"失败2次", func() { Failure(inst, fail) }, true, Closed, 0},
+		{"失败3次熔断", func() { Failure(inst, fail) }, false, Open, time.Minute},
+		{"熔断到期探测", expire, true, HalfOpen, 0},
+		{"探测失败退避翻倍", func() { Failure(inst, fail) }, false, Open, 2 * time.Minute},
+		{"再次探测", expire, true, HalfOpen, 0},
+		{"退避不超过上限", func() { Failure(inst, fail) }, false, Open, 3 * time.Minute},
+		{"第三次探测", expire, true, HalfOpen, 0},
+		{"探测成功关闭熔断", func() { Success(inst) }, true, Closed, 0},
+		{"关闭后重新计数", func() { Failure(inst, fail) }, true, Closed, 0},
+	}
+	for _, step := range steps {
+		step.do()
+		if got := Allow(inst); got != step.allow {
+			t.Fatalf("%s: Allow = %v, want %v", step.name, got, step.allow)
+		}
+		st, wait := state()
+		if st != step.state {
+			t.Fatalf("%s: state = %s, want %s", step.name, st, step.state)
+		}
+		if st == Open && wait != step.backoff {
+			t.Errorf("%s: backoff = %v, want %v", step.name, wait, step.backoff)
+		}
+		if IsClosed(inst.InstId) != (st == Closed) {
+			t.Errorf("%s: IsClosed = %v with state %s", step.name, IsClosed(inst.InstId), st)
+		}
+	}
+}
@@ -3,16 +3,13 @@ package mysql
 import (
 	"context"
 	"database/sql"
+	"db-snapshot/capturer"
 	"db-snapshot/config"
-	"db-snapshot/html"
+	"db-snapshot/connmgr"
 	"db-snapshot/model"
 	"db-snapshot/util"
 	"fmt"
-	"github.com/gookit/slog"
-	"gorm.io/gorm"
-	"math"
 	"strconv"
-	"strings"
 	"time"
 )
 
@@ -21,6 +18,14 @@ const ActSessSQL = `select now() create_time, id,user,db,substring_index(host,':
 	where id <> connection_id() and user not in ('system user','event_scheduler','replicator','aurora')
 	  and command not in ( 'sleep','Binlog Dump','Binlog Dump GTID') order by exec_time desc`
 
+// ActSessLiteSQL 降级采集的活动会话：processlist的info用left截断，按time倒序只取前几个会话
+const ActSessLiteSQL = `select now() create_time, id,user,db,substring_index(host,':',1) client,time exec_time,command,state,left(info,%[1]d) sql_text
+	 from information_schema.processlist
+	where id <> connection_id() and user not in ('system user','event_scheduler','replicator','aurora')
+	  and command not in ( 'sleep','Binlog Dump','Binlog Dump GTID') order by exec_time desc limit %[2]d`
+
+var ActSessColumns = []string{"当前时间", "PID", "用户", "库名", "客户端", "执行时间(s)", "命令", "状态", "SQL文本"}
+
 const TxnSQL = `select
 	now() create_time,
 	trx_mysql_thread_id p_id,
@@ -46,27 +51,74 @@ from
 order by
 	txn_exec_time desc`
 
+const TxnLiteSQL = `select
+	now() create_time,
+	trx_mysql_thread_id p_id,
+	b.user,
+	b.db,
+	substring_index(b.host,':',1) client,
+	b.command p_command,
+	b.state p_state,
+	b.time p_exec_time,
+	trx_id,
+	trx_started,
+	trx_state,
+	trx_operation_state,
+	timestampdiff(second,trx_started,now()) txn_exec_time,
+	ifnull(timestampdiff(second, trx_wait_started, now()), 0) txn_wait_time,
+	trx_tables_locked,
+	trx_rows_locked,
+	trx_rows_modified,
+	trx_isolation_level,
+	left(trx_query,%[1]d) trx_query
+from
+	information_schema.innodb_trx a left join information_schema.processlist b on b.id = a.trx_mysql_thread_id
+order by
+	txn_exec_time desc
+limit %[2]d`
+
+// LoadSQL 负载预检查，只读Threads_running状态变量，不扫描processlist
+const LoadSQL = `show global status like 'Threads_running'`
+
+// CountSQL 降级采集：汇总数不受行数限制，代替截断后的列表计算
+const CountSQL = `select now() create_time,
+	(select count(*) from information_schema.processlist) sess_count,
+	(select count(*) from information_schema.innodb_trx) txn_count,
+	(select count(*) from information_schema.innodb_trx where trx_state='LOCK WAIT') lock_count`
+
 const SessCountSQL = `select now() create_time,user,db,count(*) cnt from information_schema.processlist group by user,db order by count(*) desc limit 100`
 
+func init() {
+	capturer.Register(&capturer.Driver{
+		Name:          "mysql",
+		Aliases:       []capturer.Alias{{DBType: "mysql", Label: "MySQL"}, {DBType: "polar", Label: "PolarDB"}, {DBType: "tdsqlc", Label: "TDSQL-C"}},
+		DefaultDBName: "information_schema",
+		Capabilities:  []string{capturer.CapSession, capturer.CapTxn, capturer.CapLock, capturer.CapSessStat},
+		Open:          util.NewMysqlDB,
+		Sampler:       &capturer.Sampler{SQL: ActSessSQL, LiteSQL: ActSessLiteSQL, LoadSQL: LoadSQL, Columns: ActSessColumns},
+		Thresholds:    capturer.Thresholds{BigQuerySeconds: 10, WaitPattern: "Waiting for "},
+		New: func(i *model.Instance) model.Capturer {
+			return &Capturer{InstID: i.InstId, Host: i.Host, Port: i.Port, User: i.User, Password: i.Password, DBName: "information_schema", thresholds: capturer.LoadThresholds(i)}
+		},
+	})
+}
+
 type Capturer struct {
 	InstID     int
 	Host       string
 	Port       int
 	CreateTime string
 	DBName     string
+	User       string
+	Password   string
 	DB         *sql.DB
+	profile    capturer.Profile
+	thresholds capturer.Thresholds
 }
 
-func (self *Capturer) Init() error {
-	cfg := &model.DBConfig{self.Host, self.Port, config.Global.MonitorUser, config.Global.MonitorPassword, self.DBName}
-	db, err := util.NewMysqlDB(cfg)
-	if err != nil {
-		return err
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-	err = db.PingContext(ctx)
+func (self *Capturer) Init(ctx context.Context) error {
+	cfg := &model.DBConfig{Host: self.Host, Port: self.Port, User: self.User, Password: self.Password, Database: self.DBName, QueryTimeout: config.Get().QueryTimeout("mysql")}
+	db, err := connmgr.Get(ctx, self.InstID, "mysql", cfg, util.NewMysqlDB)
 	if err != nil {
 		return err
 	}
@@ -76,63 +128,72 @@ func (self *Capturer) Init() error {
 }
 
 func (self *Capturer) Close() {
-	self.DB.Close()
+	self.DB = nil
 }
 
-func (self *Capturer) getActSess() ([][]string, error) {
-	rows, err := util.QueryReturnList(self.DB, ActSessSQL)
+func (self *Capturer) getActSess(ctx context.Context) ([][]string, error) {
+	rows, err := util.QueryReturnList(ctx, self.DB, self.profile.Query(ActSessSQL, ActSessLiteSQL))
 	if err != nil {
 		return nil, fmt.Errorf("getActSess-> %w", err)
 	}
 	return rows, nil
 }
 
-func (self *Capturer) getTxn() ([][]string, error) {
-	rows, err := util.QueryReturnList(self.DB, TxnSQL)
+func (self *Capturer) getTxn(ctx context.Context) ([][]string, error) {
+	rows, err := util.QueryReturnList(ctx, self.DB, self.profile.Query(TxnSQL, TxnLiteSQL))
 	if err != nil {
 		return nil, fmt.Errorf("getTxn-> %w", err)
 	}
 	return rows, nil
 }
 
-func (self *Capturer) getSessCount() ([][]string, error) {
-	rows, err := util.QueryReturnList(self.DB, SessCountSQL)
+func (self *Capturer) getSessCount(ctx context.Context) ([][]string, error) {
+	rows, err := util.QueryReturnList(ctx, self.DB, SessCountSQL)
 	if err != nil {
 		return nil, fmt.Errorf("getSessCount-> %w", err)
 	}
 	return rows, nil
 }
 
-func (self *Capturer) Capture(db *gorm.DB) {
+func (self *Capturer) getCount(ctx context.Context) ([][]string, error) {
+	rows, err := util.QueryReturnList(ctx, self.DB, CountSQL)
+	if err != nil {
+		return nil, fmt.Errorf("getCount-> %w", err)
+	}
+	return rows, nil
+}
+
+func (self *Capturer) Capture(ctx context.Context) *model.Snapshot {
 	now := time.Now()
 	self.CreateTime = now.Format("2006-01-02 15:04:05")
-	dirName := fmt.Sprintf("data/%s/%d/", now.Format("200601"), self.InstID)
-	fileName := fmt.Sprintf("%s.html", now.Format("20060102_150405"))
-
-	sum := &model.DBSnapshot{InstID: self.InstID, CreateTime: self.CreateTime}
 
-	//收集快照数据
-	actSessList, err1 := self.getActSess()
-	txnList, err2 := self.getTxn()
-	sessCountList, err3 := self.getSessCount()
+	snap := model.NewSnapshot(self.InstID, self.Host, self.Port, now)
+	sum := snap.Summary
 
-	if err1 != nil {
-		sum.Msg += fmt.Sprintf("%v\n", err1)
-	}
-	if err2 != nil {
-		sum.Msg += fmt.Sprintf("%v\n", err2)
-	}
-	if err3 != nil {
-		sum.Msg += fmt.Sprintf("%v\n", err3)
+	//收集快照数据，实例负载过高时降级采集
+	g := capturer.NewGroup(ctx, "mysql")
+	self.profile = capturer.CheckLoad(ctx, self.DB, "mysql", LoadSQL)
+	self.profile.Apply(snap, g, "getSessCount")
+	actSess := g.Go("getActSess", self.getActSess)
+	txn := g.Go("getTxn", self.getTxn)
+	sessCount := g.Go("getSessCount", self.getSessCount)
+	var count *capturer.Result
+	if self.profile.Degraded() {
+		count = g.Go("getCount", self.getCount)
 	}
+	g.Wait()
 
-	if sum.Msg != "" {
-		slog.Errorf("[%s:%d] 获取快照数据报错: %s\n", self.Host, self.Port, sum.Msg)
-	}
+	actSessList, err1 := actSess.Get()
+	txnList, err2 := txn.Get()
+	sessCountList, err3 := sessCount.Get()
 
 	//统计数据
 	sum.TxnCount = len(txnList)
 	sum.ActSessCount = len(actSessList)
+	if self.profile.Degraded() {
+		//processlist只取了前几行，活动会话数取预检查的Threads_running，包含本程序的连接
+		sum.ActSessCount = self.profile.Load
+	}
 
 	//计算总连接数
 	sum.SessCount = func() int {
@@ -154,12 +215,12 @@ func (self *Capturer) Capture(db *gorm.DB) {
 		return n
 	}()
 
-	//计算大查询个数（超过10秒为大查询）
+	//计算大查询个数（执行时间超过分类规则的阈值）
 	sum.BigQueryCount = func() int {
 		cnt := 0
 		for _, v := range actSessList {
-			n, _ := strconv.Atoi(v[5])
-			if n > 10 {
+			n, _ := strconv.ParseFloat(v[5], 64)
+			if self.thresholds.BigQuery(n) {
 				cnt += 1
 			}
 		}
@@ -180,7 +241,7 @@ func (self *Capturer) Capture(db *gorm.DB) {
 	sum.WaitSessCount = func() int {
 		cnt := 0
 		for _, v := range actSessList {
-			if strings.Contains(v[7], "Waiting for ") {
+			if self.thresholds.Waiting(v[7]) {
 				cnt += 1
 			}
 		}
@@ -198,33 +259,32 @@ func (self *Capturer) Capture(db *gorm.DB) {
 		return cnt
 	}()
 
-	page := html.Html{}
-	page.AddHead1(self.CreateTime, self.InstID, self.Host, self.Port, nil)
-	page.AddHead2([]string{"活动会话数", "事务数", "总连接数", "大查询数", "等待会话数", "被锁事务数", "最长查询耗时(s)", "最长事务耗时(s)"},
-		[]int{sum.ActSessCount, sum.TxnCount, sum.SessCount, sum.BigQueryCount, sum.WaitSessCount, sum.LockCount, sum.MaxQuerySeconds, sum.MaxTxnSeconds})
+	//降级时事务数、被锁事务数、总连接数使用不限行数的汇总查询，查询失败时仍按列表计算
+	if count != nil {
+		if countList, err := count.Get(); err == nil && len(countList) > 0 {
+			sum.SessCount, _ = strconv.Atoi(countList[0][1])
+			sum.TxnCount, _ = strconv.Atoi(countList[0][2])
+			sum.LockCount, _ = strconv.Atoi(countList[0][3])
+		}
+	}
+
+	snap.AddMetric("活动会话数", "", sum.ActSessCount)
+	snap.AddMetric("事务数", "", sum.TxnCount)
+	snap.AddMetric("总连接数", "", sum.SessCount)
+	snap.AddMetric(self.profile.Bound("大查询数"), "", sum.BigQueryCount)
+	snap.AddMetric(self.profile.Bound("等待会话数"), "", sum.WaitSessCount)
+	snap.AddMetric("被锁事务数", "", sum.LockCount)
+	snap.AddMetric("最长查询耗时(s)", "", sum.MaxQuerySeconds)
+	snap.AddMetric("最长事务耗时(s)", "", sum.MaxTxnSeconds)
 
-	th1 := []string{"当前时间", "PID", "用户", "库名", "客户端", "执行时间(s)", "命令", "状态", "SQL文本"}
+	th1 := ActSessColumns
 	th2 := []string{"当前时间", "PID", "用户", "库名", "客户端", "线程命令", "线程状态", "线程执行时间(s)", "事务ID", "事务开始时间", "事务状态", "事务操作状态", "事务执行时间(s)", "等待时间(s)", "锁表数", "锁记录数", "修改行数", "事务隔离级别", "SQL文本"}
 	th3 := []string{"当前时间", "用户", "库名", "连接数"}
 
-	page.AddTable("活动会话", th1, actSessList)
-	page.AddTable("事务", th2, txnList)
-	page.AddTable("连接汇总", th3, sessCountList)
-
-	err := page.SaveToBrotli(dirName, fileName)
-	if err != nil {
-		slog.Errorf("[%s:%d] 保存快照文件报错: %v", self.Host, self.Port, err)
-	}
-
-	sum.DurationSeconds = int(math.Round(time.Since(now).Seconds()))
-	//保存快照汇总数据
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-	err = db.WithContext(ctx).Create(&sum).Error
-	if err != nil {
-		slog.Errorf("[%s:%d] 保存快照汇总数据失败: %v", self.Host, self.Port, err)
-	}
-
-	slog.Infof("[%s:%d] 保存快照汇总数据成功 %+v", self.Host, self.Port, *sum)
+	snap.AddSection(&model.Section{Title: "活动会话", Columns: th1, Rows: actSessList}, err1)
+	snap.AddSection(&model.Section{Title: "事务", Columns: th2, Rows: txnList}, err2)
+	snap.AddSection(&model.Section{Title: "连接汇总", Columns: th3, Rows: sessCountList}, err3)
 
+	self.thresholds.Apply(snap)
+	return snap
 }
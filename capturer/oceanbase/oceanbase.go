@@ -3,13 +3,12 @@ package oceanbase
 import (
 	"context"
 	"database/sql"
+	"db-snapshot/capturer"
 	"db-snapshot/config"
-	"db-snapshot/html"
+	"db-snapshot/connmgr"
 	"db-snapshot/model"
 	"db-snapshot/util"
 	"fmt"
-	"github.com/gookit/slog"
-	"gorm.io/gorm"
 	"math"
 	"strconv"
 	"time"
@@ -17,10 +16,19 @@ import (
 
 const ActSessSQL = `select curtime() create_time, svr_ip, id, user, db, user_client_ip client, tenant, round(time,3) exec_time, command, state, trans_id, info sqltext FROM oceanbase.gv$ob_processlist where state<>'SLEEP' order by exec_time desc`
 
+// ActSessLiteSQL 降级采集的活动会话：gv$ob_processlist包含所有OBServer节点的会话，截断info后按执行时间只取前几行
+const ActSessLiteSQL = `select curtime() create_time, svr_ip, id, user, db, user_client_ip client, tenant, round(time,3) exec_time, command, state, trans_id, left(info,%[1]d) sqltext FROM oceanbase.gv$ob_processlist where state<>'SLEEP' order by exec_time desc limit %[2]d`
+
+var ActSessColumns = []string{"当前时间", "节点", "PID", "用户", "库名", "客户端", "租户", "执行时间(s)", "命令", "状态", "事务ID", "SQL文本"}
+
 const TxnSQL = `with b as (select trans_id,min(ctx_create_time) ctx_create_time from oceanbase.__all_virtual_trans_stat group by trans_id)
 select curtime() create_time, svr_ip, id, user, db, user_client_ip client, tenant, round(time,3) exec_time, date_format(ctx_create_time,'%Y-%m-%d %H:%i:%s') txn_start, ifnull(timestampdiff(second,b.ctx_create_time,now()),0) txn_exec_sec,command, a.state, a.trans_id, info sqltext 
 FROM oceanbase.gv$ob_processlist a join b on a.trans_id=b.trans_id order by txn_exec_sec desc`
 
+const TxnLiteSQL = `with b as (select trans_id,min(ctx_create_time) ctx_create_time from oceanbase.__all_virtual_trans_stat group by trans_id)
+select curtime() create_time, svr_ip, id, user, db, user_client_ip client, tenant, round(time,3) exec_time, date_format(ctx_create_time,'%%Y-%%m-%%d %%H:%%i:%%s') txn_start, ifnull(timestampdiff(second,b.ctx_create_time,now()),0) txn_exec_sec,command, a.state, a.trans_id, left(info,%[1]d) sqltext 
+FROM oceanbase.gv$ob_processlist a join b on a.trans_id=b.trans_id order by txn_exec_sec desc limit %[2]d`
+
 const LockSQL = `with t as (
 select a.id1 blocker_txn,a.trans_id waiter_txn,b.id1 from oceanbase.gv$ob_locks a join oceanbase.gv$ob_locks b on a.trans_id=b.trans_id and a.block=1 and a.type='TX' and b.block=1 and b.type='TR')
 select bt.session_id,bt.tx_id,bt.ctx_create_time,timestampdiff(second,bt.ctx_create_time,now()) txn_exec_sec,bt.last_request_time,wt.session_id,wt.tx_id,wt.ctx_create_time,timestampdiff(second,wt.ctx_create_time,now()) txn_exec_sec,wt.last_request_time
@@ -30,25 +38,40 @@ const LockObjSQL = `select distinct a.trans_id,a.id1 tablet_id,a.id2 "blockingTx
 
 const SessCountSQL = `select curtime() create_time,user,db,count(*) cnt from oceanbase.gv$ob_processlist group by user,db order by count(*) desc limit 100`
 
+// LoadSQL 负载预检查，统计所有节点上非SLEEP的会话数，条件与ActSessSQL相同
+const LoadSQL = `select count(*) from oceanbase.gv$ob_processlist where state<>'SLEEP'`
+
+func init() {
+	capturer.Register(&capturer.Driver{
+		Name:          "oceanbase",
+		Aliases:       []capturer.Alias{{DBType: "oceanbase", Label: "OceanBase"}},
+		DefaultDBName: "oceanbase",
+		Capabilities:  []string{capturer.CapSession, capturer.CapTxn, capturer.CapLock, capturer.CapSessStat},
+		Open:          util.NewOceanbaseDB,
+		Sampler:       &capturer.Sampler{SQL: ActSessSQL, LiteSQL: ActSessLiteSQL, LoadSQL: LoadSQL, Columns: ActSessColumns},
+		Thresholds:    capturer.Thresholds{BigQuerySeconds: 10},
+		New: func(i *model.Instance) model.Capturer {
+			return &Capturer{InstID: i.InstId, Host: i.Host, Port: i.Port, User: i.User, Password: i.Password, DBName: "oceanbase", thresholds: capturer.LoadThresholds(i)}
+		},
+	})
+}
+
 type Capturer struct {
 	InstID     int
 	Host       string
 	Port       int
 	CreateTime string
 	DBName     string
+	User       string
+	Password   string
 	DB         *sql.DB
+	profile    capturer.Profile
+	thresholds capturer.Thresholds
 }
 
-func (self *Capturer) Init() error {
-	cfg := &model.DBConfig{self.Host, self.Port, config.Global.MonitorUser, config.Global.MonitorPassword, self.DBName}
-	db, err := util.NewMysqlDB(cfg)
-	if err != nil {
-		return err
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-	err = db.PingContext(ctx)
+func (self *Capturer) Init(ctx context.Context) error {
+	cfg := &model.DBConfig{Host: self.Host, Port: self.Port, User: self.User, Password: self.Password, Database: self.DBName, QueryTimeout: config.Get().QueryTimeout("oceanbase")}
+	db, err := connmgr.Get(ctx, self.InstID, "oceanbase", cfg, util.NewOceanbaseDB)
 	if err != nil {
 		return err
 	}
@@ -58,43 +81,43 @@ func (self *Capturer) Init() error {
 }
 
 func (self *Capturer) Close() {
-	self.DB.Close()
+	self.DB = nil
 }
 
-func (self *Capturer) getActSess() ([][]string, error) {
-	rows, err := util.QueryReturnList(self.DB, ActSessSQL)
+func (self *Capturer) getActSess(ctx context.Context) ([][]string, error) {
+	rows, err := util.QueryReturnList(ctx, self.DB, self.profile.Query(ActSessSQL, ActSessLiteSQL))
 	if err != nil {
 		return nil, fmt.Errorf("getActSess-> %w", err)
 	}
 	return rows, nil
 }
 
-func (self *Capturer) getTxn() ([][]string, error) {
-	rows, err := util.QueryReturnList(self.DB, TxnSQL)
+func (self *Capturer) getTxn(ctx context.Context) ([][]string, error) {
+	rows, err := util.QueryReturnList(ctx, self.DB, self.profile.Query(TxnSQL, TxnLiteSQL))
 	if err != nil {
 		return nil, fmt.Errorf("getTxn-> %w", err)
 	}
 	return rows, nil
 }
 
-func (self *Capturer) getLock() ([][]string, error) {
-	rows, err := util.QueryReturnList(self.DB, LockSQL)
+func (self *Capturer) getLock(ctx context.Context) ([][]string, error) {
+	rows, err := util.QueryReturnList(ctx, self.DB, LockSQL)
 	if err != nil {
 		return nil, fmt.Errorf("getLock-> %w", err)
 	}
 	return rows, nil
 }
 
-func (self *Capturer) getLockObj() ([][]string, error) {
-	rows, err := util.QueryReturnList(self.DB, LockObjSQL)
+func (self *Capturer) getLockObj(ctx context.Context) ([][]string, error) {
+	rows, err := util.QueryReturnList(ctx, self.DB, LockObjSQL)
 	if err != nil {
 		return nil, fmt.Errorf("getLockObj-> %w", err)
 	}
 	return rows, nil
 }
 
-func (self *Capturer) getSessCount() ([][]string, error) {
-	rows, err := util.QueryReturnList(self.DB, SessCountSQL)
+func (self *Capturer) getSessCount(ctx context.Context) ([][]string, error) {
+	rows, err := util.QueryReturnList(ctx, self.DB, SessCountSQL)
 	if err != nil {
 		return nil, fmt.Errorf("getSessCount-> %w", err)
 	}
@@ -102,7 +125,7 @@ func (self *Capturer) getSessCount() ([][]string, error) {
 }
 
 // 有性能问题，停止这个逻辑
-//func (self *Capturer) getBlockerSqlHist() [][]string {
+//func (self *Capturer) getBlockerSqlHist(ctx context.Context) [][]string {
 //	sql := `with t as (select t.sid pid,request_time,t.ret_code,affected_rows,t.elapsed_time / 1000000 elapsed_sec,t.query_sql sqltext from oceanbase.gv$ob_sql_audit t where sid in (select a.SESSION_ID from oceanbase.gv$ob_transaction_participants a where tx_id in( select distinct id1 from  oceanbase.gv$ob_locks  where block=1 and type='TX')))
 //select pid,from_unixtime(request_time div 1000000) request_at,ret_code,affected_rows,elapsed_sec,sqltext from (select row_number() over (partition by pid order by request_time desc) as rn,* from t) tmp where rn<4 order by pid,request_time`
 //	rows, err := self.DB.QueryReturnList(sql)
@@ -112,45 +135,37 @@ func (self *Capturer) getSessCount() ([][]string, error) {
 //	return rows
 //}
 
-func (self *Capturer) Capture(db *gorm.DB) {
+func (self *Capturer) Capture(ctx context.Context) *model.Snapshot {
 	now := time.Now()
 	self.CreateTime = now.Format("2006-01-02 15:04:05")
-	dirName := fmt.Sprintf("data/%s/%d/", now.Format("200601"), self.InstID)
-	fileName := fmt.Sprintf("%s.html", now.Format("20060102_150405"))
-
-	sum := &model.DBSnapshot{InstID: self.InstID, CreateTime: self.CreateTime}
-
-	//收集快照数据
 
-	actSessList, err1 := self.getActSess()
-	txnList, err2 := self.getTxn()
-	lockList, err3 := self.getLock()
-	lockObjList, err4 := self.getLockObj()
-	sessCountList, err5 := self.getSessCount()
-
-	if err1 != nil {
-		sum.Msg += fmt.Sprintf("%v\n", err1)
-	}
-	if err2 != nil {
-		sum.Msg += fmt.Sprintf("%v\n", err2)
-	}
-	if err3 != nil {
-		sum.Msg += fmt.Sprintf("%v\n", err3)
-	}
-	if err4 != nil {
-		sum.Msg += fmt.Sprintf("%v\n", err4)
-	}
-	if err5 != nil {
-		sum.Msg += fmt.Sprintf("%v\n", err5)
-	}
-
-	if sum.Msg != "" {
-		slog.Errorf("[%s:%d] 获取快照数据报错: %s\n", self.Host, self.Port, sum.Msg)
-	}
+	snap := model.NewSnapshot(self.InstID, self.Host, self.Port, now)
+	sum := snap.Summary
+
+	//收集快照数据，实例负载过高时降级采集，跳过锁相关的采集块
+	g := capturer.NewGroup(ctx, "oceanbase")
+	self.profile = capturer.CheckLoad(ctx, self.DB, "oceanbase", LoadSQL)
+	self.profile.Apply(snap, g, "getLock", "getLockObj")
+	actSess := g.Go("getActSess", self.getActSess)
+	txn := g.Go("getTxn", self.getTxn)
+	lock := g.Go("getLock", self.getLock)
+	lockObj := g.Go("getLockObj", self.getLockObj)
+	sessCount := g.Go("getSessCount", self.getSessCount)
+	g.Wait()
+
+	actSessList, err1 := actSess.Get()
+	txnList, err2 := txn.Get()
+	lockList, err3 := lock.Get()
+	lockObjList, err4 := lockObj.Get()
+	sessCountList, err5 := sessCount.Get()
 
 	//统计数据
 	sum.TxnCount = len(txnList)
 	sum.ActSessCount = len(actSessList)
+	if self.profile.Degraded() {
+		//gv$ob_processlist只取了前几行，活动会话数取预检查统计的非SLEEP会话数
+		sum.ActSessCount = self.profile.Load
+	}
 
 	//计算总连接数
 	sum.SessCount = func() int {
@@ -172,12 +187,12 @@ func (self *Capturer) Capture(db *gorm.DB) {
 		return int(math.Round(n))
 	}()
 
-	//计算大查询个数（超过10秒为大查询）
+	//计算大查询个数（执行时间超过分类规则的阈值）
 	sum.BigQueryCount = func() int {
 		cnt := 0
 		for _, v := range actSessList {
 			n, _ := strconv.ParseFloat(v[7], 64)
-			if n > 10 {
+			if self.thresholds.BigQuery(n) {
 				cnt += 1
 			}
 		}
@@ -200,38 +215,28 @@ func (self *Capturer) Capture(db *gorm.DB) {
 	//计算行锁数量
 	sum.LockCount = len(lockObjList)
 
-	page := html.Html{}
-	page.AddHead1(self.CreateTime, self.InstID, self.Host, self.Port, nil)
-	page.AddHead2([]string{"活动会话数", "事务数", "总连接数", "大查询数", "等待会话数", "被锁对象数", "最长查询耗时(s)", "最长事务耗时(s)"},
-		[]int{sum.ActSessCount, sum.TxnCount, sum.SessCount, sum.BigQueryCount, sum.WaitSessCount, sum.LockCount, sum.MaxQuerySeconds, sum.MaxTxnSeconds})
+	snap.AddMetric("活动会话数", "", sum.ActSessCount)
+	snap.AddMetric(self.profile.Bound("事务数"), "", sum.TxnCount)
+	snap.AddMetric("总连接数", "", sum.SessCount)
+	snap.AddMetric(self.profile.Bound("大查询数"), "", sum.BigQueryCount)
+	snap.AddMetric(self.profile.Bound("等待会话数"), "", sum.WaitSessCount)
+	snap.AddMetric(self.profile.Bound("被锁对象数"), "", sum.LockCount)
+	snap.AddMetric("最长查询耗时(s)", "", sum.MaxQuerySeconds)
+	snap.AddMetric("最长事务耗时(s)", "", sum.MaxTxnSeconds)
 
-	th1 := []string{"当前时间", "节点", "PID", "用户", "库名", "客户端", "租户", "执行时间(s)", "命令", "状态", "事务ID", "SQL文本"}
+	th1 := ActSessColumns
 	th2 := []string{"当前时间", "节点", "PID", "用户", "库名", "客户端", "租户", "执行时间(s)", "事务开始时间", "事务执行时间(s)", "命令", "状态", "事务ID", "SQL文本"}
 	th3 := []string{"堵塞者PID", "堵塞者事务ID", "事务开始时间", "事务耗时(s)", "最后请求时间", "等待者PID", "等待者事务ID", "事务开始时间", "事务耗时(s)", "最后请求时间"}
 	th4 := []string{"事务ID", "被锁对象", "持有锁事务和ID", "库名", "表名", "表ID", "表类型"}
 	//th5 := []string{"堵塞者PID", "请求时间", "返回码", "影响行数", "耗时(s)", "SQL文本"}
 	th5 := []string{"当前时间", "用户", "库名", "连接数"}
 
-	page.AddTable("活动连接", th1, actSessList)
-	page.AddTable("事务", th2, txnList)
-	page.AddTable("堵塞会话", th3, lockList)
-	page.AddTable("被锁对象", th4, lockObjList)
-	page.AddTable("连接汇总", th5, sessCountList)
-
-	err := page.SaveToBrotli(dirName, fileName)
-	if err != nil {
-		slog.Errorf("[%s:%d] 保存快照文件报错: %v", self.Host, self.Port, err)
-	}
-
-	sum.DurationSeconds = int(math.Round(time.Since(now).Seconds()))
-	//保存快照汇总数据
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-	err = db.WithContext(ctx).Create(&sum).Error
-	if err != nil {
-		slog.Errorf("[%s:%d] 保存快照汇总数据失败: %v", self.Host, self.Port, err)
-	}
-
-	slog.Infof("[%s:%d] 保存快照汇总数据成功 %+v", self.Host, self.Port, *sum)
+	snap.AddSection(&model.Section{Title: "活动连接", Columns: th1, Rows: actSessList}, err1)
+	snap.AddSection(&model.Section{Title: "事务", Columns: th2, Rows: txnList}, err2)
+	snap.AddSection(&model.Section{Title: "堵塞会话", Columns: th3, Rows: lockList}, err3)
+	snap.AddSection(&model.Section{Title: "被锁对象", Columns: th4, Rows: lockObjList}, err4)
+	snap.AddSection(&model.Section{Title: "连接汇总", Columns: th5, Rows: sessCountList}, err5)
 
+	self.thresholds.Apply(snap)
+	return snap
 }
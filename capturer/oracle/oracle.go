@@ -4,14 +4,13 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
+	"db-snapshot/capturer"
 	"db-snapshot/config"
-	"db-snapshot/html"
+	"db-snapshot/connmgr"
 	"db-snapshot/model"
 	"db-snapshot/util"
 	"fmt"
 	"github.com/gookit/slog"
-	"gorm.io/gorm"
-	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -48,9 +47,15 @@ WHERE   s.status = 'ACTIVE'
     AND s.username IS NOT NULL
     AND s.sql_id IS NOT NULL
     AND s.program not like '%(MS0%)'
+    AND nvl(s.module, '-') <> 'db-snapshot'
 ORDER BY 
     s.last_call_et DESC`
 
+// ActSessLiteSQL 黑匣子降级采样：限制行数
+var ActSessLiteSQL = "select * from (" + strings.ReplaceAll(ActSessSQL, "%", "%%") + ") where rownum <= %[2]d"
+
+var ActSessColumns = []string{"当前时间", "SID", "Serial", "用户", "客户端程序", "客户端", "当前SQL", "上一个SQL", "执行时间(s)", "阻塞者", "最终阻塞者", "等待事件", "等待类型", "等待状态", "等待时间(s)", "P1", "P2", "P3"}
+
 const TxnSQL = `select to_char(sysdate,'yyyy-mm-dd hh24:mi:ss') create_time,
        s.sid,
        s.username,
@@ -117,26 +122,39 @@ const SQLInfo = `select /*+ LEADING(t) USE_NL(s) NO_MERGE(t) PUSH_PRED(s) */ s.s
 from (SELECT column_value as sql_id FROM TABLE(sys.odcivarchar2list(%s))) t
 JOIN v$sqlstats s ON s.sql_id = t.sql_id`
 
+// LoadSQL 负载预检查，统计v$session中ACTIVE的用户会话数，不要求sql_id，比ActSessSQL的条件宽
+const LoadSQL = `select count(*) from v$session where status = 'ACTIVE' and type = 'USER' and username is not null`
+
+func init() {
+	capturer.Register(&capturer.Driver{
+		Name:         "oracle",
+		Aliases:      []capturer.Alias{{DBType: "oracle", Label: "Oracle"}},
+		Capabilities: []string{capturer.CapSession, capturer.CapTxn, capturer.CapLock, capturer.CapLongOps, capturer.CapSQLInfo, capturer.CapSessStat},
+		Open:         util.NewOracleDB,
+		Sampler:      &capturer.Sampler{SQL: ActSessSQL, LiteSQL: ActSessLiteSQL, LoadSQL: LoadSQL, Columns: ActSessColumns},
+		Thresholds:   capturer.Thresholds{LockPattern: "^enq: TX"},
+		New: func(i *model.Instance) model.Capturer {
+			return &Capturer{InstID: i.InstId, Host: i.Host, Port: i.Port, User: i.User, Password: i.Password, DBName: i.DBName, thresholds: capturer.LoadThresholds(i)}
+		},
+	})
+}
+
 type Capturer struct {
 	InstID     int
 	Host       string
 	Port       int
 	CreateTime string
 	DBName     string
+	User       string
+	Password   string
 	DB         *sql.DB
+	profile    capturer.Profile
+	thresholds capturer.Thresholds
 }
 
-func (self *Capturer) Init() error {
-	cfg := &model.DBConfig{self.Host, self.Port, config.Global.MonitorUser, config.Global.MonitorPassword, self.DBName}
-
-	db, err := util.NewOracleDB(cfg)
-	if err != nil {
-		return err
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-	err = db.PingContext(ctx)
+func (self *Capturer) Init(ctx context.Context) error {
+	cfg := &model.DBConfig{Host: self.Host, Port: self.Port, User: self.User, Password: self.Password, Database: self.DBName, QueryTimeout: config.Get().QueryTimeout("oracle")}
+	db, err := connmgr.Get(ctx, self.InstID, "oracle", cfg, util.NewOracleDB)
 	if err != nil {
 		return err
 	}
@@ -146,15 +164,23 @@ func (self *Capturer) Init() error {
 }
 
 func (self *Capturer) Close() {
-	self.DB.Close()
+	self.DB = nil
 }
 
-func (self *Capturer) getLongOps() ([][]string, error) {
+// limit 降级时限制返回的行数，活动会话和事务中只有sqlid，不需要截断SQL文本
+func (self *Capturer) limit(sqlText string) string {
+	if !self.profile.Degraded() {
+		return sqlText
+	}
+	return fmt.Sprintf("select * from (%s) where rownum <= %d", sqlText, self.profile.MaxRows)
+}
+
+func (self *Capturer) getLongOps(ctx context.Context) ([][]string, error) {
 	t := time.Now()
 	defer func() {
 		slog.Infof("[%s:%d] getLongOps 耗时 %d s", self.Host, self.Port, int(time.Since(t).Seconds()))
 	}()
-	rows, err := util.QueryReturnList(self.DB, LongOpsSQL)
+	rows, err := util.QueryReturnList(ctx, self.DB, LongOpsSQL)
 	if err != nil {
 		return nil, fmt.Errorf("getLongOps-> %w", err)
 	}
@@ -162,67 +188,67 @@ func (self *Capturer) getLongOps() ([][]string, error) {
 	return rows, nil
 }
 
-func (self *Capturer) getActSess() ([][]string, error) {
+func (self *Capturer) getActSess(ctx context.Context) ([][]string, error) {
 	t := time.Now()
 	defer func() {
 		slog.Infof("[%s:%d] getActSess 耗时 %d s", self.Host, self.Port, int(time.Since(t).Seconds()))
 	}()
-	rows, err := util.QueryReturnList(self.DB, ActSessSQL)
+	rows, err := util.QueryReturnList(ctx, self.DB, self.limit(ActSessSQL))
 	if err != nil {
 		return nil, fmt.Errorf("getActSess-> %w", err)
 	}
 	return rows, nil
 }
 
-func (self *Capturer) getTxn() ([][]string, error) {
+func (self *Capturer) getTxn(ctx context.Context) ([][]string, error) {
 	t := time.Now()
 	defer func() {
 		slog.Infof("[%s:%d] getTxn 耗时 %d s", self.Host, self.Port, int(time.Since(t).Seconds()))
 	}()
-	rows, err := util.QueryReturnList(self.DB, TxnSQL)
+	rows, err := util.QueryReturnList(ctx, self.DB, self.limit(TxnSQL))
 	if err != nil {
 		return nil, fmt.Errorf("getTxn-> %w", err)
 	}
 	return rows, nil
 }
 
-func (self *Capturer) getBlocker() ([][]string, error) {
+func (self *Capturer) getBlocker(ctx context.Context) ([][]string, error) {
 	t := time.Now()
 	defer func() {
 		slog.Infof("[%s:%d] getBlocker 耗时 %d s", self.Host, self.Port, int(time.Since(t).Seconds()))
 	}()
-	rows, err := util.QueryReturnList(self.DB, BlockerSQL)
+	rows, err := util.QueryReturnList(ctx, self.DB, BlockerSQL)
 	if err != nil {
 		return nil, fmt.Errorf("getBlocker-> %w", err)
 	}
 	return rows, nil
 }
 
-func (self *Capturer) getUserSessCount() ([][]string, error) {
+func (self *Capturer) getUserSessCount(ctx context.Context) ([][]string, error) {
 	t := time.Now()
 	defer func() {
 		slog.Infof("[%s:%d] getUserSessCount 耗时 %d s", self.Host, self.Port, int(time.Since(t).Seconds()))
 	}()
-	rows, err := util.QueryReturnList(self.DB, UserSessCountSQL)
+	rows, err := util.QueryReturnList(ctx, self.DB, UserSessCountSQL)
 	if err != nil {
 		return nil, fmt.Errorf("getUserSessCount-> %w", err)
 	}
 	return rows, nil
 }
 
-func (self *Capturer) getClientSessCount() ([][]string, error) {
+func (self *Capturer) getClientSessCount(ctx context.Context) ([][]string, error) {
 	t := time.Now()
 	defer func() {
 		slog.Infof("[%s:%d] getClientSessCount 耗时 %d s", self.Host, self.Port, int(time.Since(t).Seconds()))
 	}()
-	rows, err := util.QueryReturnList(self.DB, ClientSessCountSQL)
+	rows, err := util.QueryReturnList(ctx, self.DB, ClientSessCountSQL)
 	if err != nil {
 		return nil, fmt.Errorf("getClientSessCount-> %w", err)
 	}
 	return rows, nil
 }
 
-func (self *Capturer) getSQLInfo(sqlIds []string) ([][]string, error) {
+func (self *Capturer) getSQLInfo(ctx context.Context, sqlIds []string) ([][]string, error) {
 	t := time.Now()
 	defer func() {
 		slog.Infof("[%s:%d] getSQLInfo 耗时 %d s", self.Host, self.Port, int(time.Since(t).Seconds()))
@@ -240,7 +266,7 @@ func (self *Capturer) getSQLInfo(sqlIds []string) ([][]string, error) {
 		buf.WriteString("'")
 	}
 	query := fmt.Sprintf(SQLInfo, buf.String())
-	rows, err := util.QueryReturnList(self.DB, query)
+	rows, err := util.QueryReturnList(ctx, self.DB, query)
 	if err != nil {
 		return nil, fmt.Errorf("getSQLInfo-> %w", err)
 	}
@@ -248,59 +274,62 @@ func (self *Capturer) getSQLInfo(sqlIds []string) ([][]string, error) {
 
 }
 
-func (self *Capturer) Capture(db *gorm.DB) {
+func (self *Capturer) Capture(ctx context.Context) *model.Snapshot {
 	now := time.Now()
 	self.CreateTime = now.Format("2006-01-02 15:04:05")
-	dirName := fmt.Sprintf("data/%s/%d/", now.Format("200601"), self.InstID)
-	fileName := fmt.Sprintf("%s.html", now.Format("20060102_150405"))
-
-	sum := &model.DBSnapshot{InstID: self.InstID, CreateTime: self.CreateTime}
-
-	//收集快照数据
-	longOpsList, err1 := self.getLongOps()
-	actSessList, err2 := self.getActSess()
-	txnList, err3 := self.getTxn()
-	BlockerList, err4 := self.getBlocker()
-	//lockObjList, err5 := self.getLockObj()
-
-	userSessCountList, err6 := self.getUserSessCount()
-	clientSessCountList, err7 := self.getClientSessCount()
 
-	if err1 != nil {
-		sum.Msg += fmt.Sprintf("%v\n", err1)
-	}
-	if err2 != nil {
-		sum.Msg += fmt.Sprintf("%v\n", err2)
-	}
-	if err3 != nil {
-		sum.Msg += fmt.Sprintf("%v\n", err3)
-	}
-	if err4 != nil {
-		sum.Msg += fmt.Sprintf("%v\n", err4)
-	}
-	//if err5 != nil {
-	//	sum.Msg += fmt.Sprintf("%v\n", err5)
-	//}
-	if err6 != nil {
-		sum.Msg += fmt.Sprintf("%v\n", err6)
-	}
-	if err7 != nil {
-		sum.Msg += fmt.Sprintf("%v\n", err7)
-	}
-
-	if sum.Msg != "" {
-		slog.Errorf("[%s:%d] 获取快照数据报错: %s\n", self.Host, self.Port, sum.Msg)
-	}
-
-	sum.BigQueryCount = len(longOpsList)
+	snap := model.NewSnapshot(self.InstID, self.Host, self.Port, now)
+	snap.DBName = self.DBName
+	sum := snap.Summary
+
+	//收集快照数据，SQL信息依赖前四个采集块的sqlid；实例负载过高时降级采集，跳过阻塞者和SQL信息
+	g := capturer.NewGroup(ctx, "oracle")
+	self.profile = capturer.CheckLoad(ctx, self.DB, "oracle", LoadSQL)
+	self.profile.Apply(snap, g, "getBlocker", "getSQLInfo")
+	longOps := g.Go("getLongOps", self.getLongOps)
+	actSess := g.Go("getActSess", self.getActSess)
+	txn := g.Go("getTxn", self.getTxn)
+	blocker := g.Go("getBlocker", self.getBlocker)
+	//lockObj := g.Go("getLockObj", self.getLockObj)
+	userSessCount := g.Go("getUserSessCount", self.getUserSessCount)
+	clientSessCount := g.Go("getClientSessCount", self.getClientSessCount)
+	sqlInfo := g.Go("getSQLInfo", func(ctx context.Context) ([][]string, error) {
+		return self.getSQLInfo(ctx, collectSQLIds(longOps, actSess, txn, blocker))
+	}, longOps, actSess, txn, blocker)
+	g.Wait()
+
+	longOpsList, err1 := longOps.Get()
+	actSessList, err2 := actSess.Get()
+	txnList, err3 := txn.Get()
+	BlockerList, err4 := blocker.Get()
+	//lockObjList, err5 := lockObj.Get()
+	userSessCountList, err6 := userSessCount.Get()
+	clientSessCountList, err7 := clientSessCount.Get()
+	sqlInfoList, err8 := sqlInfo.Get()
+
+	//长操作的执行时间超过分类规则的阈值为大查询，默认全部计入
+	sum.BigQueryCount = func() int {
+		cnt := 0
+		for _, v := range longOpsList {
+			n, _ := strconv.ParseFloat(v[6], 64)
+			if self.thresholds.BigQuery(n) {
+				cnt += 1
+			}
+		}
+		return cnt
+	}()
 	sum.ActSessCount = len(actSessList)
+	if self.profile.Degraded() {
+		//v$session按rownum只取了前几行，活动会话数取预检查统计的ACTIVE用户会话数
+		sum.ActSessCount = self.profile.Load
+	}
 	sum.TxnCount = len(txnList)
 
 	//计算行锁数
 	sum.LockCount = func() int {
 		cnt := 0
 		for _, v := range actSessList {
-			if strings.HasPrefix(v[11], "enq: TX") {
+			if self.thresholds.Locked(v[11]) {
 				cnt += 1
 			}
 		}
@@ -347,24 +376,65 @@ func (self *Capturer) Capture(db *gorm.DB) {
 		return n
 	}()
 
-	//获取sqlid列表
+	snap.AddMetric("活动会话数", "actSess", sum.ActSessCount)
+	snap.AddMetric(self.profile.Bound("事务数"), "txn", sum.TxnCount)
+	snap.AddMetric("总连接数", "sessCount", sum.SessCount)
+	snap.AddMetric("大查询数", "longOps", sum.BigQueryCount)
+	snap.AddMetric(self.profile.Bound("等待会话数"), "actSess", sum.WaitSessCount)
+	snap.AddMetric(self.profile.Bound("行锁数"), "actSess", sum.LockCount)
+	snap.AddMetric("最长查询耗时(s)", "actSess", sum.MaxQuerySeconds)
+	snap.AddMetric("最长事务耗时(s)", "txn", sum.MaxTxnSeconds)
+
+	th1 := []string{"当前时间", "SID", "Serial", "用户", "当前SQL", "剩余时间", "执行时间(s)", "完成百分比", "操作名称", "涉及的对象", "涉及的对象说明", "已完成工作量", "总工作量", "单位", "开始时间", "最后更新时间"}
+	th2 := ActSessColumns
+	th3 := []string{"当前时间", "SID", "用户", "客户端", "客户端程序", "会话状态", "命令类型", "当前SQL", "上一个SQL", "等待类型", "等待事件", "阻塞者", "执行时间(s)", "XID", "事务状态", "事务开始时间", "事务已耗时(s)", "一致性读", "物理IO", "已使用的块数", "undo行数"}
+	th4 := []string{"当前时间", "SID", "Serial", "用户", "客户端", "客户端程序", "命令类型", "当前SQL", "上一个SQL", "会话状态", "等待状态", "等待类型", "等待事件", "登录时间", "等待时间(s)", "执行时间(s)", "阻塞者", "最终阻塞者", "P1", "P2", "P3"}
+	//th5 := []string{"当前时间", "库名", "对象名", "SID", "用户", "客户端", "程序", "等待事件", "阻塞者", "最终阻塞者", "登录时间", "执行时间(s)", "等待时间(s)", "locked_mode", "P1", "P2", "P3"}
+	//th5 := []string{"当前时间", "实例", "SID", "用户", "客户端程序", "状态", "等待事件", "执行时间(s)", "持有锁数", "加锁的对象"}
+
+	th6 := []string{"SQLID", "最后活动时间", "执行次数", "执行时间(s)", "平均执行时间(s)", "SQL文本"}
+	th7 := []string{"当前时间", "用户", "连接数"}
+	th8 := []string{"当前时间", "客户端", "连接数"}
+
+	snap.AddSection(&model.Section{Title: "长操作", ID: "longOps", Columns: th1, Rows: longOpsList}, err1)
+	snap.AddSection(&model.Section{Title: "活动会话", ID: "actSess", Columns: th2, Rows: actSessList, LinkCols: []int{6, 7}}, err2)
+	snap.AddSection(&model.Section{Title: "事务", ID: "txn", Columns: th3, Rows: txnList, LinkCols: []int{7, 8}}, err3)
+	snap.AddSection(&model.Section{Title: "阻塞者", ID: "blocker", Columns: th4, Rows: BlockerList, LinkCols: []int{7, 8}}, err4)
+	//snap.AddSection(&model.Section{Title: "加锁的会话与对象", ID: "lockObj", Columns: th5, Rows: lockObjList}, err5)
+
+	//不能放在页尾，跳转不精准
+	snap.AddSection(&model.Section{Title: "SQL信息", Columns: th6, Rows: sqlInfoList, AnchorCols: []int{0}}, err8)
+
+	snap.AddSection(&model.Section{Title: "连接汇总(用户)", ID: "sessCount", Columns: th7, Rows: userSessCountList}, err6)
+	snap.AddSection(&model.Section{Title: "连接汇总(客户端)", Columns: th8, Rows: clientSessCountList}, err7)
+
+	self.thresholds.Apply(snap)
+	return snap
+}
+
+// collectSQLIds 从长操作、活动会话、事务、阻塞者中提取sqlid
+func collectSQLIds(longOps, actSess, txn, blocker *capturer.Result) []string {
 	sqlIdMap := make(map[string]struct{})
 
+	longOpsList, _ := longOps.Get()
 	for _, row := range longOpsList {
 		sqlIdMap[row[4]] = struct{}{}
 	}
 
+	actSessList, _ := actSess.Get()
 	for _, row := range actSessList {
 		sqlIdMap[row[6]] = struct{}{}
 		sqlIdMap[row[7]] = struct{}{}
 	}
 
+	txnList, _ := txn.Get()
 	for _, row := range txnList {
 		sqlIdMap[row[7]] = struct{}{}
 		sqlIdMap[row[8]] = struct{}{}
 	}
 
-	for _, row := range BlockerList {
+	blockerList, _ := blocker.Get()
+	for _, row := range blockerList {
 		sqlIdMap[row[7]] = struct{}{}
 		sqlIdMap[row[8]] = struct{}{}
 	}
@@ -373,57 +443,5 @@ func (self *Capturer) Capture(db *gorm.DB) {
 	for k := range sqlIdMap {
 		sqlIds = append(sqlIds, k)
 	}
-	//slog.Debugf("[%s:%d]  sqlIds: %v", self.Host, self.Port, sqlIds)
-
-	//获取sql数据
-	sqlInfoList, err8 := self.getSQLInfo(sqlIds)
-	if err8 != nil {
-		sum.Msg += fmt.Sprintf("%v\n", err8)
-	}
-
-	page := html.Html{}
-	page.AddHead1(self.CreateTime, self.InstID, self.Host, self.Port, &self.DBName)
-
-	fieldNames := []string{"活动会话数", "事务数", "总连接数", "大查询数", "等待会话数", "行锁数", "最长查询耗时(s)", "最长事务耗时(s)"}
-	refId := []string{"actSess", "txn", "sessCount", "longOps", "actSess", "actSess", "actSess", "txn"}
-	page.AddHeadWithHref(fieldNames, refId, []int{sum.ActSessCount, sum.TxnCount, sum.SessCount, sum.BigQueryCount, sum.WaitSessCount, sum.LockCount, sum.MaxQuerySeconds, sum.MaxTxnSeconds})
-
-	th1 := []string{"当前时间", "SID", "Serial", "用户", "当前SQL", "剩余时间", "执行时间(s)", "完成百分比", "操作名称", "涉及的对象", "涉及的对象说明", "已完成工作量", "总工作量", "单位", "开始时间", "最后更新时间"}
-	th2 := []string{"当前时间", "SID", "Serial", "用户", "客户端程序", "客户端", "当前SQL", "上一个SQL", "执行时间(s)", "阻塞者", "最终阻塞者", "等待事件", "等待类型", "等待状态", "等待时间(s)", "P1", "P2", "P3"}
-	th3 := []string{"当前时间", "SID", "用户", "客户端", "客户端程序", "会话状态", "命令类型", "当前SQL", "上一个SQL", "等待类型", "等待事件", "阻塞者", "执行时间(s)", "XID", "事务状态", "事务开始时间", "事务已耗时(s)", "一致性读", "物理IO", "已使用的块数", "undo行数"}
-	th4 := []string{"当前时间", "SID", "Serial", "用户", "客户端", "客户端程序", "命令类型", "当前SQL", "上一个SQL", "会话状态", "等待状态", "等待类型", "等待事件", "登录时间", "等待时间(s)", "执行时间(s)", "阻塞者", "最终阻塞者", "P1", "P2", "P3"}
-	//th5 := []string{"当前时间", "库名", "对象名", "SID", "用户", "客户端", "程序", "等待事件", "阻塞者", "最终阻塞者", "登录时间", "执行时间(s)", "等待时间(s)", "locked_mode", "P1", "P2", "P3"}
-	//th5 := []string{"当前时间", "实例", "SID", "用户", "客户端程序", "状态", "等待事件", "执行时间(s)", "持有锁数", "加锁的对象"}
-
-	th6 := []string{"SQLID", "最后活动时间", "执行次数", "执行时间(s)", "平均执行时间(s)", "SQL文本"}
-	th7 := []string{"当前时间", "用户", "连接数"}
-	th8 := []string{"当前时间", "客户端", "连接数"}
-
-	page.AddTableWithClassID("长操作", "longOps", th1, longOpsList)
-	page.AddTableWithClassIDAndRowHref("活动会话", "actSess", th2, actSessList, []int{6, 7})
-	page.AddTableWithClassIDAndRowHref("事务", "txn", th3, txnList, []int{7, 8})
-	page.AddTableWithClassIDAndRowHref("阻塞者", "blocker", th4, BlockerList, []int{7, 8})
-	//page.AddTableWithClassID("加锁的会话与对象", "lockObj", th5, lockObjList)
-
-	//不能放在页尾，跳转不精准
-	page.AddTableRowWithClassID("SQL信息", th6, sqlInfoList, 0)
-
-	page.AddTableWithClassID("连接汇总(用户)", "sessCount", th7, userSessCountList)
-	page.AddTable("连接汇总(客户端)", th8, clientSessCountList)
-
-	err := page.SaveToBrotli(dirName, fileName)
-	if err != nil {
-		slog.Errorf("[%s:%d] 保存快照文件报错: %v", self.Host, self.Port, err)
-	}
-
-	sum.DurationSeconds = int(math.Round(time.Since(now).Seconds()))
-	//保存快照汇总数据
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-	err = db.WithContext(ctx).Create(&sum).Error
-	if err != nil {
-		slog.Errorf("[%s:%d] 保存快照汇总数据失败: %v", self.Host, self.Port, err)
-	}
-
-	slog.Infof("[%s:%d] 保存快照汇总数据成功 %+v", self.Host, self.Port, *sum)
+	return sqlIds
 }
@@ -3,25 +3,35 @@ package pgsql
 import (
 	"context"
 	"database/sql"
+	"db-snapshot/capturer"
 	"db-snapshot/config"
-	"db-snapshot/html"
+	"db-snapshot/connmgr"
 	"db-snapshot/model"
 	"db-snapshot/util"
 	"fmt"
-	"github.com/gookit/slog"
-	"gorm.io/gorm"
 	"math"
 	"strconv"
 	"time"
 )
 
-const ActSessSQL = `select to_char(now(), 'yyyy-mm-dd hh24:mi:ss') create_time,pid,datname as db,usename as user,application_name,backend_type,client_addr client,state,wait_event_type,wait_event,round(extract(epoch FROM (now()-query_start))::numeric,1) as duration_ses,to_char(query_start,'yyyy-mm-dd hh24:mi:ss') query_start,query sql_text from pg_stat_activity where state<>'idle' order by duration_ses desc`
+const ActSessSQL = `select to_char(now(), 'yyyy-mm-dd hh24:mi:ss') create_time,pid,datname as db,usename as user,application_name,backend_type,client_addr client,state,wait_event_type,wait_event,round(extract(epoch FROM (now()-query_start))::numeric,1) as duration_ses,to_char(query_start,'yyyy-mm-dd hh24:mi:ss') query_start,query sql_text from pg_stat_activity where state<>'idle' and application_name<>'db-snapshot' order by duration_ses desc`
+
+// ActSessLiteSQL 降级采集的活动会话：pg_stat_activity的query用left截断，按query_start计算的执行时间只取前几行
+const ActSessLiteSQL = `select to_char(now(), 'yyyy-mm-dd hh24:mi:ss') create_time,pid,datname as db,usename as user,application_name,backend_type,client_addr client,state,wait_event_type,wait_event,round(extract(epoch FROM (now()-query_start))::numeric,1) as duration_ses,to_char(query_start,'yyyy-mm-dd hh24:mi:ss') query_start,left(query,%[1]d) sql_text from pg_stat_activity where state<>'idle' and application_name<>'db-snapshot' order by duration_ses desc limit %[2]d`
+
+var ActSessColumns = []string{"当前时间", "PID", "库名", "用户名", "应用类型", "客户端类型", "客户端", "状态", "等待事件类型", "等待事件", "执行时间(s)", "执行开始时间", "SQL文本"}
 
 const TxnSQL = `select to_char(now(), 'yyyy-mm-dd hh24:mi:ss') create_time,pid,datname as db,usename as user,application_name,backend_type,client_addr client,state,wait_event_type,wait_event,
 round(extract(epoch from (now()-xact_start))::numeric,1) txn_exec_time,round(extract(epoch from (now()-query_start))::numeric,1) exec_time,
 to_char(xact_start,'yyyy-mm-dd hh24:mi:ss') txn_start,to_char(query_start,'yyyy-mm-dd hh24:mi:ss') query_start,
 query sql_text from pg_stat_activity 
-where state in ('active', 'idle in transaction') and xact_start is not null order by xact_start`
+where state in ('active', 'idle in transaction') and xact_start is not null and application_name<>'db-snapshot' order by xact_start`
+
+const TxnLiteSQL = `select to_char(now(), 'yyyy-mm-dd hh24:mi:ss') create_time,pid,datname as db,usename as user,application_name,backend_type,client_addr client,state,wait_event_type,wait_event,
+round(extract(epoch from (now()-xact_start))::numeric,1) txn_exec_time,round(extract(epoch from (now()-query_start))::numeric,1) exec_time,
+to_char(xact_start,'yyyy-mm-dd hh24:mi:ss') txn_start,to_char(query_start,'yyyy-mm-dd hh24:mi:ss') query_start,
+left(query,%[1]d) sql_text from pg_stat_activity 
+where state in ('active', 'idle in transaction') and xact_start is not null and application_name<>'db-snapshot' order by xact_start limit %[2]d`
 
 const LockSQL = `with lck as ( SELECT pid,COUNT(*) AS lock_count,sum(CASE WHEN GRANTED = 'f' THEN 1 else 0 end) as wait_lock_count,ARRAY_AGG(DISTINCT locktype) AS lock_types FROM pg_locks GROUP BY pid)
 SELECT to_char(now(), 'yyyy-mm-dd hh24:mi:ss') create_time,
@@ -38,7 +48,7 @@ SELECT to_char(now(), 'yyyy-mm-dd hh24:mi:ss') create_time,
        psa.query sqltext
 FROM pg_stat_activity psa
 JOIN lck ON psa.pid = lck.pid
-WHERE psa.state <> 'idle'
+WHERE psa.state <> 'idle' and psa.application_name<>'db-snapshot'
 ORDER BY xact_start`
 
 const UserSessCountSQL = `select to_char(now(), 'yyyy-mm-dd hh24:mi:ss') create_time,datname as db,usename as user,count(*) cnt from pg_stat_activity group by datname,usename order by cnt desc`
@@ -47,25 +57,40 @@ const APPSessCountSQL = `select to_char(now(), 'yyyy-mm-dd hh24:mi:ss') create_t
 
 const ClientSessCountSQL = `select to_char(now(), 'yyyy-mm-dd hh24:mi:ss') create_time,datname as db,client_addr client,count(*) cnt from pg_stat_activity group by datname,client_addr order by cnt desc`
 
+// LoadSQL 负载预检查，统计pg_stat_activity中非idle的会话数，排除本程序的连接，条件与ActSessSQL相同
+const LoadSQL = `select count(*) from pg_stat_activity where state<>'idle' and application_name<>'db-snapshot'`
+
+func init() {
+	capturer.Register(&capturer.Driver{
+		Name:          "pgsql",
+		Aliases:       []capturer.Alias{{DBType: "pgsql", Label: "PostgreSQL"}},
+		DefaultDBName: "postgres",
+		Capabilities:  []string{capturer.CapSession, capturer.CapTxn, capturer.CapLock, capturer.CapSessStat},
+		Open:          util.NewPgsqlDB,
+		Sampler:       &capturer.Sampler{SQL: ActSessSQL, LiteSQL: ActSessLiteSQL, LoadSQL: LoadSQL, Columns: ActSessColumns},
+		Thresholds:    capturer.Thresholds{BigQuerySeconds: 10, WaitPattern: "^Lock$"},
+		New: func(i *model.Instance) model.Capturer {
+			return &Capturer{InstID: i.InstId, Host: i.Host, Port: i.Port, User: i.User, Password: i.Password, DBName: "postgres", thresholds: capturer.LoadThresholds(i)}
+		},
+	})
+}
+
 type Capturer struct {
 	InstID     int
 	Host       string
 	Port       int
 	CreateTime string
 	DBName     string
+	User       string
+	Password   string
 	DB         *sql.DB
+	profile    capturer.Profile
+	thresholds capturer.Thresholds
 }
 
-func (self *Capturer) Init() error {
-	cfg := &model.DBConfig{self.Host, self.Port, config.Global.MonitorUser, config.Global.MonitorPassword, self.DBName}
-	db, err := util.NewPgsqlDB(cfg)
-	if err != nil {
-		return err
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-	err = db.PingContext(ctx)
+func (self *Capturer) Init(ctx context.Context) error {
+	cfg := &model.DBConfig{Host: self.Host, Port: self.Port, User: self.User, Password: self.Password, Database: self.DBName, QueryTimeout: config.Get().QueryTimeout("pgsql")}
+	db, err := connmgr.Get(ctx, self.InstID, "pgsql", cfg, util.NewPgsqlDB)
 	if err != nil {
 		return err
 	}
@@ -75,100 +100,90 @@ func (self *Capturer) Init() error {
 }
 
 func (self *Capturer) Close() {
-	self.DB.Close()
+	self.DB = nil
 }
 
-func (self *Capturer) getActSess() ([][]string, error) {
-	rows, err := util.QueryReturnList(self.DB, ActSessSQL)
+func (self *Capturer) getActSess(ctx context.Context) ([][]string, error) {
+	rows, err := util.QueryReturnList(ctx, self.DB, self.profile.Query(ActSessSQL, ActSessLiteSQL))
 	if err != nil {
 		return nil, fmt.Errorf("getActSess-> %w", err)
 	}
 	return rows, nil
 }
 
-func (self *Capturer) getTxn() ([][]string, error) {
-	rows, err := util.QueryReturnList(self.DB, TxnSQL)
+func (self *Capturer) getTxn(ctx context.Context) ([][]string, error) {
+	rows, err := util.QueryReturnList(ctx, self.DB, self.profile.Query(TxnSQL, TxnLiteSQL))
 	if err != nil {
 		return nil, fmt.Errorf("getTxn-> %w", err)
 	}
 	return rows, nil
 }
 
-func (self *Capturer) getLock() ([][]string, error) {
-	rows, err := util.QueryReturnList(self.DB, LockSQL)
+func (self *Capturer) getLock(ctx context.Context) ([][]string, error) {
+	rows, err := util.QueryReturnList(ctx, self.DB, LockSQL)
 	if err != nil {
 		return nil, fmt.Errorf("getLock-> %w", err)
 	}
 	return rows, nil
 }
 
-func (self *Capturer) getUserSessCount() ([][]string, error) {
-	rows, err := util.QueryReturnList(self.DB, UserSessCountSQL)
+func (self *Capturer) getUserSessCount(ctx context.Context) ([][]string, error) {
+	rows, err := util.QueryReturnList(ctx, self.DB, UserSessCountSQL)
 	if err != nil {
 		return nil, fmt.Errorf("getUserSessCount-> %w", err)
 	}
 	return rows, nil
 }
 
-func (self *Capturer) getAPPSessCount() ([][]string, error) {
-	rows, err := util.QueryReturnList(self.DB, APPSessCountSQL)
+func (self *Capturer) getAPPSessCount(ctx context.Context) ([][]string, error) {
+	rows, err := util.QueryReturnList(ctx, self.DB, APPSessCountSQL)
 	if err != nil {
 		return nil, fmt.Errorf("getAPPSessCount-> %w", err)
 	}
 	return rows, nil
 }
 
-func (self *Capturer) getClientSessCount() ([][]string, error) {
-	rows, err := util.QueryReturnList(self.DB, ClientSessCountSQL)
+func (self *Capturer) getClientSessCount(ctx context.Context) ([][]string, error) {
+	rows, err := util.QueryReturnList(ctx, self.DB, ClientSessCountSQL)
 	if err != nil {
 		return nil, fmt.Errorf("getClientSessCount-> %w", err)
 	}
 	return rows, nil
 }
 
-func (self *Capturer) Capture(db *gorm.DB) {
+func (self *Capturer) Capture(ctx context.Context) *model.Snapshot {
 	now := time.Now()
 	self.CreateTime = now.Format("2006-01-02 15:04:05")
-	dirName := fmt.Sprintf("data/%s/%d/", now.Format("200601"), self.InstID)
-	fileName := fmt.Sprintf("%s.html", now.Format("20060102_150405"))
-
-	sum := &model.DBSnapshot{InstID: self.InstID, CreateTime: self.CreateTime}
-
-	//收集快照数据
-
-	actSessList, err1 := self.getActSess()
-	txnList, err2 := self.getTxn()
-	lockList, err3 := self.getLock()
-	userSessCountList, err4 := self.getUserSessCount()
-	appSessCountList, err5 := self.getAPPSessCount()
-	clientSessCountList, err6 := self.getClientSessCount()
-
-	if err1 != nil {
-		sum.Msg += fmt.Sprintf("%v\n", err1)
-	}
-	if err2 != nil {
-		sum.Msg += fmt.Sprintf("%v\n", err2)
-	}
-	if err3 != nil {
-		sum.Msg += fmt.Sprintf("%v\n", err3)
-	}
-	if err4 != nil {
-		sum.Msg += fmt.Sprintf("%v\n", err4)
-	}
-	if err5 != nil {
-		sum.Msg += fmt.Sprintf("%v\n", err5)
-	}
-	if err6 != nil {
-		sum.Msg += fmt.Sprintf("%v\n", err6)
-	}
 
-	if sum.Msg != "" {
-		slog.Errorf("[%s:%d] 获取快照数据报错: %s\n", self.Host, self.Port, sum.Msg)
-	}
+	snap := model.NewSnapshot(self.InstID, self.Host, self.Port, now)
+	sum := snap.Summary
+
+	//收集快照数据，实例负载过高时降级采集，跳过关联pg_locks的采集块
+	g := capturer.NewGroup(ctx, "pgsql")
+	self.profile = capturer.CheckLoad(ctx, self.DB, "pgsql", LoadSQL)
+	self.profile.Apply(snap, g, "getLock")
+	actSess := g.Go("getActSess", self.getActSess)
+	txn := g.Go("getTxn", self.getTxn)
+	lock := g.Go("getLock", self.getLock)
+	userSessCount := g.Go("getUserSessCount", self.getUserSessCount)
+	appSessCount := g.Go("getAPPSessCount", self.getAPPSessCount)
+	clientSessCount := g.Go("getClientSessCount", self.getClientSessCount)
+	g.Wait()
+
+	actSessList, err1 := actSess.Get()
+	txnList, err2 := txn.Get()
+	lockList, err3 := lock.Get()
+	userSessCountList, err4 := userSessCount.Get()
+	appSessCountList, err5 := appSessCount.Get()
+	clientSessCountList, err6 := clientSessCount.Get()
 
 	//统计数据
 	sum.TxnCount = len(txnList)
 	sum.ActSessCount = len(actSessList)
+	if self.profile.Degraded() {
+		//pg_stat_activity只取了前几行，活动会话数取预检查统计的非idle会话数
+		sum.ActSessCount = self.profile.Load
+	}
 
 	//计算总连接数
 	sum.SessCount = func() int {
@@ -192,12 +207,12 @@ func (self *Capturer) Capture(db *gorm.DB) {
 		return 0
 	}()
 
-	//计算大查询个数（超过10秒为大查询）
+	//计算大查询个数（执行时间超过分类规则的阈值）
 	sum.BigQueryCount = func() int {
 		cnt := 0
 		for _, v := range actSessList {
 			n, _ := strconv.ParseFloat(v[10], 64)
-			if n > 10 {
+			if self.thresholds.BigQuery(n) {
 				cnt += 1
 			}
 		}
@@ -227,21 +242,25 @@ func (self *Capturer) Capture(db *gorm.DB) {
 	}()
 	sum.WaitSessCount = func() int {
 		n := 0
-		//等待事件类型为Lock
+		//等待事件类型匹配分类规则，默认为Lock
 		for _, v := range actSessList {
-			if v[8] == "Lock" {
+			if self.thresholds.Waiting(v[8]) {
 				n++
 			}
 		}
 		return n
 	}()
 
-	page := html.Html{}
-	page.AddHead1(self.CreateTime, self.InstID, self.Host, self.Port, nil)
-	page.AddHead2([]string{"活动会话数", "事务数", "总连接数", "大查询数", "等待会话数", "被锁会话数", "最长查询耗时(s)", "最长事务耗时(s)"},
-		[]int{sum.ActSessCount, sum.TxnCount, sum.SessCount, sum.BigQueryCount, sum.WaitSessCount, sum.LockCount, sum.MaxQuerySeconds, sum.MaxTxnSeconds})
+	snap.AddMetric("活动会话数", "", sum.ActSessCount)
+	snap.AddMetric(self.profile.Bound("事务数"), "", sum.TxnCount)
+	snap.AddMetric("总连接数", "", sum.SessCount)
+	snap.AddMetric(self.profile.Bound("大查询数"), "", sum.BigQueryCount)
+	snap.AddMetric(self.profile.Bound("等待会话数"), "", sum.WaitSessCount)
+	snap.AddMetric(self.profile.Bound("被锁会话数"), "", sum.LockCount)
+	snap.AddMetric("最长查询耗时(s)", "", sum.MaxQuerySeconds)
+	snap.AddMetric("最长事务耗时(s)", "", sum.MaxTxnSeconds)
 
-	th1 := []string{"当前时间", "PID", "库名", "用户名", "应用类型", "客户端类型", "客户端", "状态", "等待事件类型", "等待事件", "执行时间(s)", "执行开始时间", "SQL文本"}
+	th1 := ActSessColumns
 	th2 := []string{"当前时间", "PID", "库名", "用户名", "应用类型", "客户端类型", "客户端", "状态", "等待事件类型", "等待事件", "事务执行时间(s)", "执行时间(s)", "事务开始时间", "执行开始时间", "SQL文本"}
 	th3 := []string{"当前时间", "PID", "堵塞者PID", "库名", "应用类型", "开始时间", "状态", "事务执行时间(s)", "锁数", "等待的锁数", "锁类型", "SQL文本"}
 
@@ -249,28 +268,14 @@ func (self *Capturer) Capture(db *gorm.DB) {
 	th5 := []string{"当前时间", "库名", "应用类型", "连接数"}
 	th6 := []string{"当前时间", "库名", "客户端", "连接数"}
 
-	page.AddTable("活动连接", th1, actSessList)
-	page.AddTable("事务", th2, txnList)
-	page.AddTable("锁（按会话统计）", th3, lockList)
-
-	page.AddTable("连接汇总(按用户)", th4, userSessCountList)
-	page.AddTable("连接汇总(按应用类型)", th5, appSessCountList)
-	page.AddTable("连接汇总(按客户端)", th6, clientSessCountList)
-
-	err := page.SaveToBrotli(dirName, fileName)
-	if err != nil {
-		slog.Errorf("[%s:%d] 保存快照文件报错: %v", self.Host, self.Port, err)
-	}
-
-	sum.DurationSeconds = int(math.Round(time.Since(now).Seconds()))
-	//保存快照汇总数据
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-	err = db.WithContext(ctx).Create(&sum).Error
-	if err != nil {
-		slog.Errorf("[%s:%d] 保存快照汇总数据失败: %v", self.Host, self.Port, err)
-	}
+	snap.AddSection(&model.Section{Title: "活动连接", Columns: th1, Rows: actSessList}, err1)
+	snap.AddSection(&model.Section{Title: "事务", Columns: th2, Rows: txnList}, err2)
+	snap.AddSection(&model.Section{Title: "锁（按会话统计）", Columns: th3, Rows: lockList}, err3)
 
-	slog.Infof("[%s:%d] 保存快照汇总数据成功 %+v", self.Host, self.Port, *sum)
+	snap.AddSection(&model.Section{Title: "连接汇总(按用户)", Columns: th4, Rows: userSessCountList}, err4)
+	snap.AddSection(&model.Section{Title: "连接汇总(按应用类型)", Columns: th5, Rows: appSessCountList}, err5)
+	snap.AddSection(&model.Section{Title: "连接汇总(按客户端)", Columns: th6, Rows: clientSessCountList}, err6)
 
+	self.thresholds.Apply(snap)
+	return snap
 }
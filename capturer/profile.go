@@ -0,0 +1,97 @@
+package capturer
+
+import (
+	"context"
+	"database/sql"
+	"db-snapshot/config"
+	"db-snapshot/model"
+	"db-snapshot/util"
+	"fmt"
+	"github.com/gookit/slog"
+	"strconv"
+	"strings"
+)
+
+// 采集档位
+const (
+	ProfileFull     = "full"     //完整采集
+	ProfileDegraded = "degraded" //实例负载过高，降级采集
+)
+
+// Profile 本次快照的采集档位
+type Profile struct {
+	Name    string
+	Load    int //预检查得到的活动会话数，未执行预检查时为-1
+	MaxRows int //降级时每个采集块最多返回的行数
+	TextLen int //降级时SQL文本截断的长度
+}
+
+// Degraded 是否降级采集
+func (self Profile) Degraded() bool {
+	return self.Name == ProfileDegraded
+}
+
+// CheckLoad 执行开销很小的预检查，活动会话数达到阈值时返回降级档位，预检查失败时完整采集
+// loadSQL 返回一行，最后一列为活动会话数
+func CheckLoad(ctx context.Context, db *sql.DB, driver, loadSQL string) Profile {
+	cfg := config.Get().Degrade
+	p := Profile{Name: ProfileFull, Load: -1, MaxRows: cfg.MaxRows, TextLen: cfg.SQLTextLen}
+	if cfg.ActSessCount <= 0 {
+		return p
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.Get().GetSectionTimeout(driver, "checkLoad"))
+	defer cancel()
+	rows, err := util.QueryReturnList(ctx, db, loadSQL)
+	if err != nil || len(rows) == 0 {
+		slog.Warnf("%s 负载预检查失败，完整采集: %v", driver, err)
+		return p
+	}
+	row := rows[0]
+	p.Load, err = strconv.Atoi(row[len(row)-1])
+	if err != nil {
+		slog.Warnf("%s 负载预检查结果无效，完整采集: %v", driver, row)
+		p.Load = -1
+		return p
+	}
+	if p.Load >= cfg.ActSessCount {
+		p.Name = ProfileDegraded
+	}
+	return p
+}
+
+// Apply 记录采集档位，降级时跳过开销大的采集块，并在快照开头说明原因
+func (self Profile) Apply(snap *model.Snapshot, g *Group, heavy ...string) {
+	snap.Summary.Profile = self.Name
+	if !self.Degraded() {
+		return
+	}
+	g.Skip(heavy...)
+	snap.AddSection(&model.Section{
+		Title:   "降级采集",
+		Columns: []string{"活动会话数", "降级阈值", "每块最多行数", "SQL文本长度", "跳过的采集块"},
+		Rows: [][]string{{
+			strconv.Itoa(self.Load),
+			strconv.Itoa(config.Get().Degrade.ActSessCount),
+			strconv.Itoa(self.MaxRows),
+			strconv.Itoa(self.TextLen),
+			strings.Join(heavy, ","),
+		}},
+	}, nil)
+}
+
+// Bound 降级时只能根据截断后的列表统计的指标，标注为下限
+func (self Profile) Bound(title string) string {
+	if !self.Degraded() {
+		return title
+	}
+	return title + "(下限)"
+}
+
+// Query 返回本次使用的查询，降级时使用lite，lite中%[1]d为SQL文本长度，%[2]d为最多行数
+func (self Profile) Query(full, lite string) string {
+	if !self.Degraded() {
+		return full
+	}
+	return fmt.Sprintf(lite, self.TextLen, self.MaxRows)
+}
@@ -0,0 +1,126 @@
+package capturer
+
+import (
+	"context"
+	"database/sql"
+	"db-snapshot/config"
+	"db-snapshot/model"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 采集能力，供页面和调度判断
+const (
+	CapSession  = "session"
+	CapTxn      = "txn"
+	CapLock     = "lock"
+	CapLongOps  = "longops"
+	CapSQLInfo  = "sqlinfo"
+	CapSessStat = "sess_stat"
+)
+
+// Alias 一个db_type及其页面显示名称
+type Alias struct {
+	DBType string
+	Label  string
+}
+
+// Sampler 黑匣子使用的低开销活动会话查询
+type Sampler struct {
+	SQL     string
+	LiteSQL string //负载过高时使用，格式同 Profile.Query 的lite，为空时降级期间暂停采样
+	LoadSQL string //负载预检查，为空时不检查
+	Columns []string
+}
+
+// Driver 一种数据库引擎的采集实现
+type Driver struct {
+	Name          string
+	Aliases       []Alias
+	DefaultDBName string // 非空时忽略实例配置的db_name
+	Capabilities  []string
+	Open          func(cfg *model.DBConfig) (*sql.DB, error)
+	Ping          func(ctx context.Context, cfg *model.DBConfig) error // 为空时使用 Open + PingContext
+	New           func(i *model.Instance) model.Capturer
+	Sampler       *Sampler   // 为空时不支持黑匣子
+	Thresholds    Thresholds // 默认分类规则
+}
+
+var (
+	mu      sync.RWMutex
+	drivers []*Driver
+	byType  = make(map[string]*Driver)
+)
+
+// Register 由各采集包在init中注册
+func Register(d *Driver) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if d.Open == nil || d.New == nil {
+		panic(fmt.Sprintf("capturer %s: Open and New must not be nil", d.Name))
+	}
+	for _, a := range d.Aliases {
+		if _, ok := byType[a.DBType]; ok {
+			panic(fmt.Sprintf("capturer %s: db_type %s already registered", d.Name, a.DBType))
+		}
+		byType[a.DBType] = d
+	}
+	drivers = append(drivers, d)
+}
+
+func Lookup(dbType string) (*Driver, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	d, ok := byType[dbType]
+	if !ok {
+		return nil, fmt.Errorf("不支持该数据库类型: %s", dbType)
+	}
+	return d, nil
+}
+
+// Drivers 按注册顺序返回所有采集实现
+func Drivers() []*Driver {
+	mu.RLock()
+	defer mu.RUnlock()
+	return append([]*Driver(nil), drivers...)
+}
+
+// DBName 返回连接实例时使用的库名
+func (self *Driver) DBName(dbName string) string {
+	if self.DefaultDBName != "" {
+		return self.DefaultDBName
+	}
+	return dbName
+}
+
+func New(i *model.Instance) (model.Capturer, error) {
+	d, err := Lookup(i.DBType)
+	if err != nil {
+		return nil, err
+	}
+	return d.New(i), nil
+}
+
+func Ping(ctx context.Context, dbType string, cfg *model.DBConfig) error {
+	d, err := Lookup(dbType)
+	if err != nil {
+		return err
+	}
+	cfg.Database = d.DBName(cfg.Database)
+	cfg.QueryTimeout = config.Get().QueryTimeout(d.Name)
+	if d.Ping != nil {
+		return d.Ping(ctx, cfg)
+	}
+
+	db, err := d.Open(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	return db.PingContext(ctx)
+}
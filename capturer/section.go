@@ -0,0 +1,83 @@
+package capturer
+
+import (
+	"context"
+	"db-snapshot/config"
+	"db-snapshot/model"
+	"fmt"
+	"sync"
+)
+
+// Result 一个采集块的执行结果
+type Result struct {
+	rows [][]string
+	err  error
+	done chan struct{}
+}
+
+// Get 等待采集块执行完成并返回结果
+func (self *Result) Get() ([][]string, error) {
+	<-self.done
+	return self.rows, self.err
+}
+
+// Group 并发执行同一实例的多个采集块，每个采集块有独立的超时时间
+type Group struct {
+	ctx    context.Context
+	driver string
+	wg     sync.WaitGroup
+	skip   map[string]struct{}
+}
+
+func NewGroup(ctx context.Context, driver string) *Group {
+	return &Group{ctx: ctx, driver: driver}
+}
+
+// Skip 跳过指定的采集块，用于降级采集
+func (self *Group) Skip(names ...string) {
+	if self.skip == nil {
+		self.skip = make(map[string]struct{})
+	}
+	for _, name := range names {
+		self.skip[name] = struct{}{}
+	}
+}
+
+// Go 启动一个采集块，deps 中的采集块全部完成后才开始执行，超时时间从开始执行时计算
+func (self *Group) Go(name string, fn func(ctx context.Context) ([][]string, error), deps ...*Result) *Result {
+	r := &Result{done: make(chan struct{})}
+	if _, ok := self.skip[name]; ok {
+		r.err = fmt.Errorf("%s-> %w", name, model.ErrSkipped)
+		close(r.done)
+		return r
+	}
+	self.wg.Add(1)
+	go func() {
+		defer self.wg.Done()
+		defer close(r.done)
+		defer func() {
+			if e := recover(); e != nil {
+				r.err = fmt.Errorf("%s-> panic: %v", name, e)
+			}
+		}()
+
+		for _, d := range deps {
+			select {
+			case <-d.done:
+			case <-self.ctx.Done():
+				r.err = fmt.Errorf("%s-> %w", name, self.ctx.Err())
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(self.ctx, config.Get().GetSectionTimeout(self.driver, name))
+		defer cancel()
+		r.rows, r.err = fn(ctx)
+	}()
+	return r
+}
+
+// Wait 等待所有采集块执行完成
+func (self *Group) Wait() {
+	self.wg.Wait()
+}
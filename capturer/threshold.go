@@ -0,0 +1,88 @@
+package capturer
+
+import (
+	"db-snapshot/config"
+	"db-snapshot/model"
+	"github.com/gookit/slog"
+	"regexp"
+	"strconv"
+)
+
+// ThresholdDefault 实例未指定分类规则时使用数据库类型的默认规则
+const ThresholdDefault = "default"
+
+// Thresholds 快照汇总的分类规则，各数据库在注册时提供默认值，配置文件中按数据库类型和规则名覆盖
+type Thresholds struct {
+	Name            string //生效的规则名
+	BigQuerySeconds int    //执行时间超过该值为大查询(s)，0表示全部计入
+	WaitPattern     string //等待会话的匹配规则（正则），为空表示不按规则判断
+	LockPattern     string //行锁的匹配规则（正则），为空表示不按规则判断
+	wait            *regexp.Regexp
+	lock            *regexp.Regexp
+}
+
+// LoadThresholds 返回实例生效的分类规则：数据库类型的默认规则，依次被 [threshold.<数据库引擎>] 和实例指定的 [threshold.<规则名>] 覆盖
+func LoadThresholds(i *model.Instance) Thresholds {
+	d, err := Lookup(i.DBType)
+	if err != nil {
+		return Thresholds{Name: ThresholdDefault}
+	}
+	t := d.Thresholds
+	t.Name = ThresholdDefault
+	t.merge(config.Get().Thresholds[d.Name])
+	if i.Threshold != "" {
+		p, ok := config.Get().Thresholds[i.Threshold]
+		if ok {
+			t.Name = i.Threshold
+			t.merge(p)
+		} else {
+			slog.Warnf("[%s:%d] 分类规则 %s 未配置，使用默认规则", i.Host, i.Port, i.Threshold)
+		}
+	}
+
+	//配置在载入时已校验
+	if t.WaitPattern != "" {
+		t.wait, _ = regexp.Compile(t.WaitPattern)
+	}
+	if t.LockPattern != "" {
+		t.lock, _ = regexp.Compile(t.LockPattern)
+	}
+	return t
+}
+
+func (self *Thresholds) merge(p map[string]string) {
+	if v, ok := p[config.ThresholdBigQuerySeconds]; ok {
+		self.BigQuerySeconds, _ = strconv.Atoi(v)
+	}
+	if v, ok := p[config.ThresholdWaitPattern]; ok {
+		self.WaitPattern = v
+	}
+	if v, ok := p[config.ThresholdLockPattern]; ok {
+		self.LockPattern = v
+	}
+}
+
+// BigQuery 执行时间是否达到大查询
+func (self Thresholds) BigQuery(seconds float64) bool {
+	return self.BigQuerySeconds == 0 || seconds > float64(self.BigQuerySeconds)
+}
+
+// Waiting 是否为等待会话
+func (self Thresholds) Waiting(s string) bool {
+	return self.wait != nil && self.wait.MatchString(s)
+}
+
+// Locked 是否为行锁等待
+func (self Thresholds) Locked(s string) bool {
+	return self.lock != nil && self.lock.MatchString(s)
+}
+
+// Apply 在快照汇总中记录生效的规则名，并在快照页尾列出规则
+func (self Thresholds) Apply(snap *model.Snapshot) {
+	snap.Summary.Threshold = self.Name
+	snap.AddSection(&model.Section{
+		Title:   "分类规则",
+		Columns: []string{"规则名", "大查询(s)", "等待会话规则", "行锁规则"},
+		Rows:    [][]string{{self.Name, strconv.Itoa(self.BigQuerySeconds), self.WaitPattern, self.LockPattern}},
+	}, nil)
+}
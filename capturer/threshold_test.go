@@ -0,0 +1,122 @@
+package capturer
+
+import (
+	"database/sql"
+	"db-snapshot/config"
+	"db-snapshot/model"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const thresholdINI = `[db]
+host = "127.0.0.1"
+port = 3306
+database = "dbsnapshot"
+
+[threshold.testdb]
+big_query_seconds = 10
+wait_pattern = "^enq: "
+
+[threshold.olap]
+big_query_seconds = 300
+
+[threshold.nolock]
+lock_pattern = ""
+`
+
+func TestLoadThresholds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.ini")
+	if err := os.WriteFile(path, []byte(thresholdINI), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Init(config.Source{File: path}); err != nil {
+		t.Fatal(err)
+	}
+	Register(&Driver{
+		Name:    "testdb",
+		Aliases: []Alias{{DBType: "testdb", Label: "TestDB"}},
+		Open:    func(cfg *model.DBConfig) (*sql.DB, error) { return nil, nil },
+		New:     func(i *model.Instance) model.Capturer { return nil },
+		Thresholds: Thresholds{
+			BigQuerySeconds: 5,
+			WaitPattern:     "^lock wait",
+			LockPattern:     "row lock",
+		},
+	})
+
+	tests := []struct {
+		name      string
+		inst      model.Instance
+		want      Thresholds
+		bigQuery  float64
+		isBig     bool
+		waitEvent string
+		waiting   bool
+		lockEvent string
+		locked    bool
+	}{
+		//[threshold.testdb] 覆盖大查询和等待规则，行锁规则沿用驱动默认值
+		{"数据库类型覆盖默认值", model.Instance{DBType: "testdb"},
+			Thresholds{Name: ThresholdDefault, BigQuerySeconds: 10, WaitPattern: "^enq: ", LockPattern: "row lock"},
+			10, false, "enq: TX - row lock contention", true, "row lock contention", true},
+		//规则名只覆盖配置了的项
+		{"规则名覆盖数据库类型", model.Instance{DBType: "testdb", Threshold: "olap"},
+			Thresholds{Name: "olap", BigQuerySeconds: 300, WaitPattern: "^enq: ", LockPattern: "row lock"},
+			301, true, "lock wait", false, "row lock", true},
+		//配置为空表示不按规则判断
+		{"规则名清空行锁规则", model.Instance{DBType: "testdb", Threshold: "nolock"},
+			Thresholds{Name: "nolock", BigQuerySeconds: 10, WaitPattern: "^enq: ", LockPattern: ""},
+			11, true, "enq: TX", true, "row lock", false},
+		{"规则名未配置", model.Instance{DBType: "testdb", Threshold: "missing"},
+			Thresholds{Name: ThresholdDefault, BigQuerySeconds: 10, WaitPattern: "^enq: ", LockPattern: "row lock"},
+			10.5, true, "lock wait", false, "row lock", true},
+		{"不支持的数据库类型", model.Instance{DBType: "unknown"},
+			Thresholds{Name: ThresholdDefault},
+			0.1, true, "enq: TX", false, "row lock", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := LoadThresholds(&tt.inst)
+			if got.Name != tt.want.Name || got.BigQuerySeconds != tt.want.BigQuerySeconds ||
+				got.WaitPattern != tt.want.WaitPattern || got.LockPattern != tt.want.LockPattern {
+				t.Fatalf("LoadThresholds = %+v, want %+v", got, tt.want)
+			}
+			if b := got.BigQuery(tt.bigQuery); b != tt.isBig {
+				t.Errorf("BigQuery(%v) = %v, want %v", tt.bigQuery, b, tt.isBig)
+			}
+			if w := got.Waiting(tt.waitEvent); w != tt.waiting {
+				t.Errorf("Waiting(%q) = %v, want %v", tt.waitEvent, w, tt.waiting)
+			}
+			if l := got.Locked(tt.lockEvent); l != tt.locked {
+				t.Errorf("Locked(%q) = %v, want %v", tt.lockEvent, l, tt.locked)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	base := Thresholds{BigQuerySeconds: 5, WaitPattern: "w", LockPattern: "l"}
+	tests := []struct {
+		name string
+		p    map[string]string
+		want Thresholds
+	}{
+		{"未配置", nil, base},
+		{"大查询为0表示全部计入", map[string]string{config.ThresholdBigQuerySeconds: "0"}, Thresholds{WaitPattern: "w", LockPattern: "l"}},
+		{"覆盖全部", map[string]string{
+			config.ThresholdBigQuerySeconds: "60",
+			config.ThresholdWaitPattern:     "x",
+			config.ThresholdLockPattern:     "y",
+		}, Thresholds{BigQuerySeconds: 60, WaitPattern: "x", LockPattern: "y"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := base
+			got.merge(tt.p)
+			if got.BigQuerySeconds != tt.want.BigQuerySeconds || got.WaitPattern != tt.want.WaitPattern || got.LockPattern != tt.want.LockPattern {
+				t.Errorf("merge = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
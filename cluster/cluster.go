@@ -0,0 +1,300 @@
+package cluster
+
+import (
+	"context"
+	"db-snapshot/config"
+	"db-snapshot/model"
+	"fmt"
+	"github.com/gookit/slog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// VirtualNodes 一致性哈希中每个节点的虚拟节点数，使实例分配均匀
+const VirtualNodes = 100
+
+// Status 集群状态
+type Status struct {
+	Mode   string
+	Node   string   //本节点
+	Leader string   //主备模式持有租约的节点
+	Nodes  []string //存活的节点
+	Active bool     //本节点是否在采集
+}
+
+var (
+	mu       sync.RWMutex
+	store    *gorm.DB
+	cfg      config.ClusterConfig
+	leader   string
+	nodes    []string
+	ring     []point
+	validTo  time.Time //租约在本地的有效期，元数据库不可达时据此放弃主节点；多活模式为本节点心跳的有效期
+	onChange func()
+	stop     = make(chan struct{})
+	stopOnce sync.Once
+)
+
+type point struct {
+	hash uint32
+	node string
+}
+
+// Start 注册节点并开始续约，change在本节点负责的实例变化时调用；单节点模式不做任何事
+func Start(db *gorm.DB, change func()) error {
+	cfg = config.Get().Cluster
+	if cfg.Mode == config.ClusterSingle {
+		return nil
+	}
+	store = db
+	onChange = change
+
+	//启动时同步续约一次，调度开始前确定本节点负责的实例
+	if err := renew(); err != nil {
+		return err
+	}
+	st := Get()
+	slog.Infof("集群模式 %s，节点 %s，存活节点 %v，主节点 %s", cfg.Mode, cfg.Node, st.Nodes, st.Leader)
+
+	go func() {
+		ticker := time.NewTicker(period())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := renew(); err != nil {
+					slog.Errorf("集群续约失败: %v", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop 注销节点并释放租约，其他节点立即接管本节点的实例
+func Stop() {
+	if cfg.Mode == config.ClusterSingle {
+		return
+	}
+	stopOnce.Do(func() { close(stop) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	db := store.WithContext(ctx)
+	if err := db.Exec("DELETE FROM db_snapshot_node WHERE node = ?", cfg.Node).Error; err != nil {
+		slog.Errorf("注销集群节点失败: %v", err)
+	}
+	if cfg.Mode == config.ClusterStandby {
+		err := db.Exec("UPDATE db_snapshot_leader SET expire_time = NOW(3) WHERE id = 'leader' AND node = ?", cfg.Node).Error
+		if err != nil {
+			slog.Errorf("释放主节点租约失败: %v", err)
+		}
+	}
+}
+
+// Filter 返回本节点负责采集的实例
+func Filter(list []*model.Instance) []*model.Instance {
+	if cfg.Mode == config.ClusterSingle {
+		return list
+	}
+	owned := make([]*model.Instance, 0, len(list))
+	for _, v := range list {
+		if Owns(v.InstId) {
+			owned = append(owned, v)
+		}
+	}
+	return owned
+}
+
+// Owns 判断实例是否由本节点采集
+func Owns(instId int) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	switch cfg.Mode {
+	case config.ClusterStandby:
+		return leader == cfg.Node && time.Now().Before(validTo)
+	case config.ClusterShard:
+		//本节点心跳过期后其他节点已把它移出哈希环，不再采集
+		return time.Now().Before(validTo) && locate(ring, instId) == cfg.Node
+	default:
+		return true
+	}
+}
+
+// Get 返回集群状态
+func Get() Status {
+	mu.RLock()
+	defer mu.RUnlock()
+	st := Status{Mode: cfg.Mode, Node: cfg.Node, Leader: leader, Nodes: slices.Clone(nodes), Active: true}
+	switch cfg.Mode {
+	case config.ClusterStandby:
+		st.Active = leader == cfg.Node && time.Now().Before(validTo)
+	case config.ClusterShard:
+		st.Active = time.Now().Before(validTo)
+	}
+	return st
+}
+
+// period 续约间隔，租约时间的1/3
+func period() time.Duration {
+	return time.Second * time.Duration(cfg.Lease) / 3
+}
+
+// renew 更新节点心跳，主备模式争抢或续约租约，多活模式按存活节点重建哈希环
+func renew() error {
+	lease := time.Second * time.Duration(cfg.Lease)
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), period())
+	defer cancel()
+	db := store.WithContext(ctx)
+
+	err := db.Table("db_snapshot_node").Clauses(clause.OnConflict{DoUpdates: clause.Assignments(map[string]any{
+		"mode":      cfg.Mode,
+		"heartbeat": gorm.Expr("NOW(3)"),
+	})}).Create(map[string]any{
+		"node":       cfg.Node,
+		"mode":       cfg.Mode,
+		"heartbeat":  gorm.Expr("NOW(3)"),
+		"start_time": gorm.Expr("NOW()"),
+	}).Error
+	if err != nil {
+		expire()
+		return err
+	}
+
+	var live []string
+	err = db.Raw("SELECT node FROM db_snapshot_node WHERE mode = ? AND heartbeat > NOW(3) - INTERVAL ? SECOND ORDER BY node",
+		cfg.Mode, cfg.Lease).Scan(&live).Error
+	if err != nil {
+		expire()
+		return err
+	}
+
+	var owner string
+	if cfg.Mode == config.ClusterStandby {
+		//租约过期或本节点持有时获得租约，MySQL按顺序执行赋值，expire_time判断的是更新后的node，赋值顺序不能调整
+		expireAt := gorm.Expr("NOW(3) + INTERVAL ? SECOND", cfg.Lease)
+		err = db.Table("db_snapshot_leader").Clauses(clause.OnConflict{DoUpdates: []clause.Assignment{
+			{Column: clause.Column{Name: "node"}, Value: gorm.Expr("IF(node = ? OR expire_time < NOW(3), ?, node)", cfg.Node, cfg.Node)},
+			{Column: clause.Column{Name: "expire_time"}, Value: gorm.Expr("IF(node = ?, ?, expire_time)", cfg.Node, expireAt)},
+		}}).Create(map[string]any{"id": "leader", "node": cfg.Node, "expire_time": expireAt}).Error
+		if err == nil {
+			err = db.Raw("SELECT node FROM db_snapshot_leader WHERE id = 'leader'").Scan(&owner).Error
+		}
+		if err != nil {
+			expire()
+			return err
+		}
+	}
+
+	mu.Lock()
+	changed := false
+	switch cfg.Mode {
+	case config.ClusterStandby:
+		wasActive := leader == cfg.Node && start.Before(validTo)
+		leader = owner
+		if owner == cfg.Node {
+			//从发起续约时开始计算，保证本地有效期不晚于数据库中的租约
+			validTo = start.Add(lease)
+		}
+		changed = wasActive != (owner == cfg.Node)
+		if changed && owner == cfg.Node {
+			slog.Infof("节点 %s 获得租约，成为主节点", cfg.Node)
+		} else if changed {
+			slog.Warnf("节点 %s 失去租约，主节点为 %s", cfg.Node, owner)
+		}
+	case config.ClusterShard:
+		expired := !validTo.IsZero() && !start.Before(validTo)
+		validTo = start.Add(lease)
+		if expired {
+			slog.Infof("节点 %s 心跳恢复，重新参与分配实例", cfg.Node)
+			changed = true
+		}
+		if !slices.Equal(nodes, live) {
+			slog.Infof("存活节点变化 %v -> %v，重新分配实例", nodes, live)
+			ring = build(live)
+			changed = true
+		}
+	}
+	nodes = live
+	mu.Unlock()
+
+	if changed && onChange != nil {
+		onChange()
+	}
+	return nil
+}
+
+// expire 元数据库不可达，本地租约到期后停止采集，避免和接管的节点重复采集
+// 主备模式放弃主节点，多活模式清空哈希环，其他节点在本节点心跳过期后已接管它的实例
+func expire() {
+	mu.Lock()
+	lost := false
+	switch cfg.Mode {
+	case config.ClusterStandby:
+		lost = leader == cfg.Node && !time.Now().Before(validTo)
+		if lost {
+			leader = ""
+		}
+	case config.ClusterShard:
+		lost = ring != nil && !time.Now().Before(validTo)
+		if lost {
+			ring, nodes = nil, nil
+		}
+	}
+	mu.Unlock()
+
+	if lost {
+		slog.Warnf("节点 %s 无法续约，租约已过期，停止采集", cfg.Node)
+		if onChange != nil {
+			onChange()
+		}
+	}
+}
+
+// build 按存活节点构建一致性哈希环，节点加入或离开时只迁移相邻区间的实例
+func build(list []string) []point {
+	r := make([]point, 0, len(list)*VirtualNodes)
+	for _, node := range list {
+		for i := 0; i < VirtualNodes; i++ {
+			r = append(r, point{hash: hash(fmt.Sprintf("%s#%d", node, i)), node: node})
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].hash < r[j].hash })
+	return r
+}
+
+// locate 返回实例所在的节点，哈希环上顺时针第一个虚拟节点
+func locate(r []point, instId int) string {
+	if len(r) == 0 {
+		return ""
+	}
+	h := hash(strconv.Itoa(instId))
+	i := sort.Search(len(r), func(i int) bool { return r[i].hash >= h })
+	if i == len(r) {
+		i = 0
+	}
+	return r[i].node
+}
+
+// hash fnv-1a后再做一次murmur3的混淆，连续的实例ID也能均匀分布
+func hash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
@@ -0,0 +1,106 @@
+package cluster
+
+import (
+	"db-snapshot/config"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLocate(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []string
+	}{
+		{"单节点", []string{"n1"}},
+		{"两个节点", []string{"n1", "n2"}},
+		{"三个节点", []string{"n1", "n2", "n3"}},
+		{"五个节点", []string{"a", "b", "c", "d", "e"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, again := build(tt.nodes), build(tt.nodes)
+			if len(r) != len(tt.nodes)*VirtualNodes {
+				t.Fatalf("ring size = %d, want %d", len(r), len(tt.nodes)*VirtualNodes)
+			}
+			const n = 10000
+			count := make(map[string]int)
+			for id := 1; id <= n; id++ {
+				node := locate(r, id)
+				if node != locate(again, id) {
+					t.Fatalf("instance %d: locate is not deterministic", id)
+				}
+				count[node]++
+			}
+			//连续的实例ID均匀分布，每个节点不超过平均值的±25%
+			avg := n / len(tt.nodes)
+			for _, node := range tt.nodes {
+				if c := count[node]; c < avg*3/4 || c > avg*5/4 {
+					t.Errorf("node %s owns %d of %d instances, want about %d", node, c, n, avg)
+				}
+			}
+		})
+	}
+
+	if got := locate(nil, 1); got != "" {
+		t.Errorf("locate on empty ring = %q, want empty", got)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	tests := []struct {
+		name   string
+		before []string
+		after  []string
+	}{
+		{"节点离开", []string{"n1", "n2", "n3"}, []string{"n1", "n3"}},
+		{"节点加入", []string{"n1", "n2"}, []string{"n1", "n2", "n3"}},
+		{"替换节点", []string{"n1", "n2", "n3"}, []string{"n1", "n2", "n4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			live := make(map[string]bool)
+			for _, node := range tt.after {
+				live[node] = true
+			}
+			before, after := build(tt.before), build(tt.after)
+			for id := 1; id <= 5000; id++ {
+				from, to := locate(before, id), locate(after, id)
+				//只有离开的节点上的实例迁移，或者迁移到新加入的节点
+				if from != to && live[from] && slices.Contains(tt.before, to) {
+					t.Fatalf("instance %d moved %s -> %s between surviving nodes", id, from, to)
+				}
+			}
+		})
+	}
+}
+
+func TestOwnsShard(t *testing.T) {
+	saved := cfg
+	defer func() {
+		cfg, ring, validTo = saved, nil, time.Time{}
+	}()
+	cfg = config.ClusterConfig{Mode: config.ClusterShard, Node: "n1"}
+	ring = build([]string{"n1"})
+
+	tests := []struct {
+		name    string
+		validTo time.Time
+		want    bool
+	}{
+		{"心跳有效", time.Now().Add(time.Minute), true},
+		{"心跳过期", time.Now().Add(-time.Second), false},
+		{"未续约", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validTo = tt.validTo
+			if got := Owns(1); got != tt.want {
+				t.Errorf("Owns = %v, want %v", got, tt.want)
+			}
+			if got := Get().Active; got != tt.want {
+				t.Errorf("Active = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,49 +2,422 @@ package config
 
 import (
 	"db-snapshot/model"
+	"fmt"
 	"github.com/go-ini/ini"
-	"github.com/gookit/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
-var Global *Config
+// global 当前生效的配置，重载时整体替换
+var global atomic.Pointer[Config]
+
+// Get 返回当前生效的配置，重载后返回新的配置，调用方不能修改返回的配置
+func Get() *Config {
+	return global.Load()
+}
 
 type Config struct {
-	HttpPort         int            `ini:"http_port"`
-	Interval         int            `ini:"interval"`
-	Parallel         int            `ini:"parallel"`
-	MonitorUser      string         `ini:"monitor_user"`
-	MonitorPassword  string         `ini:"monitor_password"`
-	DB               model.DBConfig `ini:"db"`
-	ReloadConfigChan chan struct{}
+	HttpPort         int                          `ini:"http_port"`
+	Interval         int                          `ini:"interval"`
+	Parallel         int                          `ini:"parallel"`
+	MonitorUser      string                       `ini:"monitor_user"`
+	MonitorPassword  string                       `ini:"monitor_password"`
+	MasterKey        string                       `ini:"master_key"`      //加密实例监控密码的主密钥
+	SectionTimeout   int                          `ini:"section_timeout"` //单个采集块的默认超时时间(s)
+	ShutdownGrace    int                          `ini:"shutdown_grace"`  //退出时等待执行中的快照的时间(s)
+	DB               model.DBConfig               `ini:"db"`
+	ReloadConfigChan chan struct{}                //重新载入实例列表
+	SectionTimeouts  map[string]int               `ini:"-"` //[section_timeout]中按采集块配置的超时时间(s)
+	Thresholds       map[string]map[string]string `ini:"-"` //[threshold.<数据库引擎或规则名>]中配置的分类规则
+	Burst            BurstConfig                  `ini:"burst"`
+	Recorder         RecorderConfig               `ini:"recorder"`
+	Breaker          BreakerConfig                `ini:"breaker"`
+	Degrade          DegradeConfig                `ini:"degrade"`
+	Agent            AgentConfig                  `ini:"agent"`
+	Cluster          ClusterConfig                `ini:"cluster"`
+	Spool            SpoolConfig                  `ini:"spool"`
+	Storage          StorageConfig                `ini:"storage"`
+	WorkDir          string                       `ini:"work_dir"` //工作目录，快照文件和暂存目录的相对路径以此为准，默认为程序所在目录
+	secrets          secrets
+	origin           map[string]string //配置项的来源，用于打印配置
+	file             string            //配置文件
 }
 
-func init() {
-	fileName := `config.ini`
+// Init 按配置来源加载配置，解析密钥引用，程序启动时调用
+func Init(src Source) error {
+	cfg, err := Load(src)
+	if err != nil {
+		return err
+	}
+	err = cfg.ResolveSecrets()
+	if err != nil {
+		return fmt.Errorf("解析密钥失败 %w", err)
+	}
+	cfg.ReloadConfigChan = make(chan struct{}, 1)
+	source = src
+	global.Store(cfg)
+	return nil
+}
 
-	//加载配置文件
-	c, err := ini.Load(fileName)
+// RequestReload 请求重新载入实例列表，已有未处理的请求时合并为一次
+func (self *Config) RequestReload() {
+	select {
+	case self.ReloadConfigChan <- struct{}{}:
+	default:
+	}
+}
+
+// Load 依次读取默认值、配置文件、环境变量、命令行参数并校验，所有错误一起返回
+func Load(src Source) (*Config, error) {
+	c, origin, err := src.merge()
 	if err != nil {
-		slog.Fatalf("加载配置文件 '%s' 失败: %v", fileName, err)
-		return
+		return nil, err
 	}
 
-	Global = new(Config)
-	Global.ReloadConfigChan = make(chan struct{}, 100)
-	err = c.MapTo(Global)
+	cfg := new(Config)
+	err = c.StrictMapTo(cfg)
 	if err != nil {
-		slog.Fatalf("映射配置信息失败 %v", err)
-		return
+		return nil, fmt.Errorf("映射配置信息失败: %w", err)
+	}
+	cfg.origin = origin
+	cfg.file = src.File
+
+	//键为 采集块名 或 数据库类型.采集块名，例如 getSQLInfo = 20 / oracle.getSQLInfo = 30
+	var errs []string
+	cfg.SectionTimeouts = make(map[string]int)
+	for _, k := range c.Section("section_timeout").Keys() {
+		n, err := k.Int()
+		if err != nil || n <= 0 {
+			errs = append(errs, fmt.Sprintf("[section_timeout] %s = %s: 必须是大于0的整数", k.Name(), k.Value()))
+			continue
+		}
+		cfg.SectionTimeouts[k.Name()] = n
+	}
+
+	//键为 数据库引擎（覆盖该引擎的默认规则）或 规则名（实例配置中引用）
+	cfg.Thresholds = make(map[string]map[string]string)
+	for _, sec := range c.Sections() {
+		name, ok := strings.CutPrefix(sec.Name(), "threshold.")
+		if !ok {
+			continue
+		}
+		errs = append(errs, checkThreshold(name, sec)...)
+		cfg.Thresholds[name] = sec.KeysHash()
+	}
+
+	cfg.setDefaults()
+	errs = append(errs, cfg.validate()...)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("配置有%d处错误:\n  %s", len(errs), strings.Join(errs, "\n  "))
+	}
+	return cfg, nil
+}
+
+// 分类规则的配置项
+const (
+	ThresholdBigQuerySeconds = "big_query_seconds" //执行时间超过该值为大查询(s)
+	ThresholdWaitPattern     = "wait_pattern"      //等待会话的匹配规则（正则）
+	ThresholdLockPattern     = "lock_pattern"      //行锁的匹配规则（正则）
+)
+
+// thresholdName 分类规则名
+var thresholdName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// checkThreshold 校验 [threshold.<name>]
+func checkThreshold(name string, sec *ini.Section) []string {
+	var errs []string
+	if !thresholdName.MatchString(name) || name == "default" {
+		errs = append(errs, fmt.Sprintf("[threshold.%s]: 规则名只能包含字母、数字、_-，最长32个字符，不能为default", name))
+	}
+	for _, k := range sec.Keys() {
+		switch k.Name() {
+		case ThresholdBigQuerySeconds:
+			if n, err := k.Int(); err != nil || n < 0 {
+				errs = append(errs, fmt.Sprintf("[threshold.%s] %s = %s: 必须是不小于0的整数", name, k.Name(), k.Value()))
+			}
+		case ThresholdWaitPattern, ThresholdLockPattern:
+			if _, err := regexp.Compile(k.Value()); err != nil {
+				errs = append(errs, fmt.Sprintf("[threshold.%s] %s = %s: 正则表达式错误: %v", name, k.Name(), k.Value(), err))
+			}
+		default:
+			errs = append(errs, fmt.Sprintf("[threshold.%s] %s: 未知的配置项，可选 %s / %s / %s", name, k.Name(), ThresholdBigQuerySeconds, ThresholdWaitPattern, ThresholdLockPattern))
+		}
+	}
+	return errs
+}
+
+// setDefaults 未配置（为0或空）的项使用默认值
+func (self *Config) setDefaults() {
+	if self.WorkDir == "" {
+		if exe, err := os.Executable(); err == nil {
+			self.WorkDir = filepath.Dir(exe)
+		}
+	}
+	if self.HttpPort == 0 {
+		self.HttpPort = 8080
+	}
+	if self.Interval == 0 {
+		self.Interval = 30
+	}
+	if self.Parallel == 0 {
+		self.Parallel = 8
+	}
+	if self.SectionTimeout == 0 {
+		self.SectionTimeout = 10
+	}
+	if self.ShutdownGrace == 0 {
+		self.ShutdownGrace = 30
 	}
 
-	if Global.HttpPort == 0 {
-		Global.HttpPort = 8080
+	if self.Burst.Interval > 0 && self.Burst.Cooldown == 0 {
+		self.Burst.Cooldown = 300
 	}
 
-	if Global.Parallel == 0 {
-		Global.Parallel = 8
+	if self.Recorder.Window == 0 {
+		self.Recorder.Window = 300
+	}
+	if self.Recorder.Cooldown == 0 {
+		self.Recorder.Cooldown = 300
 	}
 
-	if Global.Interval == 0 {
-		Global.Parallel = 30
+	if self.Breaker.Failures == 0 {
+		self.Breaker.Failures = 3
+	}
+	if self.Breaker.Backoff == 0 {
+		self.Breaker.Backoff = 60
+	}
+	if self.Breaker.MaxBackoff == 0 {
+		self.Breaker.MaxBackoff = max(1800, self.Breaker.Backoff)
+	}
+
+	if self.Degrade.MaxRows == 0 {
+		self.Degrade.MaxRows = 200
+	}
+	if self.Degrade.SQLTextLen == 0 {
+		self.Degrade.SQLTextLen = 256
+	}
+
+	if self.Agent.SpoolDir == "" {
+		self.Agent.SpoolDir = "spool"
+	}
+	if self.Agent.MaxSpool == 0 {
+		self.Agent.MaxSpool = 10000
+	}
+
+	if self.Spool.Dir == "" {
+		self.Spool.Dir = "spool"
+	}
+	if self.Spool.MaxSize == 0 {
+		self.Spool.MaxSize = 100
+	}
+
+	if self.Storage.Type == "" {
+		self.Storage.Type = StorageLocal
+	}
+	if self.Storage.Dir == "" {
+		self.Storage.Dir = "data"
+	}
+	if self.Storage.Region == "" {
+		self.Storage.Region = "us-east-1"
+	}
+
+	if self.Cluster.Node == "" {
+		host, _ := os.Hostname()
+		self.Cluster.Node = fmt.Sprintf("%s:%d", host, self.HttpPort)
+	}
+	//租约过期加一次检查的时间不超过采集间隔，备节点在一个采集间隔内接管
+	if self.Cluster.Lease == 0 {
+		self.Cluster.Lease = max(min(15, self.Interval*3/4), 3)
 	}
 }
+
+// validate 校验配置，返回所有错误
+func (self *Config) validate() []string {
+	var errs []string
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(self.HttpPort > 0 && self.HttpPort <= 65535, "http_port = %d: 必须在1~65535之间", self.HttpPort)
+	check(self.Interval >= 5, "interval = %d: 采集间隔不能小于5秒", self.Interval)
+	check(self.Parallel > 0 && self.Parallel <= 1000, "parallel = %d: 必须在1~1000之间", self.Parallel)
+	check(self.SectionTimeout > 0, "section_timeout = %d: 必须大于0", self.SectionTimeout)
+	check(self.ShutdownGrace > 0, "shutdown_grace = %d: 必须大于0", self.ShutdownGrace)
+
+	check(self.Burst.Interval == 0 || self.Burst.Interval >= 5, "[burst] interval = %d: 高频采集间隔不能小于5秒，0表示不启用", self.Burst.Interval)
+	check(self.Burst.Cooldown >= 0, "[burst] cooldown = %d: 不能小于0", self.Burst.Cooldown)
+	check(self.Burst.LockCount >= 0 && self.Burst.WaitSessCount >= 0 && self.Burst.MaxTxnSeconds >= 0, "[burst] 阈值不能小于0")
+
+	check(self.Recorder.Interval >= 0 && self.Recorder.Interval <= 10, "[recorder] interval = %d: 黑匣子采样间隔必须在0~10秒之间，0表示不启用", self.Recorder.Interval)
+	check(self.Recorder.Window > 0, "[recorder] window = %d: 必须大于0", self.Recorder.Window)
+	check(self.Recorder.Window >= self.Recorder.Interval, "[recorder] window = %d: 不能小于采样间隔", self.Recorder.Window)
+	check(self.Recorder.ActSessCount >= 0, "[recorder] act_sess_count = %d: 不能小于0", self.Recorder.ActSessCount)
+	check(self.Recorder.Cooldown > 0, "[recorder] cooldown = %d: 必须大于0", self.Recorder.Cooldown)
+
+	check(self.Breaker.Failures > 0, "[breaker] failures = %d: 必须大于0", self.Breaker.Failures)
+	check(self.Breaker.Backoff > 0, "[breaker] backoff = %d: 必须大于0", self.Breaker.Backoff)
+	check(self.Breaker.MaxBackoff >= self.Breaker.Backoff, "[breaker] max_backoff = %d: 不能小于backoff(%d)", self.Breaker.MaxBackoff, self.Breaker.Backoff)
+
+	check(self.Degrade.ActSessCount >= 0, "[degrade] act_sess_count = %d: 不能小于0", self.Degrade.ActSessCount)
+	check(self.Degrade.MaxRows > 0, "[degrade] max_rows = %d: 必须大于0", self.Degrade.MaxRows)
+	check(self.Degrade.SQLTextLen > 0, "[degrade] sql_text_len = %d: 必须大于0", self.Degrade.SQLTextLen)
+
+	check(self.Spool.MaxSize > 0, "[spool] max_size = %d: 必须大于0", self.Spool.MaxSize)
+
+	check(self.Storage.Type == StorageLocal || self.Storage.Type == StorageS3, "[storage] type = %s: 可选 local / s3", self.Storage.Type)
+	if self.Storage.Type == StorageS3 {
+		u, err := url.Parse(self.Storage.Endpoint)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && strings.Trim(u.Path, "/") == "",
+			"[storage] endpoint = %s: 必须是 http:// 或 https:// 开头的地址，不含路径", self.Storage.Endpoint)
+		check(self.Storage.Bucket != "", "[storage] bucket: 对象存储必须配置桶名")
+		check(self.Storage.AccessKey != "" && self.Storage.SecretKey != "", "[storage] access_key、secret_key 必须配置")
+	}
+
+	if self.Agent.IsAgent() {
+		u, err := url.Parse(self.Agent.Server)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "[agent] server = %s: 必须是 http:// 或 https:// 开头的地址", self.Agent.Server)
+		check(self.Agent.Name != "", "[agent] name: 代理模式必须配置代理名称")
+		check(self.Agent.Token != "", "[agent] token: 代理模式必须配置中心为该代理签发的令牌")
+		check(self.Agent.MaxSpool > 0, "[agent] max_spool = %d: 必须大于0", self.Agent.MaxSpool)
+		check(self.Cluster.Mode != ClusterStandby && self.Cluster.Mode != ClusterShard, "[cluster] mode = %s: 代理模式不支持集群", self.Cluster.Mode)
+	} else {
+		check(self.DB.Host != "" && self.DB.Port > 0 && self.DB.Database != "", "[db] host、port、database 必须配置")
+	}
+
+	check(self.Cluster.Mode == ClusterSingle || self.Cluster.Mode == ClusterStandby || self.Cluster.Mode == ClusterShard,
+		"[cluster] mode = %s: 可选 standby / shard，为空表示单节点", self.Cluster.Mode)
+	if self.Cluster.Mode != ClusterSingle {
+		check(self.Cluster.Lease >= 3 && self.Cluster.Lease <= max(self.Interval*3/4, 3),
+			"[cluster] lease = %d: 必须在3~%d秒之间（不超过采集间隔的3/4，备节点才能在一个采集间隔内接管）", self.Cluster.Lease, max(self.Interval*3/4, 3))
+	}
+	return errs
+}
+
+// GetSectionTimeout 返回采集块的超时时间，优先级: 数据库类型.采集块名 > 采集块名 > section_timeout
+func (self *Config) GetSectionTimeout(driver, name string) time.Duration {
+	if n, ok := self.SectionTimeouts[driver+"."+name]; ok {
+		return time.Second * time.Duration(n)
+	}
+	if n, ok := self.SectionTimeouts[name]; ok {
+		return time.Second * time.Duration(n)
+	}
+	return time.Second * time.Duration(self.SectionTimeout)
+}
+
+// QueryTimeout 返回监控会话在数据库端的语句超时，取该数据库类型所有采集块超时时间的最大值
+func (self *Config) QueryTimeout(driver string) time.Duration {
+	n := self.SectionTimeout
+	for k, v := range self.SectionTimeouts {
+		if strings.HasPrefix(k, driver+".") || !strings.Contains(k, ".") {
+			n = max(n, v)
+		}
+	}
+	return time.Second * time.Duration(n)
+}
+
+// BurstConfig 实例指标超过阈值时临时切换为高频采集，指标恢复正常并持续 Cooldown 后回到正常间隔
+type BurstConfig struct {
+	Interval      int `ini:"interval"`        //高频采集间隔(s)，0表示不启用
+	Cooldown      int `ini:"cooldown"`        //冷却时间(s)，默认300
+	LockCount     int `ini:"lock_count"`      //锁数阈值，0表示不检查，下同
+	WaitSessCount int `ini:"wait_sess_count"` //等待会话数阈值
+	MaxTxnSeconds int `ini:"max_txn_seconds"` //最长事务耗时阈值(s)
+}
+
+// Enabled 是否启用高频采集
+func (self *BurstConfig) Enabled() bool {
+	return self.Interval > 0 && (self.LockCount > 0 || self.WaitSessCount > 0 || self.MaxTxnSeconds > 0)
+}
+
+// Triggered 判断快照指标是否超过任一阈值
+func (self *BurstConfig) Triggered(sum *model.DBSnapshot) bool {
+	if sum == nil {
+		return false
+	}
+	return (self.LockCount > 0 && sum.LockCount >= self.LockCount) ||
+		(self.WaitSessCount > 0 && sum.WaitSessCount >= self.WaitSessCount) ||
+		(self.MaxTxnSeconds > 0 && sum.MaxTxnSeconds >= self.MaxTxnSeconds)
+}
+
+// RecorderConfig 黑匣子：高频采样活动会话并保存在内存中，触发时才写入快照文件
+type RecorderConfig struct {
+	Interval     int    `ini:"interval"`       //采样间隔(s)，0表示不启用
+	Window       int    `ini:"window"`         //内存中保留的时长(s)，默认300
+	ActSessCount int    `ini:"act_sess_count"` //活动会话数阈值，0表示不自动触发
+	Cooldown     int    `ini:"cooldown"`       //同一实例两次自动触发的最小间隔(s)，默认300
+	WebhookToken string `ini:"webhook_token"`  //外部告警调用webhook的令牌，为空时不开放webhook
+}
+
+// BreakerConfig 实例连续连接失败后熔断，按指数退避探测，恢复后自动关闭熔断
+type BreakerConfig struct {
+	Failures   int `ini:"failures"`    //连续失败次数，达到后熔断，默认3
+	Backoff    int `ini:"backoff"`     //第一次探测的等待时间(s)，之后每次探测失败翻倍，默认60
+	MaxBackoff int `ini:"max_backoff"` //最长等待时间(s)，默认1800
+}
+
+// DegradeConfig 实例负载过高时降级采集：跳过开销大的采集块，限制行数，在数据库端截断SQL文本
+type DegradeConfig struct {
+	ActSessCount int `ini:"act_sess_count"` //预检查的活动会话数达到该值时降级，0表示不启用
+	MaxRows      int `ini:"max_rows"`       //降级时每个采集块最多返回的行数，默认200
+	SQLTextLen   int `ini:"sql_text_len"`   //降级时SQL文本截断的长度，默认256
+}
+
+// AgentConfig 代理模式：配置server时作为代理运行，只采集中心分配的实例并推送快照，使用中心为该代理签发的令牌认证
+type AgentConfig struct {
+	Server   string `ini:"server"`    //中心地址，例如 http://10.0.0.201:808，为空表示不是代理
+	Name     string `ini:"name"`      //代理名称，与实例配置中的采集代理对应
+	Token    string `ini:"token"`     //中心为该代理签发的令牌，支持密钥引用，只在代理上配置
+	SpoolDir string `ini:"spool_dir"` //推送失败的快照暂存目录，默认spool
+	MaxSpool int    `ini:"max_spool"` //最多暂存的快照数，超过后丢弃最早的快照，默认10000
+}
+
+// IsAgent 是否以代理模式运行
+func (self *AgentConfig) IsAgent() bool {
+	return self.Server != ""
+}
+
+// 集群模式
+const (
+	ClusterSingle  = ""        //单节点，不协调
+	ClusterStandby = "standby" //主备，只有持有租约的节点采集
+	ClusterShard   = "shard"   //多活，实例按一致性哈希分配到存活的节点
+)
+
+// ClusterConfig 多个采集程序通过元数据库协调，避免重复采集
+type ClusterConfig struct {
+	Mode  string `ini:"mode"`  //为空表示单节点，standby主备，shard多活
+	Node  string `ini:"node"`  //节点标识，默认 主机名:http端口
+	Lease int    `ini:"lease"` //租约时间(s)，超过该时间没有续约视为节点失效，默认15
+}
+
+// SpoolConfig 元数据库不可用时，快照汇总暂存到本地文件，恢复后按顺序重放
+type SpoolConfig struct {
+	Dir     string `ini:"dir"`      //暂存目录，默认spool
+	MaxSize int    `ini:"max_size"` //暂存文件上限(MB)，超过后丢弃新的快照汇总，默认100
+}
+
+// 快照文件的存储类型
+const (
+	StorageLocal = "local" //本地目录
+	StorageS3    = "s3"    //兼容S3的对象存储，例如 MinIO
+)
+
+// StorageConfig 快照文件和黑匣子文件的存储位置，多个节点共用对象存储时，任一节点都能查看所有快照
+type StorageConfig struct {
+	Type        string `ini:"type"`         //local本地目录，s3对象存储，默认local
+	Dir         string `ini:"dir"`          //本地目录，默认data
+	Endpoint    string `ini:"endpoint"`     //对象存储地址，例如 http://10.0.0.10:9000
+	Region      string `ini:"region"`       //区域，默认us-east-1
+	Bucket      string `ini:"bucket"`       //桶名，需要预先创建
+	Prefix      string `ini:"prefix"`       //对象名前缀，例如 db-snapshot/
+	AccessKey   string `ini:"access_key"`   //访问密钥ID
+	SecretKey   string `ini:"secret_key"`   //访问密钥，支持密钥引用
+	VirtualHost bool   `ini:"virtual_host"` //使用虚拟主机风格 bucket.endpoint 访问，默认路径风格 endpoint/bucket（MinIO等）
+}
@@ -0,0 +1,35 @@
+package config
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDefaults(t *testing.T) {
+	cfg, err := Load(Source{Flags: map[string]string{"db.host": "h", "db.port": "3306", "db.database": "d"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key  string
+		want any
+	}{
+		{"interval", 30},
+		{"parallel", 8},
+		{"http_port", 8080},
+		{"section_timeout", 10},
+		{"shutdown_grace", 30},
+		{"cluster.lease", 15},
+		{"breaker.failures", 3},
+		{"breaker.backoff", 60},
+		{"breaker.max_backoff", 1800},
+		{"spool.max_size", 100},
+	}
+	values := fields(cfg)
+	for _, tt := range tests {
+		got := values[tt.key].Interface()
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) || cfg.origin[tt.key] != OriginDefault {
+			t.Errorf("%s = %v (%s), want default %v", tt.key, got, cfg.origin[tt.key], tt.want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"fmt"
+	"github.com/gookit/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// WatchInterval 检查配置文件是否修改的间隔
+const WatchInterval = 5 * time.Second
+
+// restartKeys 修改后需要重启才能生效的配置项，重载时保留原值
+var restartKeys = []string{
+	"http_port",
+	"db.host", "db.port", "db.user", "db.database",
+	"work_dir",
+	"agent.server", "agent.name", "agent.spool_dir",
+	"cluster.mode", "cluster.node", "cluster.lease",
+	"spool.dir", "spool.max_size",
+	"storage.type", "storage.dir", "storage.endpoint", "storage.region", "storage.bucket", "storage.prefix",
+	"storage.access_key", "storage.secret_key", "storage.virtual_host",
+}
+
+// ReloadResult 重载配置的结果
+type ReloadResult struct {
+	Changed []string //已生效的配置项
+	Restart []string //已修改但需要重启才能生效的配置项
+}
+
+var (
+	reloadMu sync.Mutex
+	hooks    []func(old, cur *Config)
+)
+
+// OnReload 注册重载配置后的回调，old为重载前的配置，cur为新的配置
+func OnReload(fn func(old, cur *Config)) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	hooks = append(hooks, fn)
+}
+
+// Reload 重新读取并校验配置文件，校验失败时继续使用原配置
+func Reload() (*ReloadResult, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	cfg, err := Load(source)
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.ResolveSecrets()
+	if err != nil {
+		return nil, fmt.Errorf("解析密钥失败: %w", err)
+	}
+
+	old := Get()
+	res := &ReloadResult{}
+	oldFields, newFields := fields(old), fields(cfg)
+	for key, v := range newFields {
+		if reflect.DeepEqual(v.Interface(), oldFields[key].Interface()) {
+			continue
+		}
+		if slices.Contains(restartKeys, key) {
+			v.Set(oldFields[key])
+			res.Restart = append(res.Restart, key)
+		} else {
+			res.Changed = append(res.Changed, key)
+		}
+	}
+	if !reflect.DeepEqual(old.SectionTimeouts, cfg.SectionTimeouts) {
+		res.Changed = append(res.Changed, "[section_timeout]")
+	}
+	if !reflect.DeepEqual(old.Thresholds, cfg.Thresholds) {
+		res.Changed = append(res.Changed, "[threshold]")
+	}
+	slices.Sort(res.Changed)
+	slices.Sort(res.Restart)
+
+	cfg.ReloadConfigChan = old.ReloadConfigChan
+	global.Store(cfg)
+	for _, fn := range hooks {
+		fn(old, cfg)
+	}
+
+	if len(res.Changed) > 0 {
+		slog.Infof("重载配置成功，已生效: %v", res.Changed)
+	}
+	if len(res.Restart) > 0 {
+		slog.Warnf("以下配置需要重启才能生效: %v", res.Restart)
+	}
+	return res, nil
+}
+
+// Watch 配置文件修改或收到SIGHUP信号时重载配置，没有配置文件时只响应SIGHUP
+func Watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	reload := func(reason string) {
+		slog.Infof("%s，重载配置", reason)
+		if _, err := Reload(); err != nil {
+			slog.Errorf("重载配置失败，继续使用原配置: %v", err)
+		}
+	}
+
+	go func() {
+		var last os.FileInfo
+		if source.File != "" {
+			last, _ = os.Stat(source.File)
+		}
+		ticker := time.NewTicker(WatchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-hup:
+				reload("收到SIGHUP信号")
+			case <-ticker.C:
+				if source.File == "" {
+					continue
+				}
+				info, err := os.Stat(source.File)
+				if err != nil {
+					continue
+				}
+				if last == nil || !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size() {
+					last = info
+					reload("配置文件已修改")
+				}
+			}
+		}
+	}()
+}
+
+// fields 按ini标签返回配置项，键为 配置项 或 节.配置项，例如 interval / burst.interval
+func fields(cfg *Config) map[string]reflect.Value {
+	m := make(map[string]reflect.Value)
+	walk(reflect.ValueOf(cfg).Elem(), "", func(key string, v reflect.Value) {
+		m[key] = v
+	})
+	return m
+}
+
+// walk 按定义顺序遍历ini标签的配置项，结构体字段为节
+func walk(v reflect.Value, prefix string, fn func(key string, v reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("ini")
+		if !f.IsExported() || tag == "" || tag == "-" {
+			continue
+		}
+		if f.Type.Kind() == reflect.Struct && prefix == "" {
+			walk(v.Field(i), tag+".", fn)
+			continue
+		}
+		fn(prefix+tag, v.Field(i))
+	}
+}
@@ -0,0 +1,159 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecretProvider 解析密钥引用，例如 env:NAME、file:/path、exec:command
+type SecretProvider func(ref string) (string, error)
+
+var providers = map[string]SecretProvider{
+	"env":  envSecret,
+	"file": fileSecret,
+	"exec": execSecret,
+	"plain": func(ref string) (string, error) {
+		return ref, nil
+	},
+}
+
+// RegisterSecretProvider 注册自定义的密钥来源
+func RegisterSecretProvider(scheme string, p SecretProvider) {
+	providers[scheme] = p
+}
+
+// ResolveSecret 解析配置值，未使用已注册前缀的值按明文处理，明文本身带前缀时可写成 plain:xxx
+func ResolveSecret(value string) (string, error) {
+	scheme, ref, ok := strings.Cut(value, ":")
+	if !ok {
+		return value, nil
+	}
+	p, ok := providers[scheme]
+	if !ok {
+		return value, nil
+	}
+	secret, err := p(ref)
+	if err != nil {
+		return "", fmt.Errorf("解析密钥 %s: 失败: %w", scheme, err)
+	}
+	return secret, nil
+}
+
+func envSecret(name string) (string, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("环境变量 %s 不存在", name)
+	}
+	return v, nil
+}
+
+func fileSecret(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func execSecret(command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// secrets 解析后的账号密码，配置文件中保留原始引用
+type secrets struct {
+	mu              sync.RWMutex
+	monitorUser     string
+	monitorPassword string
+	dbPassword      string
+	masterKey       string
+	agentToken      string
+	storageSecret   string
+}
+
+// ResolveSecrets 重新解析配置中的密钥引用，解析失败时保留原值
+func (self *Config) ResolveSecrets() error {
+	monitorUser, err := ResolveSecret(self.MonitorUser)
+	if err != nil {
+		return fmt.Errorf("monitor_user %w", err)
+	}
+	monitorPassword, err := ResolveSecret(self.MonitorPassword)
+	if err != nil {
+		return fmt.Errorf("monitor_password %w", err)
+	}
+	dbPassword, err := ResolveSecret(self.DB.Password)
+	if err != nil {
+		return fmt.Errorf("db.password %w", err)
+	}
+	masterKey, err := ResolveSecret(self.MasterKey)
+	if err != nil {
+		return fmt.Errorf("master_key %w", err)
+	}
+	agentToken, err := ResolveSecret(self.Agent.Token)
+	if err != nil {
+		return fmt.Errorf("agent.token %w", err)
+	}
+	storageSecret, err := ResolveSecret(self.Storage.SecretKey)
+	if err != nil {
+		return fmt.Errorf("storage.secret_key %w", err)
+	}
+
+	self.secrets.mu.Lock()
+	defer self.secrets.mu.Unlock()
+	self.secrets.monitorUser = monitorUser
+	self.secrets.monitorPassword = monitorPassword
+	self.secrets.dbPassword = dbPassword
+	self.secrets.masterKey = masterKey
+	self.secrets.agentToken = agentToken
+	self.secrets.storageSecret = storageSecret
+	return nil
+}
+
+// MonitorCredential 返回全局监控账号
+func (self *Config) MonitorCredential() (user, password string) {
+	self.secrets.mu.RLock()
+	defer self.secrets.mu.RUnlock()
+	return self.secrets.monitorUser, self.secrets.monitorPassword
+}
+
+// DBPassword 返回元数据库密码，每次建立新连接时调用
+func (self *Config) DBPassword() string {
+	self.secrets.mu.RLock()
+	defer self.secrets.mu.RUnlock()
+	return self.secrets.dbPassword
+}
+
+func (self *Config) GetMasterKey() string {
+	self.secrets.mu.RLock()
+	defer self.secrets.mu.RUnlock()
+	return self.secrets.masterKey
+}
+
+// AgentToken 返回中心为本代理签发的令牌
+func (self *Config) AgentToken() string {
+	self.secrets.mu.RLock()
+	defer self.secrets.mu.RUnlock()
+	return self.secrets.agentToken
+}
+
+// StorageSecretKey 返回对象存储的访问密钥
+func (self *Config) StorageSecretKey() string {
+	self.secrets.mu.RLock()
+	defer self.secrets.mu.RUnlock()
+	return self.secrets.storageSecret
+}
@@ -0,0 +1,287 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/go-ini/ini"
+	"github.com/goccy/go-yaml"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// EnvPrefix 环境变量前缀，键为 前缀+配置项，节和配置项用_连接并大写，例如 DBSNAPSHOT_DB_HOST
+const EnvPrefix = "DBSNAPSHOT_"
+
+// EnvConfigFile 指定配置文件的环境变量，优先级低于 --config
+const EnvConfigFile = EnvPrefix + "CONFIG"
+
+// CmdPrintConfig 打印合并后的配置并退出
+const CmdPrintConfig = "print-config"
+
+// 配置项的来源
+const (
+	OriginDefault = "default"
+	OriginFile    = "file"
+	OriginEnv     = "env"
+	OriginFlag    = "flag"
+)
+
+// secretKeys 打印配置时隐藏的配置项
+var secretKeys = []string{"monitor_password", "master_key", "db.password", "agent.token", "recorder.webhook_token", "storage.secret_key"}
+
+// Source 配置来源，后者覆盖前者：默认值、配置文件、环境变量、命令行参数
+type Source struct {
+	File  string            //配置文件，.yaml/.yml按YAML解析，其他按INI解析，为空时不读取配置文件
+	Flags map[string]string //命令行参数，键为 配置项 或 节.配置项
+}
+
+// source 启动时的配置来源，重载配置时使用
+var source Source
+
+// ParseArgs 解析命令行参数，返回子命令和配置来源；每个配置项都可以用 --配置项 或 --节.配置项 设置
+func ParseArgs(args []string) (string, Source, error) {
+	var cmd string
+	if len(args) > 0 && args[0] == CmdPrintConfig {
+		cmd, args = args[0], args[1:]
+	}
+
+	src := Source{Flags: make(map[string]string)}
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	fs.StringVar(&src.File, "config", "", "配置文件，.yaml/.yml按YAML解析，其他按INI解析，默认为当前目录或程序所在目录下的config.ini")
+	for _, key := range keys() {
+		fs.Func(key, "配置项 "+key, func(v string) error {
+			src.Flags[key] = v
+			return nil
+		})
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "用法: %s [%s] [--config 文件] [--配置项 值]...\n", fs.Name(), CmdPrintConfig)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return "", src, err
+	}
+	if fs.NArg() > 0 {
+		return "", src, fmt.Errorf("未知的参数: %s", strings.Join(fs.Args(), " "))
+	}
+
+	if src.File == "" {
+		src.File = os.Getenv(EnvConfigFile)
+	}
+	if src.File == "" {
+		src.File = defaultFile()
+	}
+	//切换工作目录后仍能重新加载
+	if src.File != "" {
+		abs, err := filepath.Abs(src.File)
+		if err != nil {
+			return "", src, err
+		}
+		src.File = abs
+	}
+	return cmd, src, nil
+}
+
+// defaultFile 未指定配置文件时依次查找当前目录和程序所在目录下的config.ini，都不存在时只使用环境变量和命令行参数
+func defaultFile() string {
+	dirs := []string{"."}
+	if exe, err := os.Executable(); err == nil {
+		dirs = append(dirs, filepath.Dir(exe))
+	}
+	for _, dir := range dirs {
+		name := filepath.Join(dir, "config.ini")
+		if _, err := os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// merge 按优先级合并配置来源，返回合并后的配置和每个配置项的来源
+func (self Source) merge() (*ini.File, map[string]string, error) {
+	c := ini.Empty()
+	var err error
+	if self.File != "" {
+		switch strings.ToLower(filepath.Ext(self.File)) {
+		case ".yaml", ".yml":
+			c, err = loadYAML(self.File)
+		default:
+			c, err = ini.Load(self.File)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("加载配置文件 '%s' 失败: %w", self.File, err)
+		}
+	}
+
+	origin := make(map[string]string)
+	for _, key := range keys() {
+		section, name := split(key)
+		origin[key] = OriginDefault
+		if c.Section(section).HasKey(name) {
+			origin[key] = OriginFile
+		}
+		if v, ok := os.LookupEnv(envName(key)); ok {
+			c.Section(section).Key(name).SetValue(v)
+			origin[key] = OriginEnv
+		}
+		if v, ok := self.Flags[key]; ok {
+			c.Section(section).Key(name).SetValue(v)
+			origin[key] = OriginFlag
+		}
+	}
+	return c, origin, nil
+}
+
+// loadYAML 读取YAML配置文件，顶层的标量为全局配置项，映射为节；
+// section_timeout 既是全局配置项又是节，按采集块设置的超时时间写在 section_timeouts 下；分类规则写在 threshold 下
+func loadYAML(fileName string) (*ini.File, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	c := ini.Empty()
+	for key, val := range doc {
+		m, ok := val.(map[string]any)
+		if !ok {
+			s, err := scalar(key, val)
+			if err != nil {
+				return nil, err
+			}
+			c.Section("").Key(key).SetValue(s)
+			continue
+		}
+
+		section := key
+		if key == "section_timeouts" {
+			section = "section_timeout"
+		}
+		//分类规则可以写成 threshold: {olap: {...}}
+		if key == "threshold" {
+			for name, v := range m {
+				p, ok := v.(map[string]any)
+				if !ok {
+					return nil, fmt.Errorf("threshold.%s: 必须是映射", name)
+				}
+				for k, v := range p {
+					s, err := scalar("threshold."+name+"."+k, v)
+					if err != nil {
+						return nil, err
+					}
+					c.Section("threshold." + name).Key(k).SetValue(s)
+				}
+			}
+			continue
+		}
+		for name, v := range m {
+			s, err := scalar(key+"."+name, v)
+			if err != nil {
+				return nil, err
+			}
+			c.Section(section).Key(name).SetValue(s)
+		}
+	}
+	return c, nil
+}
+
+func scalar(key string, val any) (string, error) {
+	switch val.(type) {
+	case nil:
+		return "", nil
+	case map[string]any, []any:
+		return "", fmt.Errorf("%s: 只支持字符串、数字和布尔值", key)
+	}
+	return fmt.Sprint(val), nil
+}
+
+// Print 按节打印合并后的配置和每个配置项的来源，密码等配置项只打印密钥引用
+func (self *Config) Print(w io.Writer) {
+	values := fields(self)
+	var section string
+	fmt.Fprintf(w, "; 配置文件: %s\n", self.file)
+	for _, key := range keys() {
+		sec, name := split(key)
+		if sec != section {
+			section = sec
+			fmt.Fprintf(w, "\n[%s]\n", section)
+		}
+		val := fmt.Sprint(values[key].Interface())
+		if slices.Contains(secretKeys, key) {
+			val = redact(val)
+		}
+		fmt.Fprintf(w, "%s = %s ; %s\n", name, val, self.origin[key])
+	}
+	if len(self.SectionTimeouts) > 0 {
+		fmt.Fprintf(w, "\n[section_timeout]\n")
+		names := make([]string, 0, len(self.SectionTimeouts))
+		for name := range self.SectionTimeouts {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s = %d\n", name, self.SectionTimeouts[name])
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(self.Thresholds)) {
+		fmt.Fprintf(w, "\n[threshold.%s]\n", name)
+		p := self.Thresholds[name]
+		for _, k := range slices.Sorted(maps.Keys(p)) {
+			fmt.Fprintf(w, "%s = %s\n", k, p[k])
+		}
+	}
+}
+
+// redact 隐藏明文密码，密钥引用（env:/file:/exec:）不含密码，原样打印
+func redact(val string) string {
+	if val == "" {
+		return ""
+	}
+	if scheme, _, ok := strings.Cut(val, ":"); ok && scheme != "plain" {
+		if _, ok := providers[scheme]; ok {
+			return val
+		}
+	}
+	return "******"
+}
+
+// keys 返回所有配置项，全局配置项在前，节按定义顺序
+func keys() []string {
+	var global, sections []string
+	walk(reflect.ValueOf(new(Config)).Elem(), "", func(key string, _ reflect.Value) {
+		if strings.Contains(key, ".") {
+			sections = append(sections, key)
+		} else {
+			global = append(global, key)
+		}
+	})
+	return append(global, sections...)
+}
+
+// envName 配置项对应的环境变量，例如 db.host -> DBSNAPSHOT_DB_HOST
+func envName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// split 拆分为节和配置项，全局配置项的节为空
+func split(key string) (string, string) {
+	section, name, ok := strings.Cut(key, ".")
+	if !ok {
+		return "", key
+	}
+	return section, name
+}
+
+// IsHelp 判断是否为 -h / --help
+func IsHelp(err error) bool {
+	return errors.Is(err, flag.ErrHelp)
+}
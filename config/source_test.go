@@ -0,0 +1,174 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testINI = `interval = 30
+parallel = 4
+monitor_password = "abc123"
+master_key = "env:TEST_MASTER_KEY"
+
+[db]
+host = "file-host"
+port = 3306
+database = "dbsnapshot"
+
+[section_timeout]
+getSQLInfo = 20
+oracle.getSQLInfo = 30
+
+[threshold.olap]
+big_query_seconds = 300
+`
+
+const testYAML = `interval: 30
+parallel: 4
+monitor_password: abc123
+master_key: env:TEST_MASTER_KEY
+db:
+  host: file-host
+  port: 3306
+  database: dbsnapshot
+section_timeouts:
+  getSQLInfo: 20
+  oracle.getSQLInfo: 30
+threshold:
+  olap:
+    big_query_seconds: 300
+`
+
+func TestMergePrecedence(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{"config.ini": testINI, "config.yaml": testYAML}
+	for name, text := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("DBSNAPSHOT_INTERVAL", "40")
+	t.Setenv("DBSNAPSHOT_DB_HOST", "env-host")
+	t.Setenv("DBSNAPSHOT_BREAKER_BACKOFF", "90")
+
+	for name := range files {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := Load(Source{
+				File:  filepath.Join(dir, name),
+				Flags: map[string]string{"interval": "50", "breaker.backoff": "120"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tests := []struct {
+				key    string
+				want   any
+				origin string
+			}{
+				{"interval", 50, OriginFlag},           //配置文件、环境变量、命令行参数都有，命令行参数优先
+				{"breaker.backoff", 120, OriginFlag},   //只有环境变量和命令行参数
+				{"db.host", "env-host", OriginEnv},     //环境变量覆盖配置文件
+				{"parallel", 4, OriginFile},            //只在配置文件中
+				{"db.port", 3306, OriginFile},          //节中的配置项
+				{"breaker.failures", 3, OriginDefault}, //默认值
+			}
+			values := fields(cfg)
+			for _, tt := range tests {
+				got := values[tt.key].Interface()
+				if fmt.Sprint(got) != fmt.Sprint(tt.want) || cfg.origin[tt.key] != tt.origin {
+					t.Errorf("%s = %v (%s), want %v (%s)", tt.key, got, cfg.origin[tt.key], tt.want, tt.origin)
+				}
+			}
+
+			if cfg.SectionTimeouts["getSQLInfo"] != 20 || cfg.SectionTimeouts["oracle.getSQLInfo"] != 30 {
+				t.Errorf("SectionTimeouts = %v", cfg.SectionTimeouts)
+			}
+			if cfg.Thresholds["olap"][ThresholdBigQuerySeconds] != "300" {
+				t.Errorf("Thresholds = %v", cfg.Thresholds)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	//元数据库配置齐全，只校验flags中的配置项
+	withDB := func(flags map[string]string) map[string]string {
+		flags["db.host"], flags["db.port"], flags["db.database"] = "h", "3306", "d"
+		return flags
+	}
+	tests := []struct {
+		name  string
+		flags map[string]string
+		want  string
+	}{
+		{"缺少元数据库", map[string]string{}, "[db] host、port、database 必须配置"},
+		{"采集间隔过小", withDB(map[string]string{"interval": "1"}), "interval = 1"},
+		{"熔断上限小于初始值", withDB(map[string]string{"breaker.backoff": "60", "breaker.max_backoff": "30"}), "max_backoff = 30"},
+		{"超时时间不是整数", withDB(map[string]string{"section_timeout": "x"}), "section_timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(Source{Flags: tt.flags})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load err = %v, want containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		val  string
+		want string
+	}{
+		{"", ""},
+		{"abc123", "******"},
+		{"env:DBSNAPSHOT_DB_PASSWORD", "env:DBSNAPSHOT_DB_PASSWORD"},
+		{"file:/run/secrets/db", "file:/run/secrets/db"},
+		{"exec:vault kv get -field=pwd secret/db", "exec:vault kv get -field=pwd secret/db"},
+		{"plain:abc123", "******"},
+		{"p@ss:w/rd", "******"},
+		{"unknown:abc", "******"},
+	}
+	for _, tt := range tests {
+		if got := redact(tt.val); got != tt.want {
+			t.Errorf("redact(%q) = %q, want %q", tt.val, got, tt.want)
+		}
+	}
+}
+
+func TestPrintRedacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.ini")
+	if err := os.WriteFile(path, []byte(testINI), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(Source{File: path, Flags: map[string]string{"db.password": "s3cret", "agent.token": "env:TOKEN"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	cfg.Print(&buf)
+	out := buf.String()
+
+	for _, leak := range []string{"abc123", "s3cret"} {
+		if strings.Contains(out, leak) {
+			t.Errorf("Print leaks %q:\n%s", leak, out)
+		}
+	}
+	for _, want := range []string{
+		"monitor_password = ****** ; file",
+		"master_key = env:TEST_MASTER_KEY ; file",
+		"password = ****** ; flag",
+		"token = env:TOKEN ; flag",
+		"oracle.getSQLInfo = 30",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Print missing %q:\n%s", want, out)
+		}
+	}
+}
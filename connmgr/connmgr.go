@@ -0,0 +1,183 @@
+package connmgr
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"db-snapshot/model"
+	"fmt"
+	"github.com/gookit/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 每个实例保持一个小连接池，跨采集周期复用，避免每次采集重复建立连接
+const (
+	MaxOpenConns    = 8                //单实例最大连接数，不小于并发采集块数
+	MaxIdleConns    = 8                //单实例最大空闲连接数
+	ConnMaxLifetime = 30 * time.Minute //连接最大存活时间
+	ConnMaxIdleTime = 10 * time.Minute //连接最大空闲时间，需大于采集间隔
+	MaxFailures     = 3                //连续健康检查失败次数，超过后关闭连接池
+	PingTimeout     = 5 * time.Second
+)
+
+type entry struct {
+	instId   int
+	key      string //连接配置，包含密码指纹，只在进程内比较
+	addr     string //连接地址，不含密码信息，用于统计
+	db       *sql.DB
+	failures int
+	created  time.Time
+	lastUsed time.Time
+	lastErr  string
+}
+
+// PoolStat 连接池统计信息
+type PoolStat struct {
+	InstID   int
+	Addr     string
+	Created  string
+	LastUsed string
+	Failures int
+	LastErr  string
+	sql.DBStats
+}
+
+var (
+	mu    sync.Mutex
+	pools = make(map[int]*entry)
+	//密码指纹的密钥，每次启动随机生成，指纹无法离线还原密码
+	fingerprintKey = newFingerprintKey()
+)
+
+func newFingerprintKey() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}
+
+// fingerprint 密码指纹，密码变化时指纹变化
+func fingerprint(password string) string {
+	h := hmac.New(sha256.New, fingerprintKey)
+	h.Write([]byte(password))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Get 返回实例的连接池，不存在或连接配置变化时重新创建，每次获取前做健康检查
+// 连接池只由connmgr关闭（连接配置变化、健康检查连续失败、实例移除、程序退出），调用方用完后不要关闭
+func Get(ctx context.Context, instId int, driver string, cfg *model.DBConfig, open func(cfg *model.DBConfig) (*sql.DB, error)) (*sql.DB, error) {
+	//密码或会话语句超时变化也需要重建连接池，key中只保留密码指纹
+	addr := fmt.Sprintf("%s|%s@%s:%d/%s", driver, cfg.User, cfg.Host, cfg.Port, cfg.Database)
+	key := fmt.Sprintf("%s|%s|%s", addr, fingerprint(cfg.Password), cfg.QueryTimeout)
+
+	mu.Lock()
+	e, ok := pools[instId]
+	if ok && e.key != key {
+		slog.Infof("[%s:%d] 连接配置已变化，关闭旧连接池", cfg.Host, cfg.Port)
+		evict(instId)
+		ok = false
+	}
+	if !ok {
+		db, err := open(cfg)
+		if err != nil {
+			mu.Unlock()
+			return nil, err
+		}
+		db.SetMaxOpenConns(MaxOpenConns)
+		db.SetMaxIdleConns(MaxIdleConns)
+		db.SetConnMaxLifetime(ConnMaxLifetime)
+		db.SetConnMaxIdleTime(ConnMaxIdleTime)
+		e = &entry{instId: instId, key: key, addr: addr, db: db, created: time.Now()}
+		pools[instId] = e
+	}
+	e.lastUsed = time.Now()
+	db := e.db
+	mu.Unlock()
+
+	pingCtx, cancel := context.WithTimeout(ctx, PingTimeout)
+	defer cancel()
+	err := db.PingContext(pingCtx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if pools[instId] != e {
+		//健康检查期间连接池已被替换或关闭
+		return nil, fmt.Errorf("连接池已关闭")
+	}
+	if err != nil {
+		e.failures++
+		e.lastErr = err.Error()
+		if e.failures >= MaxFailures {
+			slog.Warnf("[%s:%d] 连续%d次健康检查失败，关闭连接池", cfg.Host, cfg.Port, e.failures)
+			evict(instId)
+		}
+		return nil, err
+	}
+	e.failures = 0
+	e.lastErr = ""
+	return db, nil
+}
+
+func evict(instId int) {
+	if e, ok := pools[instId]; ok {
+		delete(pools, instId)
+		e.db.Close()
+	}
+}
+
+// Evict 关闭实例的连接池
+func Evict(instId int) {
+	mu.Lock()
+	defer mu.Unlock()
+	evict(instId)
+}
+
+// Sync 关闭已删除实例的连接池，连接配置变化的实例在下次Get时重建
+func Sync(instances []*model.Instance) {
+	exists := make(map[int]struct{}, len(instances))
+	for _, i := range instances {
+		exists[i.InstId] = struct{}{}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for instId := range pools {
+		if _, ok := exists[instId]; !ok {
+			slog.Infof("实例%d已删除，关闭连接池", instId)
+			evict(instId)
+		}
+	}
+}
+
+// CloseAll 关闭所有连接池
+func CloseAll() {
+	mu.Lock()
+	defer mu.Unlock()
+	for instId := range pools {
+		evict(instId)
+	}
+}
+
+// Stats 返回所有连接池的统计信息
+func Stats() []PoolStat {
+	mu.Lock()
+	defer mu.Unlock()
+
+	list := make([]PoolStat, 0, len(pools))
+	for _, e := range pools {
+		list = append(list, PoolStat{
+			InstID:   e.instId,
+			Addr:     e.addr,
+			Created:  e.created.Format("2006-01-02 15:04:05"),
+			LastUsed: e.lastUsed.Format("2006-01-02 15:04:05"),
+			Failures: e.failures,
+			LastErr:  e.lastErr,
+			DBStats:  e.db.Stats(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].InstID < list[j].InstID })
+	return list
+}
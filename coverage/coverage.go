@@ -0,0 +1,355 @@
+package coverage
+
+import (
+	"context"
+	"db-snapshot/config"
+	"db-snapshot/event"
+	"db-snapshot/model"
+	"db-snapshot/util"
+	"errors"
+	"github.com/gookit/slog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"math"
+	"sync"
+	"time"
+)
+
+// 缺失原因
+const (
+	Down    = "down"    //采集程序未运行或调度延迟
+	Backlog = "backlog" //队列积压或上一次快照未完成
+	Timeout = "timeout" //超过快照截止时间
+	Connect = "connect" //连接失败或熔断中
+	Failed  = "failed"  //其他错误，例如保存快照汇总失败
+	Unknown = "unknown" //没有缺失记录，例如采集程序停机后没有再启动
+)
+
+// 采集失败的错误类型，由StartCapturer包装返回，用于判断缺失原因
+var (
+	ErrConnect = errors.New("连接失败")
+	ErrSave    = errors.New("保存失败")
+)
+
+// HeartbeatInterval 采集程序心跳间隔，重启后据此计算停机期间缺失的快照
+const HeartbeatInterval = 10 * time.Second
+
+// legacyID 升级前所有节点共用的心跳
+const legacyID = "collector"
+
+// heartbeat 每个节点一行，ID为节点标识
+type heartbeat struct {
+	ID       string `gorm:"column:id;primaryKey"`
+	LastTick string `gorm:"column:last_tick"`
+}
+
+func (heartbeat) TableName() string {
+	return "db_snapshot_heartbeat"
+}
+
+var (
+	queue   = make(chan *model.CoverageGap, 1000)
+	pending sync.WaitGroup
+	store   *gorm.DB
+)
+
+// Reason 根据采集错误判断缺失原因
+func Reason(ctx context.Context, err error) string {
+	switch {
+	case errors.Is(err, ErrConnect):
+		return Connect
+	case errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.Is(err, context.DeadlineExceeded):
+		return Timeout
+	case errors.Is(ctx.Err(), context.Canceled):
+		//程序退出时被取消
+		return Down
+	default:
+		return Failed
+	}
+}
+
+// Record 记录缺失的快照，异步写入
+func Record(instId int, expected time.Time, reason string, missed int, msg string) {
+	gap := &model.CoverageGap{InstID: instId, ExpectedTime: expected.Format("2006-01-02 15:04:05"), Reason: reason, Missed: missed, Msg: msg}
+	pending.Add(1)
+	select {
+	case queue <- gap:
+	default:
+		pending.Done()
+		slog.Warnf("缺失记录队列已满，丢弃 %+v", *gap)
+	}
+}
+
+// Start 启动缺失记录写入和心跳，返回上一次心跳时间，首次运行返回零值
+// 代理模式没有元数据库，db为nil时缺失记录只写日志，不计算停机期间缺失的快照
+func Start(db *gorm.DB) time.Time {
+	go func() {
+		for gap := range queue {
+			if db == nil {
+				slog.Warnf("快照缺失 %+v", *gap)
+				pending.Done()
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			err := db.WithContext(ctx).Create(gap).Error
+			cancel()
+			if err != nil {
+				slog.Errorf("保存缺失记录失败: %v %+v", err, *gap)
+			}
+			pending.Done()
+		}
+	}()
+
+	if db == nil {
+		return time.Time{}
+	}
+	store = db
+	var last time.Time
+	var hb heartbeat
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	err := db.WithContext(ctx).Where("id = ?", node()).Limit(1).Find(&hb).Error
+	if err == nil && hb.LastTick == "" {
+		//升级后第一次启动，使用升级前的心跳
+		err = db.WithContext(ctx).Where("id = ?", legacyID).Limit(1).Find(&hb).Error
+	}
+	cancel()
+	if err != nil {
+		slog.Errorf("读取采集程序心跳失败: %v", err)
+	} else if hb.LastTick != "" {
+		last, _ = time.ParseInLocation("2006-01-02 15:04:05", hb.LastTick, time.Local)
+	}
+
+	go func() {
+		ticker := time.NewTicker(HeartbeatInterval)
+		defer ticker.Stop()
+		for now := time.Now(); ; now = <-ticker.C {
+			beat(db, now)
+		}
+	}()
+	return last
+}
+
+// Stop 退出前保存最后一次心跳，下次启动从这里开始计算停机期间缺失的快照
+func Stop() {
+	if store != nil {
+		beat(store, time.Now())
+	}
+}
+
+func beat(db *gorm.DB, now time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	hb := heartbeat{ID: node(), LastTick: now.Format("2006-01-02 15:04:05")}
+	err := db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&hb).Error
+	if err != nil {
+		slog.Errorf("保存采集程序心跳失败: %v", err)
+	}
+}
+
+// node 本节点标识，集群中各节点的心跳分开记录
+func node() string {
+	return config.Get().Cluster.Node
+}
+
+// Flush 等待缺失记录写入完成，用于退出前保存，超时返回false
+func Flush(timeout time.Duration) bool {
+	return util.WaitTimeout(&pending, timeout)
+}
+
+// Report 统计时间范围内各实例的快照覆盖率，instId为0时统计所有实例
+// 应采集数按实例的采集间隔和时间窗口，计算查询范围内实例在用期间（添加之后、去掉暂停期间）的定时采集时刻数，
+// 没有缺失记录的采集时刻（例如停机后没有再启动）也计为缺失，原因为unknown；手动快照不计入，避免掩盖缺失
+func Report(ctx context.Context, db *gorm.DB, instId int, start, end time.Time) ([]*model.Coverage, error) {
+	if now := time.Now(); end.After(now) {
+		end = now
+	}
+	var configs []model.DBSnapshotConfig
+	query := db.WithContext(ctx)
+	if instId > 0 {
+		query = query.Where("inst_id = ?", instId)
+	}
+	err := query.Order("inst_id").Find(&configs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var events []model.Event
+	query = db.WithContext(ctx).Where("type IN ? AND create_time <= ?", []string{event.Paused, event.Resumed}, end)
+	if instId > 0 {
+		query = query.Where("inst_id = ?", instId)
+	}
+	err = query.Order("create_time, id").Find(&events).Error
+	if err != nil {
+		return nil, err
+	}
+	toggles := make(map[int][]model.Event)
+	for _, e := range events {
+		toggles[e.InstID] = append(toggles[e.InstID], e)
+	}
+
+	defaultInterval := time.Second * time.Duration(config.Get().Interval)
+	result := make(map[int]*model.Coverage, len(configs))
+	list := make([]*model.Coverage, 0, len(configs))
+	for _, v := range configs {
+		inst := instance(v)
+		c := &model.Coverage{InstID: inst.InstId, Reasons: make(map[string]int)}
+		created, err := time.ParseInLocation("2006-01-02 15:04:05", v.CreateTime, time.Local)
+		if err != nil {
+			created = start
+		}
+		interval := inst.CaptureInterval(defaultInterval)
+		for _, p := range active(created, inst.Enabled, toggles[inst.InstId], start, end) {
+			c.Expected += ticks(&inst, interval, p.start, p.end)
+		}
+		result[inst.InstId] = c
+		list = append(list, c)
+	}
+
+	var landed []struct {
+		InstID int
+		Cnt    int
+	}
+	query = db.WithContext(ctx).Model(&model.DBSnapshot{}).Select("inst_id, count(*) cnt").
+		Where("create_time BETWEEN ? AND ?", start, end).Where("scheduled = ?", true).
+		//快照文件保存失败的快照已记为缺失
+		Where("msg IS NULL OR msg NOT LIKE ?", model.SaveFailed+"%")
+	if instId > 0 {
+		query = query.Where("inst_id = ?", instId)
+	}
+	err = query.Group("inst_id").Scan(&landed).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range landed {
+		if c, ok := result[v.InstID]; ok {
+			c.Landed = v.Cnt
+		}
+	}
+
+	var missed []struct {
+		InstID int
+		Reason string
+		Cnt    int
+	}
+	query = db.WithContext(ctx).Model(&model.CoverageGap{}).Select("inst_id, reason, sum(missed) cnt").
+		Where("expected_time BETWEEN ? AND ?", start, end)
+	if instId > 0 {
+		query = query.Where("inst_id = ?", instId)
+	}
+	err = query.Group("inst_id, reason").Scan(&missed).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range missed {
+		if c, ok := result[v.InstID]; ok {
+			c.Missed += v.Cnt
+			c.Reasons[v.Reason] += v.Cnt
+		}
+	}
+
+	for _, c := range list {
+		fill(c)
+	}
+	return list, nil
+}
+
+// instance 覆盖率计算用到的实例配置
+func instance(v model.DBSnapshotConfig) model.Instance {
+	inst := model.Instance{InstId: int(v.InstID), Enabled: v.Enabled == nil || *v.Enabled}
+	if v.IntervalSeconds != nil {
+		inst.IntervalSeconds = *v.IntervalSeconds
+	}
+	if v.WindowStart != nil && v.WindowEnd != nil {
+		inst.WindowStart, inst.WindowEnd = *v.WindowStart, *v.WindowEnd
+	}
+	return inst
+}
+
+// period 实例在用的时间段
+type period struct {
+	start, end time.Time
+}
+
+// active 返回[start, end]中实例在用的时间段：添加之后，去掉暂停期间
+// toggles为按时间排序的暂停、恢复事件，没有事件时按实例当前是否启用判断
+func active(created time.Time, enabled bool, toggles []model.Event, start, end time.Time) []period {
+	if created.After(start) {
+		start = created
+	}
+	if !start.Before(end) {
+		return nil
+	}
+
+	//查询范围开始时是否启用：之前最后一个事件，或者之后第一个事件之前的状态
+	on := enabled
+	i := 0
+	for ; i < len(toggles); i++ {
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", toggles[i].CreateTime, time.Local)
+		if err == nil && t.After(start) {
+			break
+		}
+		on = toggles[i].Type == event.Resumed
+	}
+	if i == 0 && i < len(toggles) {
+		on = toggles[0].Type == event.Paused
+	}
+
+	var list []period
+	from := start
+	for ; i < len(toggles); i++ {
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", toggles[i].CreateTime, time.Local)
+		if err != nil || t.After(end) {
+			break
+		}
+		resumed := toggles[i].Type == event.Resumed
+		switch {
+		case on && !resumed:
+			list = append(list, period{from, t})
+		case !on && resumed:
+			from = t
+		}
+		on = resumed
+	}
+	if on {
+		list = append(list, period{from, end})
+	}
+	return list
+}
+
+// ticks 返回[start, end]中在时间窗口内的采集时刻数，采集时刻按采集间隔对齐，与调度一致
+func ticks(inst *model.Instance, interval time.Duration, start, end time.Time) int {
+	first := start.Truncate(interval)
+	if first.Before(start) {
+		first = first.Add(interval)
+	}
+	if first.After(end) {
+		return 0
+	}
+	if inst.WindowStart == "" || inst.WindowEnd == "" {
+		return int(end.Sub(first)/interval) + 1
+	}
+	n := 0
+	for t := first; !t.After(end); t = t.Add(interval) {
+		if inst.InWindow(t) {
+			n++
+		}
+	}
+	return n
+}
+
+// fill 计算缺失数和覆盖率，没有记录原因的采集时刻计为unknown
+// 高频采集期间或调小采集间隔后定时快照多于按当前间隔计算的采集时刻，应采集数不小于已保存和记录缺失的快照数
+func fill(c *model.Coverage) {
+	recorded := c.Landed + c.Missed
+	if c.Expected < recorded {
+		c.Expected = recorded
+	}
+	if unknown := c.Expected - recorded; unknown > 0 {
+		c.Missed += unknown
+		c.Reasons[Unknown] += unknown
+	}
+	c.Percent = 0
+	if c.Expected > 0 {
+		c.Percent = math.Round(float64(c.Landed)*10000/float64(c.Expected)) / 100
+	}
+}
@@ -0,0 +1,139 @@
+package coverage
+
+import (
+	"context"
+	"db-snapshot/event"
+	"db-snapshot/model"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFill(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected int //按采集间隔计算的采集时刻数
+		landed   int
+		missed   int
+		want     int
+		unknown  int
+		percent  float64
+	}{
+		{"无快照", 0, 0, 0, 0, 0, 0},
+		{"全部保存", 120, 120, 0, 120, 0, 100},
+		{"全部缺失", 30, 0, 30, 30, 0, 0},
+		{"部分缺失", 120, 117, 3, 120, 0, 97.5},
+		{"四舍五入", 3, 2, 1, 3, 0, 66.67},
+		{"停机没有缺失记录", 120, 60, 0, 120, 60, 50},
+		{"部分缺失有记录", 120, 100, 5, 120, 15, 83.33},
+		{"高频采集多出的快照", 120, 150, 2, 152, 0, 98.68},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &model.Coverage{Expected: tt.expected, Landed: tt.landed, Missed: tt.missed, Percent: -1, Reasons: map[string]int{}}
+			fill(c)
+			if c.Expected != tt.want || c.Reasons[Unknown] != tt.unknown || c.Missed != tt.want-tt.landed || c.Percent != tt.percent {
+				t.Errorf("fill = %+v, want Expected %d unknown %d %v%%", c, tt.want, tt.unknown, tt.percent)
+			}
+		})
+	}
+}
+
+func TestTicks(t *testing.T) {
+	day := time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local)
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("15:04:05", s, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return day.Add(time.Duration(v.Hour())*time.Hour + time.Duration(v.Minute())*time.Minute + time.Duration(v.Second())*time.Second)
+	}
+	tests := []struct {
+		name     string
+		inst     model.Instance
+		interval time.Duration
+		start    string
+		end      string
+		want     int
+	}{
+		{"一小时每30秒", model.Instance{}, 30 * time.Second, "10:00:00", "11:00:00", 121},
+		{"起止不在采集时刻", model.Instance{}, time.Minute, "10:00:30", "10:10:30", 10},
+		{"范围小于采集间隔", model.Instance{}, time.Minute, "10:00:10", "10:00:50", 0},
+		{"时间窗口内", model.Instance{WindowStart: "10:30", WindowEnd: "11:00"}, time.Minute, "10:00:00", "12:00:00", 30},
+		{"跨零点的时间窗口", model.Instance{WindowStart: "22:00", WindowEnd: "06:00"}, time.Hour, "00:00:00", "23:59:59", 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ticks(&tt.inst, tt.interval, at(tt.start), at(tt.end)); got != tt.want {
+				t.Errorf("ticks = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestActive(t *testing.T) {
+	ts := func(h int) time.Time {
+		return time.Date(2025, 1, 1, h, 0, 0, 0, time.Local)
+	}
+	ev := func(h int, typ string) model.Event {
+		return model.Event{CreateTime: ts(h).Format("2006-01-02 15:04:05"), Type: typ}
+	}
+	tests := []struct {
+		name    string
+		created int
+		enabled bool
+		toggles []model.Event
+		want    []int //各时间段的起止小时
+	}{
+		{"一直启用", 0, true, nil, []int{8, 20}},
+		{"一直暂停", 0, false, nil, nil},
+		{"范围内添加", 12, true, nil, []int{12, 20}},
+		{"范围后添加", 21, true, nil, nil},
+		{"范围内暂停后恢复", 0, true, []model.Event{ev(10, event.Paused), ev(14, event.Resumed)}, []int{8, 10, 14, 20}},
+		{"范围前暂停，范围内恢复", 0, true, []model.Event{ev(6, event.Paused), ev(15, event.Resumed)}, []int{15, 20}},
+		{"范围内暂停至今", 0, false, []model.Event{ev(18, event.Paused)}, []int{8, 18}},
+		{"范围前恢复", 0, true, []model.Event{ev(2, event.Paused), ev(4, event.Resumed)}, []int{8, 20}},
+		{"范围后暂停", 0, false, []model.Event{ev(22, event.Paused)}, []int{8, 20}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []int
+			for _, p := range active(ts(tt.created), tt.enabled, tt.toggles, ts(8), ts(20)) {
+				got = append(got, p.start.Hour(), p.end.Hour())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("active = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReason(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want string
+	}{
+		{"连接失败", context.Background(), fmt.Errorf("%w: dial tcp", ErrConnect), Connect},
+		{"熔断时截止时间也已过", expired, fmt.Errorf("%w: 熔断中", ErrConnect), Connect},
+		{"超过截止时间", expired, errors.New("query failed"), Timeout},
+		{"查询超时", context.Background(), fmt.Errorf("getTxn-> %w", context.DeadlineExceeded), Timeout},
+		{"程序退出", canceled, context.Canceled, Down},
+		{"保存失败", context.Background(), fmt.Errorf("%w: disk full", ErrSave), Failed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Reason(tt.ctx, tt.err); got != tt.want {
+				t.Errorf("Reason(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
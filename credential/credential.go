@@ -0,0 +1,133 @@
+package credential
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"db-snapshot/config"
+	"db-snapshot/model"
+	"db-snapshot/util"
+	"encoding/hex"
+	"fmt"
+	"gorm.io/gorm"
+	"sync/atomic"
+	"time"
+)
+
+// 按数据库类型配置的默认账号，密码为密文
+var defaults atomic.Value
+
+// LoadDefaults 载入 db_snapshot_credential 中按数据库类型配置的默认账号
+func LoadDefaults(db *gorm.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var rows []model.DBSnapshotCredential
+	if err := db.WithContext(ctx).Find(&rows).Error; err != nil {
+		return err
+	}
+	m := make(map[string]model.DBSnapshotCredential, len(rows))
+	for _, v := range rows {
+		m[v.DBType] = v
+	}
+	defaults.Store(m)
+	return nil
+}
+
+// Resolve 返回实例的监控账号，优先级: 实例账号 > 数据库类型默认账号 > 全局账号
+func Resolve(i *model.Instance) (user, password string, err error) {
+	if i.MonitorUser != "" {
+		password, err = decrypt(i.MonitorPassword)
+		if err != nil {
+			return "", "", fmt.Errorf("实例%d的监控密码: %w", i.InstId, err)
+		}
+		return i.MonitorUser, password, nil
+	}
+
+	if m, ok := defaults.Load().(map[string]model.DBSnapshotCredential); ok {
+		if v, ok := m[i.DBType]; ok && v.MonitorUser != "" {
+			password, err = decrypt(v.MonitorPassword)
+			if err != nil {
+				return "", "", fmt.Errorf("数据库类型%s的监控密码: %w", i.DBType, err)
+			}
+			return v.MonitorUser, password, nil
+		}
+	}
+
+	user, password = config.Get().MonitorCredential()
+	return user, password, nil
+}
+
+// Fill 实例未配置账号时填入数据库类型默认账号，密码保持密文，用于下发给采集代理
+func Fill(i *model.Instance) {
+	if i.MonitorUser != "" {
+		return
+	}
+	if m, ok := defaults.Load().(map[string]model.DBSnapshotCredential); ok {
+		if v, ok := m[i.DBType]; ok {
+			i.MonitorUser, i.MonitorPassword = v.MonitorUser, v.MonitorPassword
+		}
+	}
+}
+
+// WrapForAgent 填入数据库类型默认账号，密码改用代理密钥加密后下发给采集代理，代理不需要中心的 master_key
+// token为已认证的代理令牌，中心解密失败时不下发账号，代理使用配置文件中的统一账号
+func WrapForAgent(i *model.Instance, token string) error {
+	Fill(i)
+	if i.MonitorPassword == "" {
+		return nil
+	}
+	password, err := decrypt(i.MonitorPassword)
+	if err == nil {
+		i.MonitorPassword, err = util.Encrypt(agentKey(token), password)
+	}
+	if err != nil {
+		i.MonitorUser, i.MonitorPassword = "", ""
+		return fmt.Errorf("实例%d的监控密码: %w", i.InstId, err)
+	}
+	return nil
+}
+
+// agentKey 代理密钥，由中心签发给该代理的令牌派生，其他代理的令牌解不开
+func agentKey(token string) string {
+	h := hmac.New(sha256.New, []byte(token))
+	h.Write([]byte("db-snapshot agent credential"))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// NewAgentToken 为代理签发随机令牌，中心只保存令牌的摘要
+func NewAgentToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(b)
+	return token, AgentTokenHash(token), nil
+}
+
+// AgentTokenHash 令牌的摘要，中心按摘要识别代理
+func AgentTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Encrypt 使用配置的 master_key 加密密码，空密码不加密
+func Encrypt(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+	return util.Encrypt(config.Get().GetMasterKey(), password)
+}
+
+func decrypt(cipherText string) (string, error) {
+	if cipherText == "" {
+		return "", nil
+	}
+	cfg := config.Get()
+	if cfg.Agent.IsAgent() {
+		//代理的实例账号由中心使用代理密钥加密后下发
+		return util.Decrypt(agentKey(cfg.AgentToken()), cipherText)
+	}
+	return util.Decrypt(cfg.GetMasterKey(), cipherText)
+}
@@ -0,0 +1,61 @@
+package credential
+
+import (
+	"db-snapshot/util"
+	"testing"
+)
+
+func TestAgentKey(t *testing.T) {
+	tokenA, _, err := NewAgentToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenB, _, err := NewAgentToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		encTok string
+		decTok string
+		ok     bool
+	}{
+		{"同一代理", tokenA, tokenA, true},
+		{"其他代理的令牌", tokenA, tokenB, false},
+		{"令牌摘要", tokenA, AgentTokenHash(tokenA), false},
+		{"空令牌", tokenA, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc, err := util.Encrypt(agentKey(tt.encTok), "p@ss:w/rd")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := util.Decrypt(agentKey(tt.decTok), enc)
+			if tt.ok && (err != nil || got != "p@ss:w/rd") {
+				t.Errorf("Decrypt = %q, %v", got, err)
+			}
+			if !tt.ok && err == nil {
+				t.Errorf("Decrypt with another key succeeded: %q", got)
+			}
+		})
+	}
+}
+
+func TestNewAgentToken(t *testing.T) {
+	seen := make(map[string]bool)
+	for range 100 {
+		token, hash, err := NewAgentToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(token) != 64 || seen[token] {
+			t.Fatalf("token %q is not a fresh 32-byte hex string", token)
+		}
+		seen[token] = true
+		//中心只保存摘要，摘要不能当作令牌使用
+		if hash != AgentTokenHash(token) || hash == token || agentKey(token) == agentKey(hash) {
+			t.Errorf("hash %q of token %q", hash, token)
+		}
+	}
+}
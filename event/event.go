@@ -0,0 +1,62 @@
+package event
+
+import (
+	"context"
+	"db-snapshot/model"
+	"db-snapshot/util"
+	"github.com/gookit/slog"
+	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+// 事件类型
+const (
+	Skipped      = "skipped"       //上一次采集未完成，跳过本次采集
+	BreakerOpen  = "breaker_open"  //连续连接失败，熔断
+	BreakerClose = "breaker_close" //连接恢复，关闭熔断
+	Paused       = "paused"        //暂停采集，暂停期间不计入应采集的快照
+	Resumed      = "resumed"       //恢复采集
+)
+
+var (
+	queue   = make(chan *model.Event, 1000)
+	pending sync.WaitGroup //未写入的事件
+)
+
+// Record 记录一个事件，异步写入，不阻塞调度
+func Record(instId int, typ string, t time.Time, msg string) {
+	e := &model.Event{InstID: instId, CreateTime: t.Format("2006-01-02 15:04:05"), Type: typ, Msg: msg}
+	pending.Add(1)
+	select {
+	case queue <- e:
+	default:
+		pending.Done()
+		slog.Warnf("事件队列已满，丢弃事件 %+v", *e)
+	}
+}
+
+// Start 启动事件写入，代理模式没有元数据库，db为nil时只记录日志
+func Start(db *gorm.DB) {
+	go func() {
+		for e := range queue {
+			if db == nil {
+				slog.Infof("调度事件 %+v", *e)
+				pending.Done()
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			err := db.WithContext(ctx).Create(e).Error
+			cancel()
+			if err != nil {
+				slog.Errorf("保存事件失败: %v %+v", err, *e)
+			}
+			pending.Done()
+		}
+	}()
+}
+
+// Flush 等待队列中的事件写入完成，用于退出前保存，超时返回false
+func Flush(timeout time.Duration) bool {
+	return util.WaitTimeout(&pending, timeout)
+}
@@ -27,6 +27,12 @@ font-size: 14px;
 color: #2468a2;
 }
 
+/* 采集报错 */
+.section-error {
+color: #d93025;
+white-space: pre-wrap;
+}
+
 /* 表格样式 */
 table {
 white-space: nowrap;
@@ -1,14 +1,17 @@
 package html
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"db-snapshot/storage"
 	"db-snapshot/util"
 	"fmt"
 	"github.com/andybalholm/brotli"
 	"github.com/gookit/slog"
+	"html/template"
 	"os"
-	"path/filepath"
 	"strings"
+	"time"
 )
 
 type Html struct {
@@ -170,6 +173,16 @@ func (self *Html) AddTableRowWithClassID(title string, fieldNames []string, data
 	self.Tables = append(self.Tables, text)
 }
 
+// AddError 在数据块下方显示采集报错，表格为空时用于区分没有数据和采集失败
+func (self *Html) AddError(msg string, timeout bool) {
+	title := "采集报错"
+	if timeout {
+		title = "采集超时"
+	}
+	text := fmt.Sprintf(`<p class="section-error">%s: %s</p><br>`, title, template.HTMLEscapeString(msg))
+	self.Tables = append(self.Tables, text)
+}
+
 func (self *Html) Save(dirname, filename string) {
 	//保存
 
@@ -196,27 +209,11 @@ func (self *Html) Save(dirname, filename string) {
 
 }
 
-func (self *Html) SaveToBrotli(dirname, filename string) error {
-	fullPath := filepath.Join(dirname, filename+".br")
-
-	// 创建目录
-	if _, err := os.Stat(dirname); os.IsNotExist(err) {
-		err := os.MkdirAll(dirname, 0775)
-		if err != nil {
-			return fmt.Errorf("创建目录失败: %w", err)
-		}
-	}
-
-	// 创建文件
-	file, err := os.Create(fullPath)
-	if err != nil {
-		return fmt.Errorf("创建文件失败: %w", err)
-	}
-	defer file.Close()
-
-	// file (磁盘) <- bufio (缓冲区) <- brWriter (压缩器)
-	buf := bufio.NewWriterSize(file, 64*1024) // 设置 64KB 缓冲区
-	brWriter := brotli.NewWriterLevel(buf, brotli.DefaultCompression)
+// SaveToBrotli 压缩后保存到配置的存储，name为相对存储根目录的路径（不含.br），例如 202501/12/20250101_120000.html
+func (self *Html) SaveToBrotli(name string) error {
+	// buf (内存) <- brWriter (压缩器)，快照压缩后一般只有几百KB，整体上传到存储
+	var buf bytes.Buffer
+	brWriter := brotli.NewWriterLevel(&buf, brotli.DefaultCompression)
 
 	// 写入数据
 	if _, err := brWriter.Write([]byte(self.Head1)); err != nil {
@@ -235,10 +232,11 @@ func (self *Html) SaveToBrotli(dirname, filename string) error {
 	if err := brWriter.Close(); err != nil {
 		return fmt.Errorf("brotli close 失败: %w", err)
 	}
-	// 再刷新缓冲区（真正写入磁盘）
-	if err := buf.Flush(); err != nil {
-		return fmt.Errorf("bufio flush 失败: %w", err)
-	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := storage.Put(ctx, name+".br", buf.Bytes()); err != nil {
+		return fmt.Errorf("保存文件失败: %w", err)
+	}
 	return nil
 }
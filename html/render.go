@@ -0,0 +1,48 @@
+package html
+
+import "db-snapshot/model"
+
+// Render 将结构化快照渲染为html页面
+func Render(snap *model.Snapshot) *Html {
+	page := &Html{}
+
+	var dbName *string
+	if snap.DBName != "" {
+		dbName = &snap.DBName
+	}
+	page.AddHead1(snap.Summary.CreateTime, snap.Summary.InstID, snap.Host, snap.Port, dbName)
+
+	var titles, refIds []string
+	var values []int
+	withHref := false
+	for _, m := range snap.Metrics {
+		titles = append(titles, m.Title)
+		refIds = append(refIds, m.Ref)
+		values = append(values, m.Value)
+		if m.Ref != "" {
+			withHref = true
+		}
+	}
+	if withHref {
+		page.AddHeadWithHref(titles, refIds, values)
+	} else {
+		page.AddHead2(titles, values)
+	}
+
+	for _, sec := range snap.Sections {
+		switch {
+		case len(sec.AnchorCols) > 0:
+			page.AddTableRowWithClassID(sec.Title, sec.Columns, sec.Rows, sec.AnchorCols[0])
+		case len(sec.LinkCols) > 0:
+			page.AddTableWithClassIDAndRowHref(sec.Title, sec.ID, sec.Columns, sec.Rows, sec.LinkCols)
+		case sec.ID != "":
+			page.AddTableWithClassID(sec.Title, sec.ID, sec.Columns, sec.Rows)
+		default:
+			page.AddTable(sec.Title, sec.Columns, sec.Rows)
+		}
+		if sec.Error != "" {
+			page.AddError(sec.Error, sec.Timeout)
+		}
+	}
+	return page
+}
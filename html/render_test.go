@@ -0,0 +1,42 @@
+package html
+
+import (
+	"context"
+	"db-snapshot/model"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderSectionError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string //为空表示不显示报错
+	}{
+		{"无报错", nil, ""},
+		{"已跳过", fmt.Errorf("getLock-> %w", model.ErrSkipped), ""},
+		{"超时", fmt.Errorf("getTxn-> %w", context.DeadlineExceeded), "采集超时: getTxn-&gt; context deadline exceeded"},
+		{"报错转义", errors.New("getActSess-> Error 1142: <select> denied"), "采集报错: getActSess-&gt; Error 1142: &lt;select&gt; denied"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snap := model.NewSnapshot(1, "10.0.0.1", 3306, time.Now())
+			snap.AddSection(&model.Section{Title: "事务", Columns: []string{"PID"}}, tt.err)
+			page := Render(snap)
+			text := strings.Join(page.Tables, "\n")
+			has := strings.Contains(text, `class="section-error"`)
+			if tt.want == "" {
+				if has {
+					t.Errorf("unexpected error block: %s", text)
+				}
+				return
+			}
+			if !strings.Contains(text, tt.want) {
+				t.Errorf("error block missing %q: %s", tt.want, text)
+			}
+		})
+	}
+}
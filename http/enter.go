@@ -1,6 +1,9 @@
 package http
 
 import (
+	"db-snapshot/scheduler"
+	"db-snapshot/storage"
+	"db-snapshot/threading"
 	"embed"
 	"fmt"
 	"github.com/andybalholm/brotli"
@@ -10,11 +13,12 @@ import (
 	"io/fs"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strconv"
 	"strings"
 )
 
-func StartService(db *gorm.DB, port int, embedFS embed.FS) {
+// NewServer 创建http服务，由调用方启动和关闭
+func NewServer(db *gorm.DB, port int, embedFS embed.FS, sched *scheduler.Scheduler, pool *threading.Pool) *http.Server {
 
 	f, err := os.OpenFile("http.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
@@ -52,6 +56,26 @@ func StartService(db *gorm.DB, port int, embedFS embed.FS) {
 		api := root.Group("/api")
 		{
 			api.GET("/snapshotList", GetDBSnapshotList(db))
+			api.GET("/round", GetRound(db))
+			api.GET("/pools", ListPoolHandler)
+			api.GET("/workers", WorkerStats(pool))
+			api.PUT("/workers", ResizeWorkers(pool))
+			api.GET("/recordingList", GetRecordingList(db))
+			api.GET("/fileList", GetFileList)
+			api.GET("/eventList", GetEventList(db))
+			api.GET("/coverage", GetCoverage(db))
+			api.GET("/instance/status", ListInstanceStatus(db))
+			api.GET("/agentList", ListAgents(db))
+			api.POST("/agentToken/:name", IssueAgentToken(db))
+			api.GET("/cluster", GetClusterStatus)
+			api.GET("/spool", GetSpoolStats)
+
+			//采集代理接口，需要中心为该代理签发的令牌
+			ag := api.Group("/agent", AgentAuth(db))
+			{
+				ag.POST("/heartbeat", AgentHeartbeat(db))
+				ag.POST("/ingest", AgentIngest(db))
+			}
 
 			config := api.Group("/config")
 			{
@@ -60,9 +84,27 @@ func StartService(db *gorm.DB, port int, embedFS embed.FS) {
 				config.GET("/:inst_id", GetConfig(db))
 				config.PUT("/:inst_id", UpdateConfig(db))
 				config.DELETE("/:inst_id", DeleteConfig(db))
-				config.POST("/ping", TestConnectionHandler)
+				config.POST("/:inst_id/pause", SetEnabled(db, false))
+				config.POST("/:inst_id/resume", SetEnabled(db, true))
+				config.POST("/:inst_id/capture", CaptureNow(sched))
+				config.POST("/ping", TestConnection(db))
+				config.GET("/types", ListDBTypeHandler)
 				config.GET("/reload", ReloadConfigHandler)
 			}
+
+			credential := api.Group("/credential")
+			{
+				credential.GET("/", ListCredential(db))
+				credential.PUT("/:db_type", SaveCredential(db))
+				credential.DELETE("/:db_type", DeleteCredential(db))
+			}
+
+			rec := api.Group("/recorder")
+			{
+				rec.GET("/", ListRecorderHandler)
+				rec.POST("/:inst_id/dump", DumpRecorderHandler)
+				rec.POST("/webhook", RecorderWebhook)
+			}
 		}
 
 		// 将 web/static 映射到 /db-snapshot/static
@@ -70,43 +112,42 @@ func StartService(db *gorm.DB, port int, embedFS embed.FS) {
 
 		//root.Static("/data", "./data")
 		root.GET("/data/:date/:id/:filename", func(c *gin.Context) {
-			date := c.Param("date")
-			id := c.Param("id")
-			filename := c.Param("filename") + ".br"
+			name := c.Param("date") + "/" + c.Param("id") + "/" + c.Param("filename") + ".br"
 
-			filePath := filepath.Join("data", date, id, filename)
-
-			if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			// 从配置的存储读取，本地目录或对象存储
+			r, info, err := storage.Get(c.Request.Context(), name)
+			if storage.IsNotExist(err) {
 				c.String(http.StatusNotFound, "File not found")
 				return
 			}
+			if err != nil {
+				c.Error(err)
+				c.String(http.StatusInternalServerError, err.Error())
+				return
+			}
+			defer r.Close()
+
+			c.Header("Content-Type", "text/html; charset=utf-8")
+			if !info.ModTime.IsZero() {
+				c.Header("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+			}
 
 			// 检查浏览器是否支持 br
 			acceptEncoding := c.GetHeader("Accept-Encoding")
 			if !strings.Contains(acceptEncoding, "br") {
-				// 不支持 br的浏览器
-				file, _ := os.Open(filePath)
-				if err != nil {
-					c.String(http.StatusNotFound, err.Error())
-					return
-				}
-				defer file.Close()
-
-				// 创建解压器
-				brReader := brotli.NewReader(file)
-				c.Header("Content-Type", "text/html; charset=utf-8")
+				// 不支持 br的浏览器，解压后返回
+				brReader := brotli.NewReader(r)
 				// 使用 io.Copy 将解压后的流直接写回响应
 				io.Copy(c.Writer, brReader)
-
 				return
 			}
 
-			c.Header("Content-Type", "text/html; charset=utf-8")
 			c.Header("Content-Encoding", "br")
 			c.Header("Cache-Control", "public, max-age=60") // 缓存一分钟
-
-			c.File(filePath)
-
+			if info.Size >= 0 {
+				c.Header("Content-Length", strconv.FormatInt(info.Size, 10))
+			}
+			io.Copy(c.Writer, r)
 		})
 
 		root.GET("/config", func(c *gin.Context) {
@@ -129,7 +170,7 @@ func StartService(db *gorm.DB, port int, embedFS embed.FS) {
 
 	}
 
-	r.Run(fmt.Sprintf(":%d", port))
+	return &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: r}
 }
 
 // 提取跨域中间件
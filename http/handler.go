@@ -1,12 +1,30 @@
 package http
 
 import (
+	"crypto/subtle"
+	"db-snapshot/agent"
+	"db-snapshot/capturer"
+	"db-snapshot/cluster"
 	"db-snapshot/config"
+	"db-snapshot/connmgr"
+	"db-snapshot/coverage"
+	"db-snapshot/credential"
+	"db-snapshot/event"
 	"db-snapshot/model"
-	"db-snapshot/util"
+	"db-snapshot/recorder"
+	"db-snapshot/scheduler"
+	"db-snapshot/spool"
+	"db-snapshot/storage"
+	"db-snapshot/threading"
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -16,46 +34,59 @@ type QueryParams struct {
 	EndTime   *string `form:"end_time"`
 }
 
-func GetDBSnapshotList(db *gorm.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		var q QueryParams
-		if err := c.ShouldBindQuery(&q); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "参数错误: " + err.Error()})
-			return
-		}
+// bindQuery 解析实例ID和时间范围，默认查询最近24小时，参数错误时返回false
+func bindQuery(c *gin.Context) (q QueryParams, start, end time.Time, ok bool) {
+	if err := c.ShouldBindQuery(&q); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "参数错误: " + err.Error()})
+		return
+	}
 
-		if q.InstID <= 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "参数错误: inst_id"})
+	if q.InstID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "参数错误: inst_id"})
+		return
+	}
+
+	start, end, ok = parseRange(c, q.StartTime, q.EndTime)
+	return
+}
+
+// parseRange 解析时间范围，默认最近24小时，参数错误时返回false
+func parseRange(c *gin.Context, startTime, endTime *string) (start, end time.Time, ok bool) {
+	var err error
+	if startTime == nil {
+		start = time.Now().Add(-time.Hour * 24)
+	} else {
+		start, err = time.ParseInLocation("2006-01-02 15:04:05", *startTime, time.Local)
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "start_time 格式错误"})
 			return
 		}
+	}
 
-		var err error
-		var start, end time.Time
-		if q.StartTime == nil {
-			start = time.Now().Add(-time.Hour * 24)
-		} else {
-			start, err = time.ParseInLocation("2006-01-02 15:04:05", *q.StartTime, time.Local)
-			if err != nil {
-				c.Error(err)
-				c.JSON(http.StatusBadRequest, gin.H{"error": "start_time 格式错误"})
-				return
-			}
+	if endTime == nil {
+		end = time.Now()
+	} else {
+		end, err = time.ParseInLocation("2006-01-02 15:04:05", *endTime, time.Local)
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "end_time 格式错误"})
+			return
 		}
+	}
+	return start, end, true
+}
 
-		if q.EndTime == nil {
-			end = time.Now()
-		} else {
-			end, err = time.ParseInLocation("2006-01-02 15:04:05", *q.EndTime, time.Local)
-			if err != nil {
-				c.Error(err)
-				c.JSON(http.StatusBadRequest, gin.H{"error": "end_time 格式错误"})
-				return
-			}
+func GetDBSnapshotList(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, start, end, ok := bindQuery(c)
+		if !ok {
+			return
 		}
 
 		// 构造查询
 		var list []model.DBSnapshot
-		err = db.Where("inst_id = ?", q.InstID).
+		err := db.Where("inst_id = ?", q.InstID).
 			Where("create_time BETWEEN ? AND ?", start, end).
 			Order("create_time").
 			Find(&list).Error
@@ -85,6 +116,19 @@ func ListConfig(db *gorm.DB) gin.HandlerFunc {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		//附带实例熔断状态，没有记录表示从未连接失败
+		var statusList []model.InstanceStatus
+		if err := db.Find(&statusList).Error; err != nil {
+			c.Error(err)
+		}
+		status := make(map[int64]*model.InstanceStatus, len(statusList))
+		for i := range statusList {
+			status[int64(statusList[i].InstID)] = &statusList[i]
+		}
+		for i := range list {
+			list[i].Redact()
+			list[i].Status = status[list[i].InstID]
+		}
 
 		c.JSON(http.StatusOK, list)
 	}
@@ -104,6 +148,7 @@ func GetConfig(db *gorm.DB) gin.HandlerFunc {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		cfg.Redact()
 
 		c.JSON(http.StatusOK, cfg)
 	}
@@ -119,12 +164,25 @@ func CreateConfig(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		if err := validateSchedule(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := encryptPassword(&req); err != nil {
+			c.Error(err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
 		if err := db.Create(&req).Error; err != nil {
 			c.Error(err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
+		//立即生效
+		config.Get().RequestReload()
 		c.JSON(http.StatusOK, gin.H{"inst_id": req.InstID})
 	}
 }
@@ -138,7 +196,12 @@ func DeleteConfig(db *gorm.DB) gin.HandlerFunc {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		if err := db.Delete(&model.InstanceStatus{}, "inst_id = ?", instID).Error; err != nil {
+			c.Error(err)
+		}
 
+		//立即生效
+		config.Get().RequestReload()
 		c.JSON(http.StatusOK, gin.H{"deleted": true})
 	}
 }
@@ -154,7 +217,39 @@ func UpdateConfig(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
-		// 只更新有效字段
+		if err := validateSchedule(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := encryptPassword(&req); err != nil {
+			c.Error(err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if req.ClearCredential {
+			req.MonitorUser, req.MonitorPassword = "", ""
+			if err := db.Model(&model.DBSnapshotConfig{}).
+				Where("inst_id = ?", instID).
+				Updates(map[string]interface{}{"monitor_user": "", "monitor_password": ""}).Error; err != nil {
+				c.Error(err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		//暂停、恢复需要记录事件
+		if req.Enabled != nil {
+			if _, err := setEnabled(db, instID, *req.Enabled); err != nil {
+				c.Error(err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			req.Enabled = nil
+		}
+
+		// 只更新有效字段，密码为空时保留原密码
 		if err := db.Model(&model.DBSnapshotConfig{}).
 			Where("inst_id = ?", instID).
 			Updates(req).Error; err != nil {
@@ -163,42 +258,801 @@ func UpdateConfig(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		//立即生效
+		config.Get().RequestReload()
 		c.JSON(http.StatusOK, gin.H{"updated": true})
 	}
 }
 
-func ReloadConfigHandler(c *gin.Context) {
-	config.Global.ReloadConfigChan <- struct{}{}
-	c.JSON(http.StatusOK, gin.H{"msg": "收到重载配置请求"})
+// SetEnabled 暂停或恢复实例采集，保留实例配置
+func SetEnabled(db *gorm.DB, enabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		found, err := setEnabled(db, c.Param("inst_id"), enabled)
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !found {
+			c.JSON(http.StatusNotFound, gin.H{"error": "记录不存在"})
+			return
+		}
+
+		//立即生效
+		config.Get().RequestReload()
+		c.JSON(http.StatusOK, gin.H{"enabled": enabled})
+	}
+}
+
+// setEnabled 修改实例是否采集，状态变化时记录暂停、恢复事件，覆盖率据此去掉暂停期间
+func setEnabled(db *gorm.DB, instID string, enabled bool) (found bool, err error) {
+	result := db.Model(&model.DBSnapshotConfig{}).Where("inst_id = ?", instID).Update("enabled", enabled)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	//值没有变化时影响行数为0
+	if result.RowsAffected > 0 {
+		id, _ := strconv.Atoi(instID)
+		if enabled {
+			event.Record(id, event.Resumed, time.Now(), "恢复采集")
+		} else {
+			event.Record(id, event.Paused, time.Now(), "暂停采集")
+		}
+		return true, nil
+	}
+	var cnt int64
+	err = db.Model(&model.DBSnapshotConfig{}).Where("inst_id = ?", instID).Count(&cnt).Error
+	return cnt > 0, err
 }
 
-func TestConnectionHandler(c *gin.Context) {
+// 采集代理名称
+var agentName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
 
-	var req model.DBSnapshotConfig
-	if err := c.ShouldBindJSON(&req); err != nil {
+// validateSchedule 校验采集间隔、时间窗口、实例级别、采集代理和分类规则
+func validateSchedule(req *model.DBSnapshotConfig) error {
+	if req.Threshold != nil && *req.Threshold != "" {
+		if _, ok := config.Get().Thresholds[*req.Threshold]; !ok {
+			return fmt.Errorf("分类规则 %s 未配置，需要先在配置文件中添加 [threshold.%s]", *req.Threshold, *req.Threshold)
+		}
+	}
+	if req.Agent != nil && *req.Agent != "" && !agentName.MatchString(*req.Agent) {
+		return fmt.Errorf("采集代理名称只能包含字母、数字、_.-，最长64个字符")
+	}
+	if req.Tier != nil && *req.Tier != 1 && *req.Tier != 2 {
+		return fmt.Errorf("实例级别只能是1或2")
+	}
+	if req.IntervalSeconds != nil && *req.IntervalSeconds < 0 {
+		return fmt.Errorf("采集间隔不能小于0")
+	}
+	if req.IntervalSeconds != nil && *req.IntervalSeconds > 0 && *req.IntervalSeconds < 5 {
+		return fmt.Errorf("采集间隔不能小于5秒")
+	}
+
+	var start, end string
+	if req.WindowStart != nil {
+		start = *req.WindowStart
+	}
+	if req.WindowEnd != nil {
+		end = *req.WindowEnd
+	}
+	for _, v := range []string{start, end} {
+		if v == "" {
+			continue
+		}
+		if _, err := time.Parse("15:04", v); err != nil || len(v) != 5 {
+			return fmt.Errorf("时间窗口格式错误，应为 HH:MM: %s", v)
+		}
+	}
+	if (start == "") != (end == "") && req.WindowStart != nil && req.WindowEnd != nil {
+		return fmt.Errorf("时间窗口的开始和结束时间需同时设置")
+	}
+	return nil
+}
+
+// ReloadConfigHandler 重载配置文件并重新载入实例列表，返回已生效和需要重启才能生效的配置项
+func ReloadConfigHandler(c *gin.Context) {
+	res, err := config.Reload()
+	if err != nil {
 		c.Error(err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "参数错误: " + err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	config.Get().RequestReload()
+	c.JSON(http.StatusOK, gin.H{"msg": "收到重载配置请求", "changed": res.Changed, "restart": res.Restart})
+}
+
+func TestConnection(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req model.DBSnapshotConfig
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.Error(err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "参数错误: " + err.Error()})
+			return
+		}
+
+		user, password, err := pingCredential(db, &req)
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		cfg := &model.DBConfig{
+			Host:     req.Host,
+			Port:     req.Port,
+			User:     user,
+			Password: password,
+			Database: req.DBName,
+		}
+
+		err = capturer.Ping(c.Request.Context(), req.DBType, cfg)
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "连接失败: " + err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"msg": "连接成功！"})
+	}
+}
 
-	if req.DBType == "pgsql" {
-		req.DBName = "postgres"
+// pingCredential 测试连接使用的账号：请求中的账号 > 已保存的实例账号 > 数据库类型默认账号 > 全局账号
+func pingCredential(db *gorm.DB, req *model.DBSnapshotConfig) (string, string, error) {
+	if req.MonitorUser != "" && req.MonitorPassword != "" {
+		return req.MonitorUser, req.MonitorPassword, nil
 	}
 
-	cfg := &model.DBConfig{
-		Host:     req.Host,
-		Port:     req.Port,
-		User:     config.Global.MonitorUser,
-		Password: config.Global.MonitorPassword,
-		Database: req.DBName,
+	inst := &model.Instance{InstId: int(req.InstID), DBType: req.DBType}
+	if req.InstID > 0 && !req.ClearCredential {
+		var saved model.DBSnapshotConfig
+		err := db.First(&saved, "inst_id = ?", req.InstID).Error
+		if err == nil && (req.MonitorUser == "" || req.MonitorUser == saved.MonitorUser) {
+			inst.MonitorUser, inst.MonitorPassword = saved.MonitorUser, saved.MonitorPassword
+		}
 	}
 
-	err := util.PingDB(req.DBType, cfg)
+	if err := credential.LoadDefaults(db); err != nil {
+		return "", "", err
+	}
+	return credential.Resolve(inst)
+}
+
+// encryptPassword 加密请求中的监控密码
+func encryptPassword(req *model.DBSnapshotConfig) error {
+	if req.MonitorPassword == "" {
+		return nil
+	}
+	if req.MonitorUser == "" {
+		return fmt.Errorf("设置监控密码时必须填写监控账号")
+	}
+	enc, err := credential.Encrypt(req.MonitorPassword)
 	if err != nil {
-		c.Error(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "连接失败: " + err.Error()})
+		return err
+	}
+	req.MonitorPassword = enc
+	return nil
+}
+
+func ListCredential(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var list []model.DBSnapshotCredential
+		if err := db.Order("db_type").Find(&list).Error; err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for i := range list {
+			list[i].Redact()
+		}
+
+		c.JSON(http.StatusOK, list)
+	}
+}
+
+// SaveCredential 设置数据库类型的默认监控账号
+func SaveCredential(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req model.DBSnapshotCredential
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.Error(err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "请求参数错误"})
+			return
+		}
+		req.DBType = c.Param("db_type")
+
+		if _, err := capturer.Lookup(req.DBType); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.MonitorUser == "" || req.MonitorPassword == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "监控账号和密码不能为空"})
+			return
+		}
+
+		enc, err := credential.Encrypt(req.MonitorPassword)
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		req.MonitorPassword = enc
+
+		if err := db.Save(&req).Error; err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		//立即生效
+		config.Get().RequestReload()
+		c.JSON(http.StatusOK, gin.H{"saved": true})
+	}
+}
+
+func DeleteCredential(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dbType := c.Param("db_type")
+
+		if err := db.Delete(&model.DBSnapshotCredential{}, "db_type = ?", dbType).Error; err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		//立即生效
+		config.Get().RequestReload()
+		c.JSON(http.StatusOK, gin.H{"deleted": true})
+	}
+}
+
+// ListDBTypeHandler 返回已注册的数据库类型，供配置页面下拉框使用
+func ListDBTypeHandler(c *gin.Context) {
+	var list []gin.H
+	for _, d := range capturer.Drivers() {
+		for _, a := range d.Aliases {
+			list = append(list, gin.H{"DBType": a.DBType, "Label": a.Label, "Driver": d.Name, "Capabilities": d.Capabilities})
+		}
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// ListPoolHandler 返回各实例连接池的统计信息
+func ListPoolHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, connmgr.Stats())
+}
+
+// GetRecordingList 返回实例在时间范围内的黑匣子转储记录
+func GetRecordingList(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, start, end, ok := bindQuery(c)
+		if !ok {
+			return
+		}
+
+		var list []model.Recording
+		err := db.Where("inst_id = ?", q.InstID).
+			Where("create_time BETWEEN ? AND ?", start, end).
+			Order("create_time").
+			Find(&list).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	}
+}
+
+// MaxFileListMonths 列出快照文件时最多查询的月数，每个月对应存储中的一个目录
+const MaxFileListMonths = 12
+
+// GetFileList 返回存储中实例在时间范围内的快照和黑匣子文件，包括没有快照汇总的文件
+func GetFileList(c *gin.Context) {
+	q, start, end, ok := bindQuery(c)
+	if !ok {
+		return
+	}
+	first := time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.Local)
+	if first.AddDate(0, MaxFileListMonths, 0).Before(end) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("时间范围不能超过%d个月", MaxFileListMonths)})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"msg": "连接成功！"})
+	list := []storage.Info{}
+	for month := first; !month.After(end); month = month.AddDate(0, 1, 0) {
+		files, err := storage.List(c.Request.Context(), fmt.Sprintf("%s/%d/", month.Format("200601"), q.InstID))
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for _, f := range files {
+			//文件名以采集时间开头，例如 20250101_120000.html.br、20250101_120000_recorder.html.br
+			base := f.Name[strings.LastIndex(f.Name, "/")+1:]
+			if len(base) < 15 {
+				continue
+			}
+			t, err := time.ParseInLocation("20060102_150405", base[:15], time.Local)
+			if err != nil || t.Before(start) || t.After(end) {
+				continue
+			}
+			list = append(list, f)
+		}
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// GetEventList 返回实例在时间范围内的调度事件
+func GetEventList(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, start, end, ok := bindQuery(c)
+		if !ok {
+			return
+		}
+
+		var list []model.Event
+		err := db.Where("inst_id = ?", q.InstID).
+			Where("create_time BETWEEN ? AND ?", start, end).
+			Order("create_time").
+			Find(&list).Error
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	}
+}
+
+// ListInstanceStatus 返回实例熔断状态，可按inst_id过滤
+func ListInstanceStatus(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query := db.Model(&model.InstanceStatus{})
+		if instID := c.Query("inst_id"); instID != "" {
+			query = query.Where("inst_id = ?", instID)
+		}
+
+		var list []model.InstanceStatus
+		if err := query.Order("inst_id").Find(&list).Error; err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	}
+}
+
+// ListRecorderHandler 返回各实例黑匣子的运行状态
+func ListRecorderHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, recorder.Stats())
+}
+
+// DumpRecorderHandler 手动转储实例的黑匣子
+func DumpRecorderHandler(c *gin.Context) {
+	instID, err := strconv.Atoi(c.Param("inst_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "参数错误: inst_id"})
+		return
+	}
+	rec, err := recorder.Dump(instID, "手动触发")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rec)
+}
+
+type WebhookRequest struct {
+	InstID int    `json:"InstID"`
+	Host   string `json:"Host"`
+	Port   int    `json:"Port"`
+	Reason string `json:"Reason"`
+}
+
+// RecorderWebhook 外部告警触发黑匣子转储，按InstID或Host+Port定位实例
+func RecorderWebhook(c *gin.Context) {
+	token := config.Get().Recorder.WebhookToken
+	if token == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "未配置webhook_token"})
+		return
+	}
+	reqToken := c.GetHeader("X-Token")
+	if reqToken == "" {
+		reqToken = c.Query("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(reqToken), []byte(token)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "token错误"})
+		return
+	}
+
+	var req WebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.InstID == 0 {
+		instID, ok := recorder.Find(req.Host, req.Port)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("%s:%d未开启黑匣子", req.Host, req.Port)})
+			return
+		}
+		req.InstID = instID
+	}
+	reason := "webhook触发"
+	if req.Reason != "" {
+		reason += ": " + req.Reason
+	}
+
+	rec, err := recorder.Dump(req.InstID, reason)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rec)
+}
+
+// CaptureNow 立即采集一次实例快照
+func CaptureNow(sched *scheduler.Scheduler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		instID, err := strconv.Atoi(c.Param("inst_id"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "参数错误: inst_id"})
+			return
+		}
+		if err := sched.CaptureNow(instID); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"submitted": true})
+	}
+}
+
+// WorkerStats 返回采集线程池的计数器
+func WorkerStats(pool *threading.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, pool.Stats())
+	}
+}
+
+type ResizeRequest struct {
+	Size int `json:"Size"`
+}
+
+// ResizeWorkers 调整采集线程池大小，重启后恢复为配置文件中的parallel
+func ResizeWorkers(pool *threading.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ResizeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := pool.Resize(req.Size); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, pool.Stats())
+	}
+}
+
+// GetCoverage 统计快照覆盖率，不指定inst_id时返回所有实例
+func GetCoverage(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var q struct {
+			InstID    int     `form:"inst_id"`
+			StartTime *string `form:"start_time"`
+			EndTime   *string `form:"end_time"`
+		}
+		if err := c.ShouldBindQuery(&q); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "参数错误: " + err.Error()})
+			return
+		}
+		start, end, ok := parseRange(c, q.StartTime, q.EndTime)
+		if !ok {
+			return
+		}
+
+		list, err := coverage.Report(c.Request.Context(), db, q.InstID, start, end)
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	}
+}
+
+// GetRound 返回一个调度轮次中所有实例的快照汇总和快照文件，按round_id查询，或按time查询该时刻及之前最近的轮次，都不指定时返回最近的轮次
+func GetRound(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var q struct {
+			RoundID int64   `form:"round_id"`
+			Time    *string `form:"time"`
+		}
+		if err := c.ShouldBindQuery(&q); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "参数错误: " + err.Error()})
+			return
+		}
+		db := db.WithContext(c.Request.Context())
+
+		//轮次ID为名义时刻的unix时间戳
+		nearest := func(query string, arg int64, order string) (int64, error) {
+			var ids []int64
+			err := db.Model(&model.DBSnapshot{}).Where("round_id > 0").Where(query, arg).Order(order).Limit(1).Pluck("round_id", &ids).Error
+			if err != nil || len(ids) == 0 {
+				return 0, err
+			}
+			return ids[0], nil
+		}
+
+		id := q.RoundID
+		if id == 0 {
+			at := time.Now()
+			if q.Time != nil {
+				var err error
+				at, err = time.ParseInLocation("2006-01-02 15:04:05", *q.Time, time.Local)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "time 格式错误，应为 YYYY-MM-DD HH:MM:SS"})
+					return
+				}
+			}
+			var err error
+			id, err = nearest("round_id <= ?", at.Unix(), "round_id desc")
+			if err != nil {
+				c.Error(err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if id == 0 {
+				c.JSON(http.StatusNotFound, gin.H{"error": "该时刻之前没有调度轮次"})
+				return
+			}
+		}
+
+		round := model.Round{RoundID: id, RoundTime: time.Unix(id, 0).Format("2006-01-02 15:04:05")}
+		var list []model.DBSnapshot
+		var configs []model.DBSnapshotConfig
+		var gaps []model.CoverageGap
+		err := db.Where("round_id = ?", id).Find(&list).Error
+		if err == nil {
+			err = db.Order("inst_id").Find(&configs).Error
+		}
+		if err == nil {
+			err = db.Where("expected_time = ?", round.RoundTime).Find(&gaps).Error
+		}
+		if err == nil {
+			round.Prev, err = nearest("round_id < ?", id, "round_id desc")
+		}
+		if err == nil {
+			round.Next, err = nearest("round_id > ?", id, "round_id")
+		}
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		sums := make(map[int]*model.DBSnapshot, len(list))
+		for i := range list {
+			sums[list[i].InstID] = &list[i]
+		}
+		missing := make(map[int]*model.CoverageGap, len(gaps))
+		for i := range gaps {
+			missing[gaps[i].InstID] = &gaps[i]
+		}
+		for _, v := range configs {
+			inst := &model.RoundInstance{InstID: int(v.InstID), DBType: v.DBType, Host: v.Host, Port: v.Port, Summary: sums[int(v.InstID)], Gap: missing[int(v.InstID)]}
+			if v.Agent != nil {
+				inst.Agent = *v.Agent
+			}
+			if inst.Summary != nil {
+				inst.File = inst.Summary.File()
+			}
+			round.Instances = append(round.Instances, inst)
+		}
+		c.JSON(http.StatusOK, round)
+	}
+}
+
+// MaxIngestSize 代理推送的单个快照请求体上限，快照文件按base64编码
+const MaxIngestSize = 64 << 20
+
+// 代理推送的快照文件路径，YYYYMM/实例ID/YYYYmmdd_HHMMSS.html
+var agentFile = regexp.MustCompile(`^\d{6}/(\d+)/\d{8}_\d{6}\.html$`)
+
+// AgentAuth 按中心为每个代理签发的令牌识别代理，请求头中的代理名称必须与令牌对应，未签发令牌的代理无法访问
+// 认证失败返回401，代理保留快照重试；403表示快照被拒绝，代理会丢弃
+func AgentAuth(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.GetHeader(agent.HeaderToken)
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "代理认证失败"})
+			return
+		}
+		var a model.Agent
+		err := db.Where("token_hash = ?", credential.AgentTokenHash(token)).Take(&a).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			c.Error(err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil || a.Name != c.GetHeader(agent.HeaderName) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "代理认证失败"})
+			return
+		}
+		c.Set("agent", a.Name)
+		c.Next()
+	}
+}
+
+// IssueAgentToken 为代理签发新令牌，旧令牌立即失效，令牌只在响应中返回这一次
+func IssueAgentToken(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		if !agentName.MatchString(name) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "采集代理名称只能包含字母、数字、_.-，最长64个字符"})
+			return
+		}
+		token, hash, err := credential.NewAgentToken()
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		err = db.Table(model.Agent{}.TableName()).
+			Clauses(clause.OnConflict{DoUpdates: clause.AssignmentColumns([]string{"token_hash"})}).
+			Create(map[string]any{"name": name, "token_hash": hash}).Error
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"Name": name, "Token": token})
+	}
+}
+
+// AgentHeartbeat 记录代理心跳，返回分配给代理的实例
+func AgentHeartbeat(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req model.AgentHeartbeat
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		a := model.Agent{Name: c.GetString("agent")}
+		err := db.Model(&a).Updates(map[string]any{
+			"addr":           c.ClientIP(),
+			"instances":      req.Instances,
+			"spooled":        req.Spooled,
+			"last_heartbeat": time.Now().Format("2006-01-02 15:04:05"),
+		}).Error
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		var rows []*model.Instance
+		if err := db.Table("db_snapshot_config").Where("agent = ?", a.Name).Find(&rows).Error; err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		//代理没有元数据库，下发实例账号或数据库类型默认账号，密码改用该代理令牌派生的密钥加密
+		if err := credential.LoadDefaults(db); err != nil {
+			c.Error(err)
+		}
+		for _, v := range rows {
+			if err := credential.WrapForAgent(v, c.GetHeader(agent.HeaderToken)); err != nil {
+				c.Error(fmt.Errorf("代理%s: %w，代理将使用统一监控账号", a.Name, err))
+			}
+		}
+		c.JSON(http.StatusOK, rows)
+	}
+}
+
+// AgentIngest 保存代理推送的快照文件和快照汇总，重复推送时忽略
+func AgentIngest(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.GetString("agent")
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MaxIngestSize)
+
+		var req model.AgentSnapshot
+		if err := c.ShouldBindJSON(&req); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "快照超过大小限制"})
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.Summary == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "缺少快照汇总"})
+			return
+		}
+		m := agentFile.FindStringSubmatch(req.File)
+		if m == nil || m[1] != strconv.Itoa(req.Summary.InstID) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "快照文件路径错误: " + req.File})
+			return
+		}
+
+		var cnt int64
+		err := db.Model(&model.DBSnapshotConfig{}).Where("inst_id = ? AND agent = ?", req.Summary.InstID, name).Count(&cnt).Error
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if cnt == 0 {
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("实例%d未分配给代理%s", req.Summary.InstID, name)})
+			return
+		}
+
+		if len(req.Content) > 0 {
+			err := storage.Put(c.Request.Context(), req.File+".br", req.Content)
+			if err != nil {
+				c.Error(err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "保存快照文件失败: " + err.Error()})
+				return
+			}
+		}
+
+		if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(req.Summary).Error; err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"saved": true})
+	}
+}
+
+// ListAgents 返回采集代理的心跳状态和分配的实例数
+func ListAgents(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var list []model.Agent
+		if err := db.Order("name").Find(&list).Error; err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		var counts []struct {
+			Agent string
+			Cnt   int
+		}
+		err := db.Model(&model.DBSnapshotConfig{}).Select("agent, count(*) cnt").
+			Where("agent <> ''").Group("agent").Scan(&counts).Error
+		if err != nil {
+			c.Error(err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		assigned := make(map[string]int, len(counts))
+		for _, v := range counts {
+			assigned[v.Agent] = v.Cnt
+		}
+
+		for i := range list {
+			a := &list[i]
+			a.Assigned = assigned[a.Name]
+			a.Issued = a.TokenHash != ""
+			delete(assigned, a.Name)
+			t, err := time.ParseInLocation("2006-01-02 15:04:05", a.LastHeartbeat, time.Local)
+			a.Online = err == nil && time.Since(t) < agent.OfflineAfter
+		}
+		//已分配实例但从未上报心跳的代理
+		for name, n := range assigned {
+			list = append(list, model.Agent{Name: name, Assigned: n})
+		}
+		c.JSON(http.StatusOK, list)
+	}
+}
+
+// GetClusterStatus 返回集群模式、本节点、主节点和存活的节点
+func GetClusterStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, cluster.Get())
+}
+
+// GetSpoolStats 返回快照汇总暂存文件的计数器
+func GetSpoolStats(c *gin.Context) {
+	c.JSON(http.StatusOK, spool.Get())
 }
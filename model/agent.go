@@ -0,0 +1,31 @@
+package model
+
+// Agent 采集代理，在隔离网络中采集分配给它的实例并推送快照
+type Agent struct {
+	Name          string `gorm:"column:name;primaryKey" json:"Name"`
+	Addr          string `gorm:"column:addr" json:"Addr"`                    //最后一次心跳的来源地址
+	Instances     int    `gorm:"column:instances" json:"Instances"`          //代理正在采集的实例数
+	Spooled       int    `gorm:"column:spooled" json:"Spooled"`              //代理本地待推送的快照数
+	LastHeartbeat string `gorm:"column:last_heartbeat" json:"LastHeartbeat"` //最后一次心跳时间
+	TokenHash     string `gorm:"column:token_hash" json:"-"`                 //中心签发的令牌的摘要，为空表示未签发
+	Issued        bool   `gorm:"-" json:"Issued"`                            //是否已签发令牌
+	Assigned      int    `gorm:"-" json:"Assigned"`                          //分配给代理的实例数
+	Online        bool   `gorm:"-" json:"Online"`
+}
+
+func (self Agent) TableName() string {
+	return "db_snapshot_agent"
+}
+
+// AgentHeartbeat 代理心跳，响应为分配给代理的实例
+type AgentHeartbeat struct {
+	Instances int
+	Spooled   int
+}
+
+// AgentSnapshot 代理推送的快照，File为相对data目录的快照文件路径，Content为brotli压缩后的文件内容
+type AgentSnapshot struct {
+	Summary *DBSnapshot
+	File    string
+	Content []byte
+}
@@ -1,9 +1,10 @@
 package model
 
-import "gorm.io/gorm"
+import "context"
 
+// Capturer 数据库快照采集器，每次采集新建，Init从connmgr获取实例的连接池
 type Capturer interface {
-	Init() error
-	Capture(*gorm.DB)
-	Close()
+	Init(ctx context.Context) error
+	Capture(ctx context.Context) *Snapshot
+	Close() //结束本次采集，连接池归connmgr所有，跨采集周期复用，实现中不能关闭
 }
@@ -0,0 +1,25 @@
+package model
+
+// CoverageGap 应采集但没有快照的时刻及原因
+type CoverageGap struct {
+	ID           int64  `gorm:"column:id;primaryKey"`
+	InstID       int    `gorm:"column:inst_id"`
+	ExpectedTime string `gorm:"column:expected_time"` //计划采集时刻，多次缺失时为第一次
+	Reason       string `gorm:"column:reason"`
+	Missed       int    `gorm:"column:missed"` //缺失的快照数
+	Msg          string `gorm:"column:msg"`
+}
+
+func (self CoverageGap) TableName() string {
+	return "db_snapshot_gap"
+}
+
+// Coverage 实例在时间范围内的快照覆盖率
+type Coverage struct {
+	InstID   int
+	Expected int            //应采集的快照数
+	Landed   int            //实际保存的快照数
+	Missed   int            //缺失的快照数
+	Percent  float64        //覆盖率(%)
+	Reasons  map[string]int //按原因统计的缺失数
+}
@@ -1,9 +1,12 @@
 package model
 
+import "time"
+
 type DBConfig struct {
-	Host     string `ini:"host"`
-	Port     int    `ini:"port"`
-	User     string `ini:"user"`
-	Password string `ini:"password"`
-	Database string `ini:"database"`
+	Host         string        `ini:"host"`
+	Port         int           `ini:"port"`
+	User         string        `ini:"user"`
+	Password     string        `ini:"password"` //支持密钥引用 env:NAME / file:/path / exec:command
+	Database     string        `ini:"database"`
+	QueryTimeout time.Duration `ini:"-"` //监控会话在数据库端的语句超时，0表示不设置
 }
@@ -0,0 +1,14 @@
+package model
+
+// Event 实例调度事件，例如跳过采集，用于解释监控大盘上的空缺
+type Event struct {
+	ID         int64  `gorm:"column:id;primaryKey"`
+	InstID     int    `gorm:"column:inst_id"`
+	CreateTime string `gorm:"column:create_time"`
+	Type       string `gorm:"column:type"`
+	Msg        string `gorm:"column:msg"`
+}
+
+func (self Event) TableName() string {
+	return "db_snapshot_event"
+}
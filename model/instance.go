@@ -1,9 +1,42 @@
 package model
 
+import "time"
+
 type Instance struct {
-	InstId int
-	DBType string
-	Host   string
-	Port   int
-	DBName string
+	InstId          int
+	DBType          string
+	Host            string
+	Port            int
+	DBName          string
+	MonitorUser     string //为空时使用数据库类型默认账号或全局账号
+	MonitorPassword string //密文
+	Enabled         bool   //暂停后保留配置但不采集
+	IntervalSeconds int    //采集间隔，0表示使用全局配置
+	WindowStart     string //采集时间窗口 HH:MM，为空表示全天
+	WindowEnd       string
+	Tier            int    //实例级别，1为核心实例，优先采集
+	Agent           string //采集代理名称，为空表示由中心采集
+	Threshold       string `gorm:"column:threshold_profile"` //分类规则名，为空表示使用数据库类型的默认规则
+	User            string `gorm:"-" json:"-"`               //解析后的监控账号，不下发、不落盘
+	Password        string `gorm:"-" json:"-"`               //解析后的监控密码明文，不下发、不落盘
+}
+
+// CaptureInterval 返回实例的采集间隔
+func (self *Instance) CaptureInterval(def time.Duration) time.Duration {
+	if self.IntervalSeconds > 0 {
+		return time.Second * time.Duration(self.IntervalSeconds)
+	}
+	return def
+}
+
+// InWindow 判断t是否在采集时间窗口内，支持跨零点，例如 22:00-06:00
+func (self *Instance) InWindow(t time.Time) bool {
+	if self.WindowStart == "" || self.WindowEnd == "" {
+		return true
+	}
+	cur := t.Format("15:04")
+	if self.WindowStart <= self.WindowEnd {
+		return cur >= self.WindowStart && cur < self.WindowEnd
+	}
+	return cur >= self.WindowStart || cur < self.WindowEnd
 }
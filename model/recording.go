@@ -0,0 +1,17 @@
+package model
+
+// Recording 黑匣子转储记录
+type Recording struct {
+	InstID     int    `gorm:"column:inst_id"`
+	CreateTime string `gorm:"column:create_time"`
+	Reason     string `gorm:"column:reason"`     //触发原因
+	StartTime  string `gorm:"column:start_time"` //第一个采样时间
+	EndTime    string `gorm:"column:end_time"`   //最后一个采样时间
+	Frames     int    `gorm:"column:frames"`     //采样次数
+	MaxActSess int    `gorm:"column:max_act_sess"`
+	FileName   string `gorm:"column:file_name"` //快照文件，相对data目录
+}
+
+func (self Recording) TableName() string {
+	return "db_snapshot_recording"
+}
@@ -0,0 +1,22 @@
+package model
+
+// Round 一个调度轮次中所有实例的快照
+type Round struct {
+	RoundID   int64
+	RoundTime string
+	Prev      int64 //上一个轮次，没有时为0
+	Next      int64 //下一个轮次，没有时为0
+	Instances []*RoundInstance
+}
+
+// RoundInstance 实例在调度轮次中的快照，本轮次没有采集该实例时Summary为空
+type RoundInstance struct {
+	InstID  int
+	DBType  string
+	Host    string
+	Port    int
+	Agent   string
+	Summary *DBSnapshot
+	File    string       //快照文件，相对 /db-snapshot/data/ 的路径
+	Gap     *CoverageGap //本轮次应采集但没有快照的原因
+}
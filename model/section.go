@@ -0,0 +1,77 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrSkipped 降级采集时跳过的采集块
+var ErrSkipped = errors.New("已跳过")
+
+// Snapshot 一次采集的结构化结果，与渲染和存储解耦
+type Snapshot struct {
+	Host     string
+	Port     int
+	DBName   string // 非空时在页头显示
+	Time     time.Time
+	Summary  *DBSnapshot
+	Metrics  []Metric
+	Sections []*Section
+}
+
+// Metric 页头的汇总指标，Ref 为跳转的 Section ID
+type Metric struct {
+	Title string
+	Ref   string
+	Value int
+}
+
+// Section 快照中的一个数据块
+type Section struct {
+	Title      string
+	ID         string // 锚点ID，可为空
+	Columns    []string
+	Rows       [][]string
+	Error      string
+	Timeout    bool  // 报错是否为超时
+	LinkCols   []int // 值渲染为页内链接的列
+	AnchorCols []int // 值作为行锚点的列
+}
+
+func NewSnapshot(instId int, host string, port int, t time.Time) *Snapshot {
+	return &Snapshot{
+		Host:    host,
+		Port:    port,
+		Time:    t,
+		Summary: &DBSnapshot{InstID: instId, CreateTime: t.Format("2006-01-02 15:04:05")},
+	}
+}
+
+func (self *Snapshot) AddMetric(title, ref string, value int) {
+	self.Metrics = append(self.Metrics, Metric{Title: title, Ref: ref, Value: value})
+}
+
+func (self *Snapshot) AddSection(sec *Section, err error) {
+	if errors.Is(err, ErrSkipped) {
+		//跳过不是错误，只在标题中说明
+		sec.Title += "（降级采集，已跳过）"
+		err = nil
+	}
+	if err != nil {
+		sec.Error = err.Error()
+		sec.Timeout = errors.Is(err, context.DeadlineExceeded)
+	}
+	self.Sections = append(self.Sections, sec)
+}
+
+// Errors 汇总所有数据块的报错信息
+func (self *Snapshot) Errors() string {
+	var msg string
+	for _, sec := range self.Sections {
+		if sec.Error != "" {
+			msg += sec.Error + "\n"
+		}
+	}
+	return msg
+}
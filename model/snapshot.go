@@ -1,5 +1,13 @@
 package model
 
+import (
+	"fmt"
+	"time"
+)
+
+// SaveFailed 快照文件保存失败时写在快照汇总Msg开头，覆盖率不计入这些快照
+const SaveFailed = "保存快照文件失败"
+
 type DBSnapshot struct {
 	InstID          int    `gorm:"column:inst_id"`
 	CreateTime      string `gorm:"column:create_time"`
@@ -12,21 +20,79 @@ type DBSnapshot struct {
 	MaxQuerySeconds int    `gorm:"column:max_query_seconds"`
 	MaxTxnSeconds   int    `gorm:"column:max_txn_seconds"`
 	DurationSeconds int    `gorm:"column:duration_seconds"`
+	Burst           bool   `gorm:"column:burst"`                   //高频采集期间的快照
+	Scheduled       bool   `gorm:"column:scheduled"`               //定时采集的快照，手动触发为false，覆盖率只统计定时快照
+	Profile         string `gorm:"column:capture_profile"`         //采集档位：full完整采集，degraded降级采集
+	Threshold       string `gorm:"column:threshold_profile"`       //分类规则名，default为数据库类型的默认规则
+	RoundID         int64  `gorm:"column:round_id"`                //调度轮次，名义时刻的unix时间戳，集群和代理中同一时刻的快照相同
+	RoundTime       string `gorm:"column:round_time;default:null"` //调度轮次的名义时刻，各实例的create_time可能晚几秒，旧版本的快照为空
 	Msg             string `gorm:"column:msg"`
 }
 
+// File 返回快照文件相对data目录的路径（不含.br），YYYYMM/实例ID/YYYYmmdd_HHMMSS.html
+func (self *DBSnapshot) File() string {
+	t, err := time.ParseInLocation("2006-01-02 15:04:05", self.CreateTime, time.Local)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s/%d/%s.html", t.Format("200601"), self.InstID, t.Format("20060102_150405"))
+}
+
+// SetRound 记录快照所属的调度轮次
+func (self *DBSnapshot) SetRound(t time.Time) {
+	self.RoundID = t.Unix()
+	self.RoundTime = t.Format("2006-01-02 15:04:05")
+}
+
 func (self DBSnapshot) TableName() string {
 	return "db_snapshot"
 }
 
 type DBSnapshotConfig struct {
-	InstID int64  `gorm:"column:inst_id" json:"InstID"` // 显式声明，前后端对齐
-	DBType string `gorm:"column:db_type" json:"DBType"`
-	Host   string `gorm:"column:host"    json:"Host"`
-	Port   int    `gorm:"column:port"    json:"Port"`
-	DBName string `gorm:"column:db_name" json:"DBName"`
+	InstID          int64  `gorm:"column:inst_id" json:"InstID"` // 显式声明，前后端对齐
+	DBType          string `gorm:"column:db_type" json:"DBType"`
+	Host            string `gorm:"column:host"    json:"Host"`
+	Port            int    `gorm:"column:port"    json:"Port"`
+	DBName          string `gorm:"column:db_name" json:"DBName"`
+	MonitorUser     string `gorm:"column:monitor_user" json:"MonitorUser"`
+	MonitorPassword string `gorm:"column:monitor_password" json:"MonitorPassword,omitempty"` // 只接收不返回，存储密文
+	HasPassword     bool   `gorm:"-" json:"HasPassword"`
+	ClearCredential bool   `gorm:"-" json:"ClearCredential,omitempty"` // 清除实例账号，改用默认账号
+	// 以下字段为指针，更新时 nil 表示不修改，便于设置为零值
+	Enabled         *bool           `gorm:"column:enabled;default:1" json:"Enabled"`
+	IntervalSeconds *int            `gorm:"column:interval_seconds;default:0" json:"IntervalSeconds"` // 0表示使用全局采集间隔
+	WindowStart     *string         `gorm:"column:window_start;default:''" json:"WindowStart"`        // 采集时间窗口 HH:MM，为空表示全天
+	WindowEnd       *string         `gorm:"column:window_end;default:''" json:"WindowEnd"`
+	Tier            *int            `gorm:"column:tier;default:2" json:"Tier"`                    // 1核心实例优先采集，2普通实例
+	Agent           *string         `gorm:"column:agent;default:''" json:"Agent"`                 // 采集代理名称，为空表示由中心采集
+	Threshold       *string         `gorm:"column:threshold_profile;default:''" json:"Threshold"` // 分类规则名，为空表示使用数据库类型的默认规则
+	Status          *InstanceStatus `gorm:"-" json:"Status,omitempty"`                            // 熔断状态，只在列表中返回
+	CreateTime      string          `gorm:"column:create_time;<-:false" json:"CreateTime"`        // 添加时间，由数据库生成，覆盖率从这里开始计算
 }
 
 func (DBSnapshotConfig) TableName() string {
 	return "db_snapshot_config"
 }
+
+// Redact 返回前清除密码
+func (self *DBSnapshotConfig) Redact() {
+	self.HasPassword = self.MonitorPassword != ""
+	self.MonitorPassword = ""
+}
+
+// DBSnapshotCredential 按数据库类型配置的默认监控账号
+type DBSnapshotCredential struct {
+	DBType          string `gorm:"column:db_type;primaryKey" json:"DBType"`
+	MonitorUser     string `gorm:"column:monitor_user" json:"MonitorUser"`
+	MonitorPassword string `gorm:"column:monitor_password" json:"MonitorPassword,omitempty"` // 只接收不返回，存储密文
+	HasPassword     bool   `gorm:"-" json:"HasPassword"`
+}
+
+func (DBSnapshotCredential) TableName() string {
+	return "db_snapshot_credential"
+}
+
+func (self *DBSnapshotCredential) Redact() {
+	self.HasPassword = self.MonitorPassword != ""
+	self.MonitorPassword = ""
+}
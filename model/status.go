@@ -0,0 +1,16 @@
+package model
+
+// InstanceStatus 实例连接熔断状态
+type InstanceStatus struct {
+	InstID     int     `gorm:"column:inst_id;primaryKey" json:"InstID"`
+	State      string  `gorm:"column:state" json:"State"`          //closed正常，open熔断，half-open探测中
+	Failures   int     `gorm:"column:failures" json:"Failures"`    //连续失败次数
+	LastError  string  `gorm:"column:last_error" json:"LastError"` //最后一次失败原因
+	Since      string  `gorm:"column:since" json:"Since"`          //进入当前状态的时间
+	NextProbe  *string `gorm:"column:next_probe" json:"NextProbe"` //熔断后下一次探测时间
+	UpdateTime string  `gorm:"column:update_time" json:"UpdateTime"`
+}
+
+func (self InstanceStatus) TableName() string {
+	return "db_snapshot_status"
+}
@@ -0,0 +1,83 @@
+package pipeline
+
+import (
+	"context"
+	"db-snapshot/html"
+	"db-snapshot/model"
+	"db-snapshot/spool"
+	"fmt"
+	"github.com/gookit/slog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"math"
+	"time"
+)
+
+// Save 渲染并保存快照文件，返回相对存储根目录的文件路径（不含.br），保存失败时返回错误
+func Save(snap *model.Snapshot) (string, error) {
+	sum := snap.Summary
+	sum.Msg = snap.Errors()
+	if sum.Msg != "" {
+		slog.Errorf("[%s:%d] 获取快照数据报错: %s", snap.Host, snap.Port, sum.Msg)
+	}
+
+	file := fmt.Sprintf("%s/%d/%s.html", snap.Time.Format("200601"), sum.InstID, snap.Time.Format("20060102_150405"))
+
+	page := html.Render(snap)
+	err := page.SaveToBrotli(file)
+	if err != nil {
+		slog.Errorf("[%s:%d] 保存快照文件报错: %v", snap.Host, snap.Port, err)
+	}
+
+	sum.DurationSeconds = int(math.Round(time.Since(snap.Time).Seconds()))
+	return file, err
+}
+
+// Process 渲染并保存快照文件，写入快照汇总数据，元数据库不可用时暂存到本地文件，暂存失败时返回错误
+// 快照文件保存失败时仍写入汇总数据，Msg以model.SaveFailed开头，并返回保存文件的错误
+func Process(ctx context.Context, db *gorm.DB, snap *model.Snapshot) error {
+	sum := snap.Summary
+	_, saveErr := Save(snap)
+	if saveErr != nil {
+		//保留统计值，标记快照文件不存在
+		sum.Msg = fmt.Sprintf("%s: %v\n", model.SaveFailed, saveErr) + sum.Msg
+	}
+	err := insert(ctx, db, snap)
+	if saveErr != nil {
+		return saveErr
+	}
+	return err
+}
+
+// insert 写入快照汇总数据，元数据库不可用时暂存到本地文件
+func insert(ctx context.Context, db *gorm.DB, snap *model.Snapshot) error {
+	sum := snap.Summary
+	//暂存文件中还有未重放的快照汇总时直接追加，保证按顺序写入元数据库
+	if spool.Depth() > 0 {
+		return stash(snap)
+	}
+
+	//保存快照汇总数据
+	saveCtx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	//集群重新分配实例时，新旧节点可能采集同一时刻的快照，重复时忽略
+	err := db.WithContext(saveCtx).Clauses(clause.OnConflict{DoNothing: true}).Create(sum).Error
+	if err != nil {
+		slog.Errorf("[%s:%d] 保存快照汇总数据失败: %v", snap.Host, snap.Port, err)
+		return stash(snap)
+	}
+
+	slog.Infof("[%s:%d] 保存快照汇总数据成功 %+v", snap.Host, snap.Port, *sum)
+	return nil
+}
+
+// stash 快照汇总写入暂存文件，元数据库恢复后重放
+func stash(snap *model.Snapshot) error {
+	err := spool.Append(snap.Summary)
+	if err != nil {
+		slog.Errorf("[%s:%d] 暂存快照汇总失败: %v", snap.Host, snap.Port, err)
+		return err
+	}
+	slog.Warnf("[%s:%d] 快照汇总已暂存，元数据库恢复后写入", snap.Host, snap.Port)
+	return nil
+}
@@ -0,0 +1,348 @@
+package recorder
+
+import (
+	"context"
+	"database/sql"
+	"db-snapshot/breaker"
+	"db-snapshot/capturer"
+	"db-snapshot/config"
+	"db-snapshot/connmgr"
+	"db-snapshot/html"
+	"db-snapshot/model"
+	"db-snapshot/util"
+	"fmt"
+	"github.com/gookit/slog"
+	"gorm.io/gorm"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 黑匣子：按秒级间隔采样活动会话，只在内存中保留最近一段时间，触发时才写入快照文件
+
+// MinDumpInterval 同一实例两次转储的最小间隔，避免重复触发覆盖同名文件
+const MinDumpInterval = 10 * time.Second
+
+// Frame 一次采样结果
+type Frame struct {
+	Time   time.Time
+	Rows   [][]string
+	Active int //活动会话数，降级采样时行数被截断，取预检查的活动会话数
+	Error  string
+}
+
+// Recorder 一个实例的黑匣子
+type Recorder struct {
+	inst     *model.Instance
+	driver   *capturer.Driver
+	db       *gorm.DB
+	key      string
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	frames   []Frame //环形缓冲区
+	pos      int
+	full     bool
+	lastDump time.Time
+	lastAuto time.Time
+}
+
+// Status 黑匣子运行状态
+type Status struct {
+	InstID   int
+	Host     string
+	Port     int
+	Frames   int
+	LastDump string
+}
+
+var (
+	mu        sync.Mutex
+	recorders = make(map[int]*Recorder)
+)
+
+// Sync 按实例列表启动或停止黑匣子，未启用黑匣子时全部停止
+func Sync(db *gorm.DB, instances []*model.Instance) {
+	cfg := config.Get().Recorder
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	seen := make(map[int]struct{}, len(instances))
+	if cfg.Interval > 0 {
+		for _, inst := range instances {
+			d, err := capturer.Lookup(inst.DBType)
+			if err != nil || d.Sampler == nil {
+				continue
+			}
+			seen[inst.InstId] = struct{}{}
+
+			//连接信息或黑匣子配置变化时重启黑匣子
+			key := fmt.Sprintf("%s|%s@%s:%d/%s|%s|%+v", inst.DBType, inst.User, inst.Host, inst.Port, inst.DBName, inst.Password, cfg)
+			r, ok := recorders[inst.InstId]
+			if ok && r.key == key {
+				continue
+			}
+			if ok {
+				r.stop()
+			}
+			recorders[inst.InstId] = start(db, inst, d, key, cfg)
+		}
+	}
+
+	for instId, r := range recorders {
+		if _, ok := seen[instId]; !ok {
+			r.stop()
+			delete(recorders, instId)
+		}
+	}
+}
+
+// StopAll 停止所有黑匣子，用于程序退出
+func StopAll() {
+	mu.Lock()
+	defer mu.Unlock()
+	for instId, r := range recorders {
+		r.stop()
+		delete(recorders, instId)
+	}
+}
+
+// Dump 立即转储实例的黑匣子
+func Dump(instId int, reason string) (*model.Recording, error) {
+	mu.Lock()
+	r, ok := recorders[instId]
+	mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("实例%d未开启黑匣子", instId)
+	}
+	return r.dump(reason)
+}
+
+// Find 按地址查找实例ID，供外部告警webhook使用
+func Find(host string, port int) (int, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	for instId, r := range recorders {
+		if r.inst.Host == host && r.inst.Port == port {
+			return instId, true
+		}
+	}
+	return 0, false
+}
+
+// Stats 返回所有黑匣子的运行状态
+func Stats() []Status {
+	mu.Lock()
+	defer mu.Unlock()
+
+	list := make([]Status, 0, len(recorders))
+	for _, r := range recorders {
+		r.mu.Lock()
+		st := Status{InstID: r.inst.InstId, Host: r.inst.Host, Port: r.inst.Port, Frames: r.size()}
+		if !r.lastDump.IsZero() {
+			st.LastDump = r.lastDump.Format("2006-01-02 15:04:05")
+		}
+		r.mu.Unlock()
+		list = append(list, st)
+	}
+	return list
+}
+
+func start(db *gorm.DB, inst *model.Instance, d *capturer.Driver, key string, cfg config.RecorderConfig) *Recorder {
+	interval := time.Second * time.Duration(cfg.Interval)
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Recorder{
+		inst:   inst,
+		driver: d,
+		db:     db,
+		key:    key,
+		cancel: cancel,
+		frames: make([]Frame, cfg.Window/cfg.Interval+1),
+	}
+	slog.Infof("[%s:%d] 启动黑匣子，采样间隔%ds，保留%ds", inst.Host, inst.Port, cfg.Interval, cfg.Window)
+	go r.run(ctx, interval, cfg)
+	return r
+}
+
+func (self *Recorder) stop() {
+	slog.Infof("[%s:%d] 停止黑匣子", self.inst.Host, self.inst.Port)
+	self.cancel()
+}
+
+func (self *Recorder) run(ctx context.Context, interval time.Duration, cfg config.RecorderConfig) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Errorf("[%s:%d] 黑匣子异常退出: %v", self.inst.Host, self.inst.Port, r)
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var db *sql.DB
+	var lastErr string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			f := Frame{Time: now}
+			rows, active, err := self.sample(ctx, &db, interval)
+			if err != nil {
+				f.Error = err.Error()
+				if f.Error != lastErr {
+					slog.Errorf("[%s:%d] 黑匣子采样失败: %v", self.inst.Host, self.inst.Port, err)
+				}
+			}
+			lastErr = f.Error
+			f.Rows = rows
+			f.Active = active
+			self.push(f)
+
+			if cfg.ActSessCount > 0 && active >= cfg.ActSessCount && self.allowAuto(now, cfg.Cooldown) {
+				go func() {
+					_, err := self.dump(fmt.Sprintf("活动会话数%d超过阈值%d", active, cfg.ActSessCount))
+					if err != nil {
+						slog.Errorf("[%s:%d] 黑匣子转储失败: %v", self.inst.Host, self.inst.Port, err)
+					}
+				}()
+			}
+		}
+	}
+}
+
+// sample 执行一次活动会话查询，返回采样结果和活动会话数，连接池失效后下次采样重新获取
+// 实例熔断期间不连接实例；负载过高时与定时快照一样降级，使用限制行数的查询
+func (self *Recorder) sample(ctx context.Context, db **sql.DB, timeout time.Duration) ([][]string, int, error) {
+	if !breaker.IsClosed(self.inst.InstId) {
+		*db = nil
+		return nil, 0, fmt.Errorf("实例已熔断，暂停采样")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if *db == nil {
+		//与定时快照共用连接池，会话参数需一致，否则会互相重建连接池
+		cfg := &model.DBConfig{Host: self.inst.Host, Port: self.inst.Port, User: self.inst.User, Password: self.inst.Password, Database: self.driver.DBName(self.inst.DBName), QueryTimeout: config.Get().QueryTimeout(self.driver.Name)}
+		conn, err := connmgr.Get(ctx, self.inst.InstId, self.driver.Name, cfg, self.driver.Open)
+		if err != nil {
+			return nil, 0, err
+		}
+		*db = conn
+	}
+
+	sampler := self.driver.Sampler
+	query, load := sampler.SQL, -1
+	if sampler.LoadSQL != "" {
+		p := capturer.CheckLoad(ctx, *db, self.driver.Name, sampler.LoadSQL)
+		load = p.Load
+		if p.Degraded() {
+			if sampler.LiteSQL == "" {
+				return nil, load, fmt.Errorf("活动会话数%d达到降级阈值，暂停采样", load)
+			}
+			query = p.Query(sampler.SQL, sampler.LiteSQL)
+		}
+	}
+	rows, err := util.QueryReturnList(ctx, *db, query)
+	if err != nil {
+		*db = nil
+		return nil, max(load, 0), err
+	}
+	return rows, max(len(rows), load), nil
+}
+
+func (self *Recorder) push(f Frame) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.frames[self.pos] = f
+	self.pos = (self.pos + 1) % len(self.frames)
+	if self.pos == 0 {
+		self.full = true
+	}
+}
+
+func (self *Recorder) size() int {
+	if self.full {
+		return len(self.frames)
+	}
+	return self.pos
+}
+
+// snapshot 按时间顺序返回缓冲区中的采样
+func (self *Recorder) snapshot() []Frame {
+	if !self.full {
+		return append([]Frame(nil), self.frames[:self.pos]...)
+	}
+	list := append([]Frame(nil), self.frames[self.pos:]...)
+	return append(list, self.frames[:self.pos]...)
+}
+
+func (self *Recorder) allowAuto(now time.Time, cooldown int) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if now.Sub(self.lastAuto) < time.Second*time.Duration(cooldown) {
+		return false
+	}
+	self.lastAuto = now
+	return true
+}
+
+// dump 将缓冲区中的采样写入快照文件，并记录到db_snapshot_recording
+func (self *Recorder) dump(reason string) (*model.Recording, error) {
+	now := time.Now()
+	self.mu.Lock()
+	if now.Sub(self.lastDump) < MinDumpInterval {
+		self.mu.Unlock()
+		return nil, fmt.Errorf("%ds内已转储过，请稍后重试", int(MinDumpInterval.Seconds()))
+	}
+	self.lastDump = now
+	frames := self.snapshot()
+	self.mu.Unlock()
+
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("黑匣子暂无采样数据")
+	}
+
+	snap := model.NewSnapshot(self.inst.InstId, self.inst.Host, self.inst.Port, now)
+	rec := &model.Recording{
+		InstID:     self.inst.InstId,
+		CreateTime: snap.Summary.CreateTime,
+		Reason:     reason,
+		StartTime:  frames[0].Time.Format("2006-01-02 15:04:05"),
+		EndTime:    frames[len(frames)-1].Time.Format("2006-01-02 15:04:05"),
+		Frames:     len(frames),
+	}
+	//最新的采样在前，便于查看故障发生前最后时刻
+	for i := len(frames) - 1; i >= 0; i-- {
+		f := frames[i]
+		if f.Active > rec.MaxActSess {
+			rec.MaxActSess = f.Active
+		}
+		sec := &model.Section{Title: fmt.Sprintf("%s 活动会话(%d)", f.Time.Format("15:04:05"), f.Active), Columns: self.driver.Sampler.Columns, Rows: f.Rows}
+		if f.Error != "" {
+			sec.Title = fmt.Sprintf("%s 采样失败: %s", f.Time.Format("15:04:05"), f.Error)
+		}
+		snap.AddSection(sec, nil)
+	}
+	snap.Summary.ActSessCount = rec.MaxActSess
+	snap.AddMetric("采样次数", "", rec.Frames)
+	snap.AddMetric("最大活动会话数", "", rec.MaxActSess)
+	snap.AddMetric("时间范围(s)", "", int(frames[len(frames)-1].Time.Sub(frames[0].Time).Seconds()))
+
+	fileName := fmt.Sprintf("%s_recorder.html", now.Format("20060102_150405"))
+	rec.FileName = now.Format("200601") + "/" + strconv.Itoa(self.inst.InstId) + "/" + fileName
+	err := html.Render(snap).SaveToBrotli(rec.FileName)
+	if err != nil {
+		return nil, fmt.Errorf("保存黑匣子文件报错: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	err = self.db.WithContext(ctx).Create(rec).Error
+	if err != nil {
+		slog.Errorf("[%s:%d] 保存黑匣子记录失败: %v", self.inst.Host, self.inst.Port, err)
+	}
+	slog.Infof("[%s:%d] 黑匣子转储完成(%s)，%d次采样 %s", self.inst.Host, self.inst.Port, reason, rec.Frames, rec.FileName)
+	return rec, nil
+}
@@ -0,0 +1,356 @@
+package scheduler
+
+import (
+	"context"
+	"db-snapshot/config"
+	"db-snapshot/coverage"
+	"db-snapshot/event"
+	"db-snapshot/model"
+	"db-snapshot/threading"
+	"fmt"
+	"github.com/gookit/slog"
+	"sync"
+	"time"
+)
+
+// Run 一次采集任务的调度信息
+type Run struct {
+	Timeout  time.Duration //本次采集的截止时间
+	Burst    bool          //是否处于高频采集
+	Expected time.Time     //计划采集时刻，手动触发时为零值
+	Round    time.Time     //调度轮次的名义时刻：定时采集为对齐的采集时刻，手动快照为投递时刻
+}
+
+// Task 采集一个实例，返回快照汇总，采集失败时返回错误
+type Task func(ctx context.Context, i *model.Instance, run Run) (*model.DBSnapshot, error)
+
+// MaxDownRange 启动时最多统计的停机时长，超过的部分不计入缺失
+const MaxDownRange = 7 * 24 * time.Hour
+
+type state struct {
+	next       time.Time
+	interval   time.Duration
+	burst      bool
+	burstUntil time.Time //高频采集的截止时间，指标超过阈值时顺延
+}
+
+// Scheduler 按实例的采集间隔和时间窗口投递采集任务
+type Scheduler struct {
+	Interval  time.Duration       //默认采集间隔
+	Burst     *config.BurstConfig //高频采集配置，nil表示不启用
+	DownSince time.Time           //上次程序停止的时间，首次调度时记录停机期间缺失的快照
+	pool      *threading.Pool
+	instances func() []*model.Instance
+	task      Task
+	mu        sync.Mutex
+	states    map[int]*state
+	inflight  map[int]*running //执行中的实例，同一实例不并发采集
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+type running struct {
+	inst    *model.Instance
+	start   time.Time
+	run     Run
+	started bool //已从队列取出开始执行
+}
+
+func New(interval time.Duration, pool *threading.Pool, instances func() []*model.Instance, task Task) *Scheduler {
+	return &Scheduler{
+		Interval:  interval,
+		pool:      pool,
+		instances: instances,
+		task:      task,
+		states:    make(map[int]*state),
+		inflight:  make(map[int]*running),
+		stop:      make(chan struct{}),
+	}
+}
+
+// Run 每秒检查一次到期的实例，采集时刻对齐到采集间隔的整数倍
+func (self *Scheduler) Run() {
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-self.stop:
+			slog.Infof("调度器已停止")
+			return
+		case now := <-ticker.C:
+			self.tick(now)
+		}
+	}
+}
+
+// Stop 停止投递新的采集任务，不等待执行中的任务
+func (self *Scheduler) Stop() {
+	self.stopOnce.Do(func() { close(self.stop) })
+}
+
+// Reconfigure 重载配置后更新默认采集间隔和高频采集配置，下一次调度时生效
+func (self *Scheduler) Reconfigure(interval time.Duration, burst *config.BurstConfig) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.Interval = interval
+	self.Burst = burst
+}
+
+// Inflight 返回已投递但未完成的实例，用于退出时报告被中断的采集
+func (self *Scheduler) Inflight() []string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	list := make([]string, 0, len(self.inflight))
+	for _, r := range self.inflight {
+		list = append(list, fmt.Sprintf("%d(%s:%d 开始于%s)", r.inst.InstId, r.inst.Host, r.inst.Port, r.start.Format("15:04:05")))
+	}
+	return list
+}
+
+// Abandon 记录退出时未执行或未结束的定时快照
+func (self *Scheduler) Abandon() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for _, r := range self.inflight {
+		if !r.run.Expected.IsZero() {
+			coverage.Record(r.inst.InstId, r.run.Expected, coverage.Down, 1, "程序退出，快照未完成")
+		}
+	}
+}
+
+type dueTask struct {
+	inst *model.Instance
+	run  Run
+}
+
+func (self *Scheduler) tick(now time.Time) {
+	list := self.instances()
+	if list == nil {
+		return
+	}
+
+	if !self.DownSince.IsZero() {
+		self.mu.Lock()
+		interval := self.Interval
+		self.mu.Unlock()
+		self.recordDown(now, list, interval)
+		self.DownSince = time.Time{}
+	}
+
+	due := self.collect(now, list)
+	if len(due) == 0 {
+		return
+	}
+	slog.Infof("开始执行%d个实例的快照任务", len(due))
+	for _, d := range due {
+		priority := threading.PriorityNormal
+		if d.inst.Tier == 1 {
+			priority = threading.PriorityHigh
+		}
+		self.submit(d, priority)
+	}
+}
+
+// CaptureNow 立即采集一次实例快照，优先执行，不影响定时采集
+func (self *Scheduler) CaptureNow(instId int) error {
+	var inst *model.Instance
+	for _, v := range self.instances() {
+		if v.InstId == instId {
+			inst = v
+			break
+		}
+	}
+	if inst == nil {
+		return fmt.Errorf("实例%d不存在，请先重载配置", instId)
+	}
+
+	now := time.Now()
+	self.mu.Lock()
+	if r, ok := self.inflight[instId]; ok {
+		self.mu.Unlock()
+		return fmt.Errorf("实例%d的快照正在执行(开始于%s)", instId, r.start.Format("15:04:05"))
+	}
+	run := Run{Timeout: inst.CaptureInterval(self.Interval), Round: now.Truncate(time.Second)}
+	if st, ok := self.states[instId]; ok {
+		run.Burst = st.burst
+	}
+	self.inflight[instId] = &running{inst: inst, start: now, run: run}
+	self.mu.Unlock()
+
+	slog.Infof("[%s:%d] 手动触发快照", inst.Host, inst.Port)
+	self.submit(dueTask{inst: inst, run: run}, threading.PriorityHigh)
+	return nil
+}
+
+// submit 投递采集任务，采集失败时计入线程池的失败数
+func (self *Scheduler) submit(d dueTask, priority threading.Priority) {
+	ok := self.pool.Submit(threading.Task{
+		Name:     fmt.Sprintf("%d(%s:%d)", d.inst.InstId, d.inst.Host, d.inst.Port),
+		Priority: priority,
+		Timeout:  d.run.Timeout,
+		Run: func(ctx context.Context) error {
+			defer self.done(d.inst.InstId)
+			self.begin(d.inst.InstId)
+			sum, err := self.task(ctx, d.inst, d.run)
+			self.observe(d.inst, sum)
+			if err != nil && !d.run.Expected.IsZero() {
+				coverage.Record(d.inst.InstId, d.run.Expected, coverage.Reason(ctx, err), 1, err.Error())
+			}
+			return err
+		},
+	})
+	if !ok {
+		self.done(d.inst.InstId)
+		if !d.run.Expected.IsZero() {
+			coverage.Record(d.inst.InstId, d.run.Expected, coverage.Backlog, 1, "线程池已关闭，采集任务未投递")
+		}
+	}
+}
+
+// collect 返回到期的实例，并计算下一次采集时刻
+func (self *Scheduler) collect(now time.Time, list []*model.Instance) []dueTask {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	seen := make(map[int]struct{}, len(list))
+	var due []dueTask
+	for _, inst := range list {
+		seen[inst.InstId] = struct{}{}
+		if !inst.Enabled || !inst.InWindow(now) {
+			delete(self.states, inst.InstId)
+			continue
+		}
+
+		st, ok := self.states[inst.InstId]
+		if !ok {
+			st = &state{}
+			self.states[inst.InstId] = st
+		}
+		interval := inst.CaptureInterval(self.Interval)
+		burst := self.burstInterval(st, now)
+		if burst > 0 && burst < interval {
+			interval = burst
+			st.burst = true
+		} else if st.burst {
+			st.burst = false
+			slog.Infof("[%s:%d] 指标恢复正常，退出高频采集", inst.Host, inst.Port)
+		}
+
+		if st.interval != interval {
+			//新实例或采集间隔变化，从下一个对齐时刻开始
+			st.interval = interval
+			st.next = now.Truncate(interval).Add(interval)
+			continue
+		}
+		if now.Before(st.next) {
+			continue
+		}
+		expected := st.next
+		if missed := int(now.Sub(expected) / interval); missed > 0 {
+			//调度延迟超过一个采集间隔，例如进程暂停或系统时间跳变
+			coverage.Record(inst.InstId, expected, coverage.Down, missed, fmt.Sprintf("调度延迟，错过%d次采集", missed))
+			expected = now.Truncate(interval)
+		}
+		st.next = now.Truncate(interval).Add(interval)
+		if r, ok := self.inflight[inst.InstId]; ok {
+			//上一次采集未完成，跳过本次，避免对已经繁忙的实例并发采集
+			msg := fmt.Sprintf("上一次快照仍在执行(开始于%s)，跳过本次采集", r.start.Format("15:04:05"))
+			reason := coverage.Timeout
+			if !r.started {
+				msg = fmt.Sprintf("上一次快照仍在排队(投递于%s)，跳过本次采集", r.start.Format("15:04:05"))
+				reason = coverage.Backlog
+			}
+			slog.Warnf("[%s:%d] %s", inst.Host, inst.Port, msg)
+			event.Record(inst.InstId, event.Skipped, now, msg)
+			coverage.Record(inst.InstId, expected, reason, 1, msg)
+			continue
+		}
+		run := Run{Timeout: interval, Burst: st.burst, Expected: expected, Round: expected}
+		self.inflight[inst.InstId] = &running{inst: inst, start: now, run: run}
+		due = append(due, dueTask{inst: inst, run: run})
+	}
+
+	//清理已删除的实例
+	for instId := range self.states {
+		if _, ok := seen[instId]; !ok {
+			delete(self.states, instId)
+		}
+	}
+	return due
+}
+
+// begin 任务从队列取出开始执行
+func (self *Scheduler) begin(instId int) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if r, ok := self.inflight[instId]; ok {
+		r.started = true
+	}
+}
+
+// recordDown 记录程序停止期间各实例缺失的快照，只统计启用且在时间窗口内的采集时刻
+// defaultInterval 由调用方加锁读取，Reconfigure 可能同时修改 self.Interval
+func (self *Scheduler) recordDown(now time.Time, list []*model.Instance, defaultInterval time.Duration) {
+	since := self.DownSince
+	if now.Sub(since) > MaxDownRange {
+		since = now.Add(-MaxDownRange)
+	}
+	for _, inst := range list {
+		if !inst.Enabled {
+			continue
+		}
+		interval := inst.CaptureInterval(defaultInterval)
+		var first time.Time
+		missed := 0
+		for t := since.Truncate(interval).Add(interval); !t.After(now); t = t.Add(interval) {
+			if !inst.InWindow(t) {
+				continue
+			}
+			if missed == 0 {
+				first = t
+			}
+			missed++
+		}
+		if missed > 0 {
+			msg := fmt.Sprintf("采集程序未运行(%s至%s)，错过%d次采集", self.DownSince.Format("2006-01-02 15:04:05"), now.Format("2006-01-02 15:04:05"), missed)
+			coverage.Record(inst.InstId, first, coverage.Down, missed, msg)
+		}
+	}
+}
+
+// done 采集结束，允许下一次采集
+func (self *Scheduler) done(instId int) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.inflight, instId)
+}
+
+// burstInterval 返回高频采集间隔，不在高频采集期间返回0
+func (self *Scheduler) burstInterval(st *state, now time.Time) time.Duration {
+	if self.Burst == nil || !self.Burst.Enabled() || !now.Before(st.burstUntil) {
+		return 0
+	}
+	return time.Second * time.Duration(self.Burst.Interval)
+}
+
+// observe 根据采集结果判断是否进入高频采集，高频采集期间指标仍超过阈值时顺延冷却时间
+func (self *Scheduler) observe(inst *model.Instance, sum *model.DBSnapshot) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.Burst == nil || !self.Burst.Enabled() || !self.Burst.Triggered(sum) {
+		return
+	}
+
+	st, ok := self.states[inst.InstId]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	if !now.Before(st.burstUntil) {
+		slog.Warnf("[%s:%d] 指标超过阈值(锁数=%d 等待会话数=%d 最长事务耗时=%ds)，进入高频采集", inst.Host, inst.Port, sum.LockCount, sum.WaitSessCount, sum.MaxTxnSeconds)
+	}
+	st.burstUntil = now.Add(time.Second * time.Duration(self.Burst.Cooldown))
+}
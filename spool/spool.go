@@ -0,0 +1,294 @@
+package spool
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"db-snapshot/config"
+	"db-snapshot/model"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gookit/slog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ReplayInterval 检查元数据库是否恢复的间隔
+const ReplayInterval = 5 * time.Second
+
+// fileName 暂存文件，每行一个快照汇总，全部重放后清空
+const fileName = "summary.jsonl"
+
+// Stats 暂存文件的计数器
+type Stats struct {
+	Depth     int    //待重放的快照汇总数
+	Bytes     int64  //暂存文件大小，包括已重放、还没有清理的部分
+	MaxBytes  int64  //暂存文件上限
+	Spooled   int64  //累计暂存数
+	Replayed  int64  //累计重放数
+	Dropped   int64  //超过上限或无法写入而丢弃的数量
+	LastError string //最后一次写入元数据库的错误
+}
+
+var (
+	mu     sync.Mutex
+	file   *os.File
+	path   string
+	offset int64 //已重放到的位置
+	stats  Stats
+)
+
+// Start 打开暂存文件并启动重放，重启后从头重放未清空的暂存文件，重复的快照汇总被忽略
+func Start(db *gorm.DB) error {
+	cfg := config.Get().Spool
+	err := os.MkdirAll(cfg.Dir, 0775)
+	if err != nil {
+		return fmt.Errorf("创建暂存目录失败: %w", err)
+	}
+	name := filepath.Join(cfg.Dir, fileName)
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("打开暂存文件失败: %w", err)
+	}
+	depth, size, err := count(f)
+	if err == nil {
+		//上次退出时写到一半的行
+		err = f.Truncate(size)
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("读取暂存文件失败: %w", err)
+	}
+
+	mu.Lock()
+	file, path = f, name
+	stats.Depth = depth
+	stats.Bytes = size
+	stats.MaxBytes = int64(cfg.MaxSize) << 20
+	mu.Unlock()
+	if depth > 0 {
+		slog.Warnf("暂存文件中有%d个快照汇总未写入元数据库，开始重放", depth)
+	}
+
+	go func() {
+		ticker := time.NewTicker(ReplayInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			replay(db)
+		}
+	}()
+	return nil
+}
+
+// Append 追加一个快照汇总到暂存文件，待重放的部分超过上限时丢弃
+func Append(sum *model.DBSnapshot) error {
+	data, err := json.Marshal(sum)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	mu.Lock()
+	defer mu.Unlock()
+	if file == nil {
+		return errors.New("暂存文件未打开")
+	}
+	if stats.Bytes-offset+int64(len(data)) > stats.MaxBytes {
+		stats.Dropped++
+		return fmt.Errorf("暂存文件超过%dMB，丢弃快照汇总", stats.MaxBytes>>20)
+	}
+	if _, err := file.Write(data); err != nil {
+		stats.Dropped++
+		return fmt.Errorf("写入暂存文件失败: %w", err)
+	}
+	stats.Depth++
+	stats.Bytes += int64(len(data))
+	stats.Spooled++
+	return nil
+}
+
+// Depth 返回待重放的快照汇总数，不为0时新的快照汇总也写入暂存文件，保证按顺序写入元数据库
+func Depth() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return stats.Depth
+}
+
+// Get 返回暂存文件的计数器
+func Get() Stats {
+	mu.Lock()
+	defer mu.Unlock()
+	return stats
+}
+
+// Close 关闭暂存文件，未重放的快照汇总下次启动后重放
+func Close() {
+	mu.Lock()
+	defer mu.Unlock()
+	if file != nil {
+		file.Close()
+		file = nil
+	}
+	if stats.Depth > 0 {
+		slog.Warnf("%d个快照汇总保存在暂存文件中，下次启动后写入元数据库", stats.Depth)
+	}
+}
+
+// replay 按顺序把暂存的快照汇总写入元数据库，元数据库仍不可用时停止，全部写入后清空暂存文件
+func replay(db *gorm.DB) {
+	mu.Lock()
+	if file == nil || stats.Depth == 0 {
+		mu.Unlock()
+		return
+	}
+	start, name := offset, path
+	mu.Unlock()
+
+	f, err := os.Open(name)
+	if err != nil {
+		slog.Errorf("读取暂存文件失败: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		slog.Errorf("读取暂存文件失败: %v", err)
+		return
+	}
+
+	n := 0
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			//写到一半的行留到下一次
+			break
+		}
+
+		var sum model.DBSnapshot
+		if err := json.Unmarshal(bytes.TrimSpace(line), &sum); err != nil {
+			slog.Errorf("暂存文件格式错误，丢弃: %v %s", err, line)
+			advance(len(line), false)
+			continue
+		}
+		if err := save(db, &sum); err != nil {
+			if !available(db) {
+				mu.Lock()
+				stats.LastError = err.Error()
+				mu.Unlock()
+				break
+			}
+			//元数据库可用但这一行写入失败，重试也不会成功
+			slog.Errorf("重放快照汇总失败，丢弃: %v %+v", err, sum)
+			advance(len(line), false)
+			continue
+		}
+		advance(len(line), true)
+		n++
+	}
+	if n > 0 {
+		slog.Infof("重放%d个快照汇总，剩余%d个", n, Depth())
+	}
+	compact()
+}
+
+// compact 已重放的部分超过暂存文件的一半时，把未重放的部分复制到新文件，避免元数据库长时间部分恢复时文件一直增长
+func compact() {
+	mu.Lock()
+	defer mu.Unlock()
+	if file == nil || offset == 0 || offset < stats.Bytes/2 {
+		return
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		slog.Errorf("整理暂存文件失败: %v", err)
+		return
+	}
+	defer src.Close()
+	tmp, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		slog.Errorf("整理暂存文件失败: %v", err)
+		return
+	}
+	size, err := io.Copy(tmp, io.NewSectionReader(src, offset, stats.Bytes-offset))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(path + ".tmp")
+		slog.Errorf("整理暂存文件失败: %v", err)
+		return
+	}
+	//改名后tmp就是暂存文件
+	file.Close()
+	file = tmp
+	offset = 0
+	stats.Bytes = size
+}
+
+// advance 已处理一行，全部处理完后清空暂存文件
+func advance(size int, ok bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	offset += int64(size)
+	stats.Depth--
+	if ok {
+		stats.Replayed++
+	} else {
+		stats.Dropped++
+	}
+	if stats.Depth == 0 && file != nil {
+		if err := file.Truncate(0); err != nil {
+			slog.Errorf("清空暂存文件失败: %v", err)
+			return
+		}
+		offset = 0
+		stats.Bytes = 0
+		stats.LastError = ""
+	}
+}
+
+func save(db *gorm.DB, sum *model.DBSnapshot) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	return db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(sum).Error
+}
+
+// available 判断元数据库是否可用
+func available(db *gorm.DB) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	return db.WithContext(ctx).Exec("SELECT 1").Error == nil
+}
+
+// count 返回暂存文件中完整的行数和这些行的大小
+func count(f *os.File) (int, int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	n := 0
+	var size int64
+	r := bufio.NewReader(io.NewSectionReader(f, 0, info.Size()))
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		n++
+		size += int64(len(line))
+	}
+	return n, size, nil
+}
@@ -0,0 +1,277 @@
+package spool
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"db-snapshot/config"
+	"db-snapshot/model"
+	"errors"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDB 模拟元数据库：down时所有语句失败，reject中的实例写入失败，写入limit行后不可用
+type fakeDB struct {
+	mu       sync.Mutex
+	down     bool
+	reject   int64
+	limit    int
+	inserted []int64
+}
+
+func (self *fakeDB) Open(string) (driver.Conn, error) { return &fakeConn{db: self}, nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (self *fakeConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (self *fakeConn) Close() error                        { return nil }
+func (self *fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (self *fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	db := self.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.down || (db.limit > 0 && len(db.inserted) >= db.limit) {
+		return nil, errors.New("dial tcp: connection refused")
+	}
+	if strings.HasPrefix(query, "INSERT") {
+		id := args[0].Value.(int64)
+		if id == db.reject {
+			return nil, errors.New("Error 1406: Data too long for column 'msg'")
+		}
+		db.inserted = append(db.inserted, id)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func openFake(t *testing.T) (*fakeDB, *gorm.DB) {
+	fake := &fakeDB{}
+	db, err := gorm.Open(mysql.New(mysql.Config{
+		Conn:                      sql.OpenDB(fakeConnector{fake}),
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{SkipDefaultTransaction: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, db
+}
+
+type fakeConnector struct{ db *fakeDB }
+
+func (self fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	return &fakeConn{db: self.db}, nil
+}
+func (self fakeConnector) Driver() driver.Driver { return self.db }
+
+// setup 在临时目录中打开暂存文件，content为上次退出时留下的内容
+func setup(t *testing.T, content string) string {
+	dir := t.TempDir()
+	err := config.Init(config.Source{Flags: map[string]string{
+		"db.host": "127.0.0.1", "db.port": "3306", "db.database": "dbsnapshot",
+		"spool.dir": dir, "spool.max_size": "1",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, fileName)
+	if content != "" {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, db := openFake(t)
+	if err := Start(db); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		Close()
+		mu.Lock()
+		offset, stats = 0, Stats{}
+		mu.Unlock()
+	})
+	return path
+}
+
+func size(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestStartTruncate(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		depth   int
+		size    int64
+	}{
+		{"空文件", "", 0, 0},
+		{"完整的行", "{\"InstID\":1}\n{\"InstID\":2}\n", 2, 26},
+		{"写到一半的行被截掉", "{\"InstID\":1}\n{\"InstID\":2}\n{\"Inst", 2, 26},
+		{"只有写到一半的行", "{\"InstID\":1", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := setup(t, tt.content)
+			if got := Get(); got.Depth != tt.depth || got.Bytes != tt.size || got.MaxBytes != 1<<20 {
+				t.Errorf("Stats = %+v, want Depth %d Bytes %d", got, tt.depth, tt.size)
+			}
+			if got := size(t, path); got != tt.size {
+				t.Errorf("file size = %d, want %d", got, tt.size)
+			}
+		})
+	}
+}
+
+func TestAppendLimit(t *testing.T) {
+	setup(t, "")
+	sum := &model.DBSnapshot{InstID: 1, CreateTime: "2025-01-01 12:00:00"}
+	if err := Append(sum); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	stats.MaxBytes = stats.Bytes + 1
+	mu.Unlock()
+	if err := Append(sum); err == nil {
+		t.Errorf("Append over max_size succeeded")
+	}
+	if got := Get(); got.Depth != 1 || got.Spooled != 1 || got.Dropped != 1 {
+		t.Errorf("Stats = %+v, want Depth 1 Spooled 1 Dropped 1", got)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	//第3行格式错误，重放时丢弃
+	path := setup(t, "{\"InstID\":1}\n{\"InstID\":2}\nnot json\n")
+	fake, db := openFake(t)
+	for _, id := range []int{3, 4} {
+		if err := Append(&model.DBSnapshot{InstID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	steps := []struct {
+		name     string
+		down     bool
+		reject   int64
+		depth    int
+		replayed int64
+		dropped  int64
+		inserted []int64
+		lastErr  bool
+	}{
+		{"元数据库不可用时停止", true, 0, 5, 0, 0, nil, true},
+		{"恢复后按顺序重放", false, 3, 0, 3, 2, []int64{1, 2, 4}, false},
+	}
+	for _, step := range steps {
+		fake.mu.Lock()
+		fake.down, fake.reject = step.down, step.reject
+		fake.mu.Unlock()
+		replay(db)
+
+		got := Get()
+		if got.Depth != step.depth || got.Replayed != step.replayed || got.Dropped != step.dropped || (got.LastError != "") != step.lastErr {
+			t.Errorf("%s: Stats = %+v", step.name, got)
+		}
+		if !slices.Equal(fake.inserted, step.inserted) {
+			t.Errorf("%s: inserted = %v, want %v", step.name, fake.inserted, step.inserted)
+		}
+	}
+
+	//全部重放后清空暂存文件，之后追加的从头重放
+	if got := size(t, path); got != 0 || offset != 0 {
+		t.Errorf("file size = %d, offset = %d after replay, want 0", got, offset)
+	}
+	if err := Append(&model.DBSnapshot{InstID: 5}); err != nil {
+		t.Fatal(err)
+	}
+	replay(db)
+	if !slices.Equal(fake.inserted, []int64{1, 2, 4, 5}) || Depth() != 0 {
+		t.Errorf("inserted = %v, depth = %d after second replay", fake.inserted, Depth())
+	}
+}
+
+func TestCompact(t *testing.T) {
+	path := setup(t, "")
+	fake, db := openFake(t)
+	for id := 1; id <= 4; id++ {
+		if err := Append(&model.DBSnapshot{InstID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	line := Get().Bytes / 4
+
+	steps := []struct {
+		name   string
+		limit  int //元数据库写入limit行后再次不可用
+		depth  int
+		bytes  int64
+		offset int64
+	}{
+		//已重放的部分不到文件的一半，不整理
+		{"重放1个", 1, 3, 4 * line, line},
+		//超过一半后去掉已重放的部分
+		{"再重放2个", 3, 1, line, 0},
+	}
+	for _, step := range steps {
+		fake.limit = step.limit
+		replay(db)
+		if got := Get(); got.Depth != step.depth || got.Bytes != step.bytes || offset != step.offset {
+			t.Errorf("%s: Stats = %+v, offset = %d, want Depth %d Bytes %d offset %d", step.name, got, offset, step.depth, step.bytes, step.offset)
+		}
+		if got := size(t, path); got != step.bytes {
+			t.Errorf("%s: file size = %d, want %d", step.name, got, step.bytes)
+		}
+	}
+
+	//上限只计算待重放的部分
+	mu.Lock()
+	stats.MaxBytes = 2 * line
+	mu.Unlock()
+	if err := Append(&model.DBSnapshot{InstID: 5}); err != nil {
+		t.Errorf("Append within max_size: %v", err)
+	}
+	if err := Append(&model.DBSnapshot{InstID: 6}); err == nil {
+		t.Errorf("Append over max_size succeeded")
+	}
+
+	fake.limit = 0
+	replay(db)
+	if !slices.Equal(fake.inserted, []int64{1, 2, 3, 4, 5}) || Depth() != 0 || size(t, path) != 0 {
+		t.Errorf("inserted = %v, depth = %d, file size = %d after recovery", fake.inserted, Depth(), size(t, path))
+	}
+}
+
+func TestAppendAfterPartialReplay(t *testing.T) {
+	setup(t, "")
+	fake, db := openFake(t)
+	for id := 1; id <= 4; id++ {
+		if err := Append(&model.DBSnapshot{InstID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	line := Get().Bytes / 4
+
+	//重放1个后文件不整理，仍有4行，其中3行待重放
+	fake.limit = 1
+	replay(db)
+	mu.Lock()
+	stats.MaxBytes = 4 * line
+	mu.Unlock()
+	if err := Append(&model.DBSnapshot{InstID: 5}); err != nil {
+		t.Errorf("Append with 3 pending lines under a 4 line max_size: %v", err)
+	}
+	if err := Append(&model.DBSnapshot{InstID: 6}); err == nil {
+		t.Errorf("Append over max_size succeeded")
+	}
+}
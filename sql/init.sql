@@ -5,11 +5,123 @@ CREATE TABLE `db_snapshot_config`
     `host`    varchar(120) NOT NULL DEFAULT '' COMMENT '实例IP',
     `port`    int          NOT NULL DEFAULT '0' COMMENT '实例端口',
     `db_name` varchar(120) NOT NULL DEFAULT '' COMMENT '数据库名',
+    `monitor_user`     varchar(64)  NOT NULL DEFAULT '' COMMENT '监控账号，为空时使用默认账号',
+    `monitor_password` varchar(512) NOT NULL DEFAULT '' COMMENT '监控密码密文',
+    `enabled`          tinyint      NOT NULL DEFAULT '1' COMMENT '是否采集：1采集，0暂停',
+    `interval_seconds` int          NOT NULL DEFAULT '0' COMMENT '采集间隔(s)，0表示使用全局配置',
+    `window_start`     char(5)      NOT NULL DEFAULT '' COMMENT '采集时间窗口开始 HH:MM，为空表示全天',
+    `window_end`       char(5)      NOT NULL DEFAULT '' COMMENT '采集时间窗口结束 HH:MM',
+    `tier`             tinyint      NOT NULL DEFAULT '2' COMMENT '实例级别：1核心实例优先采集，2普通实例',
+    `agent`            varchar(64)  NOT NULL DEFAULT '' COMMENT '采集代理名称，为空表示由中心采集',
+    `threshold_profile` varchar(32) NOT NULL DEFAULT '' COMMENT '分类规则名，为空表示使用数据库类型的默认规则',
+    `create_time`      datetime     NOT NULL DEFAULT CURRENT_TIMESTAMP COMMENT '添加时间，覆盖率从这里开始计算',
     PRIMARY KEY (`inst_id`),
     UNIQUE KEY `uk_ip_port` (`host`,`port`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci  COMMENT='db快照配置';
 
 
+CREATE TABLE `db_snapshot_credential`
+(
+    `db_type`          varchar(30)  NOT NULL COMMENT '实例类型',
+    `monitor_user`     varchar(64)  NOT NULL DEFAULT '' COMMENT '监控账号',
+    `monitor_password` varchar(512) NOT NULL DEFAULT '' COMMENT '监控密码密文',
+    PRIMARY KEY (`db_type`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci  COMMENT='按实例类型配置的默认监控账号';
+
+
+CREATE TABLE `db_snapshot_recording`
+(
+    `inst_id`      bigint       NOT NULL COMMENT '实例ID',
+    `create_time`  datetime     NOT NULL COMMENT '转储时间',
+    `reason`       varchar(255) NOT NULL DEFAULT '' COMMENT '触发原因',
+    `start_time`   datetime     DEFAULT NULL COMMENT '第一个采样时间',
+    `end_time`     datetime     DEFAULT NULL COMMENT '最后一个采样时间',
+    `frames`       int          NOT NULL DEFAULT '0' COMMENT '采样次数',
+    `max_act_sess` int          NOT NULL DEFAULT '0' COMMENT '最大活动会话数',
+    `file_name`    varchar(255) NOT NULL DEFAULT '' COMMENT '快照文件，相对data目录',
+    PRIMARY KEY (`inst_id`, `create_time`),
+    KEY            `create_time` (`create_time`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='黑匣子转储记录';
+
+
+CREATE TABLE `db_snapshot_event`
+(
+    `id`          bigint       NOT NULL AUTO_INCREMENT,
+    `inst_id`     bigint       NOT NULL COMMENT '实例ID',
+    `create_time` datetime     NOT NULL COMMENT '事件时间',
+    `type`        varchar(30)  NOT NULL COMMENT '事件类型：skipped跳过采集',
+    `msg`         varchar(1024) NOT NULL DEFAULT '' COMMENT '事件说明',
+    PRIMARY KEY (`id`),
+    KEY           `idx_inst_time` (`inst_id`, `create_time`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='实例调度事件';
+
+
+CREATE TABLE `db_snapshot_status`
+(
+    `inst_id`     bigint        NOT NULL COMMENT '实例ID',
+    `state`       varchar(16)   NOT NULL DEFAULT 'closed' COMMENT '熔断状态：closed正常，open熔断，half-open探测中',
+    `failures`    int           NOT NULL DEFAULT '0' COMMENT '连续连接失败次数',
+    `last_error`  varchar(1024) NOT NULL DEFAULT '' COMMENT '最后一次失败原因',
+    `since`       datetime      DEFAULT NULL COMMENT '进入当前状态的时间',
+    `next_probe`  datetime      DEFAULT NULL COMMENT '下一次探测时间',
+    `update_time` datetime      DEFAULT NULL COMMENT '更新时间',
+    PRIMARY KEY (`inst_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='实例连接熔断状态';
+
+
+CREATE TABLE `db_snapshot_gap`
+(
+    `id`            bigint        NOT NULL AUTO_INCREMENT,
+    `inst_id`       bigint        NOT NULL COMMENT '实例ID',
+    `expected_time` datetime      NOT NULL COMMENT '计划采集时刻，多次缺失时为第一次',
+    `reason`        varchar(16)   NOT NULL COMMENT '缺失原因：down采集程序未运行，backlog队列积压，timeout超时，connect连接失败，failed其他错误',
+    `missed`        int           NOT NULL DEFAULT '1' COMMENT '缺失的快照数',
+    `msg`           varchar(1024) NOT NULL DEFAULT '' COMMENT '说明',
+    PRIMARY KEY (`id`),
+    KEY             `idx_inst_time` (`inst_id`, `expected_time`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='快照缺失记录';
+
+
+CREATE TABLE `db_snapshot_heartbeat`
+(
+    `id`        varchar(128) NOT NULL COMMENT '节点标识，默认 主机名:http端口',
+    `last_tick` datetime     NOT NULL COMMENT '最后一次心跳时间',
+    PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='采集程序心跳，用于计算停机期间缺失的快照';
+
+
+CREATE TABLE `db_snapshot_agent`
+(
+    `name`           varchar(64)  NOT NULL COMMENT '代理名称',
+    `addr`           varchar(64)  NOT NULL DEFAULT '' COMMENT '最后一次心跳的来源地址',
+    `instances`      int          NOT NULL DEFAULT '0' COMMENT '代理正在采集的实例数',
+    `spooled`        int          NOT NULL DEFAULT '0' COMMENT '代理本地待推送的快照数',
+    `last_heartbeat` datetime     DEFAULT NULL COMMENT '最后一次心跳时间',
+    `token_hash`     char(64)     DEFAULT NULL COMMENT '中心签发的令牌的SHA-256摘要，为空表示未签发',
+    PRIMARY KEY (`name`),
+    UNIQUE KEY `uk_token_hash` (`token_hash`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='采集代理';
+
+
+CREATE TABLE `db_snapshot_node`
+(
+    `node`       varchar(128) NOT NULL COMMENT '节点标识，默认 主机名:http端口',
+    `mode`       varchar(16)  NOT NULL DEFAULT '' COMMENT '集群模式：standby主备，shard多活',
+    `heartbeat`  datetime(3)  NOT NULL COMMENT '最后一次续约时间',
+    `start_time` datetime     NOT NULL COMMENT '节点启动时间',
+    PRIMARY KEY (`node`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='采集程序集群节点';
+
+
+CREATE TABLE `db_snapshot_leader`
+(
+    `id`          varchar(32)  NOT NULL COMMENT '租约标识',
+    `node`        varchar(128) NOT NULL COMMENT '持有租约的节点',
+    `expire_time` datetime(3)  NOT NULL COMMENT '租约到期时间',
+    PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='主备模式的主节点租约';
+
+
 CREATE TABLE `db_snapshot`
 (
     `inst_id`           bigint   NOT NULL COMMENT '实例ID',
@@ -23,9 +135,16 @@ CREATE TABLE `db_snapshot`
     `max_query_seconds` int DEFAULT NULL COMMENT '最长查询耗时(s)',
     `max_txn_seconds`   int DEFAULT NULL COMMENT '最长事务耗时(s)',
     `duration_seconds`  int DEFAULT NULL COMMENT '采集快照耗时(s)',
+    `burst`             tinyint  NOT NULL DEFAULT '0' COMMENT '是否高频采集：1是，0否',
+    `scheduled`         tinyint  NOT NULL DEFAULT '1' COMMENT '是否定时采集：1是，0手动触发',
+    `capture_profile`   varchar(16) NOT NULL DEFAULT 'full' COMMENT '采集档位：full完整采集，degraded负载过高降级采集',
+    `threshold_profile` varchar(32) NOT NULL DEFAULT 'default' COMMENT '分类规则名，default为数据库类型的默认规则',
+    `round_id`          bigint   NOT NULL DEFAULT '0' COMMENT '调度轮次，名义时刻的unix时间戳，0表示旧版本的快照',
+    `round_time`        datetime DEFAULT NULL COMMENT '调度轮次的名义时刻',
     `msg`               text COMMENT '报错信息',
     PRIMARY KEY (`inst_id`, `create_time`),
     KEY                 `create_time` (`create_time`),
+    KEY                 `idx_round` (`round_id`),
     KEY                 `idx_msg` (`msg`(32))
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='db快照汇总'
 PARTITION BY RANGE  COLUMNS(create_time)
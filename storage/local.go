@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Local 本地目录
+type Local struct {
+	dir string
+}
+
+func NewLocal(dir string) *Local {
+	return &Local{dir: dir}
+}
+
+func (self *Local) path(name string) string {
+	return filepath.Join(self.dir, filepath.FromSlash(name))
+}
+
+// Put 先写临时文件再重命名，读取时不会看到写了一半的文件
+func (self *Local) Put(ctx context.Context, name string, data []byte) error {
+	p := self.path(name)
+	err := os.MkdirAll(filepath.Dir(p), 0775)
+	if err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (self *Local) Get(ctx context.Context, name string) (io.ReadCloser, *Info, error) {
+	f, err := os.Open(self.path(name))
+	if err != nil {
+		return nil, nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if st.IsDir() {
+		f.Close()
+		return nil, nil, &fs.PathError{Op: "open", Path: name, Err: ErrNotExist}
+	}
+	return f, &Info{Name: name, Size: st.Size(), ModTime: st.ModTime()}, nil
+}
+
+// List 从前缀所在的目录开始遍历
+func (self *Local) List(ctx context.Context, prefix string) ([]Info, error) {
+	dir := prefix
+	if !strings.HasSuffix(dir, "/") {
+		dir = path.Dir(dir)
+	}
+	var list []Info
+	err := filepath.WalkDir(self.path(dir), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(p, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(self.dir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		st, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		list = append(list, Info{Name: name, Size: st.Size(), ModTime: st.ModTime()})
+		return nil
+	})
+	slices.SortFunc(list, func(a, b Info) int { return strings.Compare(a.Name, b.Name) })
+	return list, err
+}
+
+func (self *Local) Delete(ctx context.Context, name string) error {
+	err := os.Remove(self.path(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
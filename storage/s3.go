@@ -0,0 +1,269 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"db-snapshot/config"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// emptyHash 空请求体的sha256
+const emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3 兼容S3的对象存储，请求使用 AWS Signature Version 4 签名
+type S3 struct {
+	endpoint    *url.URL
+	region      string
+	bucket      string
+	prefix      string
+	accessKey   string
+	secretKey   string
+	virtualHost bool
+	client      *http.Client
+	now         func() time.Time
+}
+
+func NewS3(cfg *config.StorageConfig, secretKey string) (*S3, error) {
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("对象存储地址错误: %w", err)
+	}
+	return &S3{
+		endpoint:    u,
+		region:      cfg.Region,
+		bucket:      cfg.Bucket,
+		prefix:      cfg.Prefix,
+		accessKey:   cfg.AccessKey,
+		secretKey:   secretKey,
+		virtualHost: cfg.VirtualHost,
+		client:      &http.Client{Timeout: time.Minute},
+		now:         time.Now,
+	}, nil
+}
+
+func (self *S3) Put(ctx context.Context, name string, data []byte) error {
+	sum := sha256.Sum256(data)
+	req, err := self.request(ctx, http.MethodPut, self.prefix+name, nil, bytes.NewReader(data), hex.EncodeToString(sum[:]))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(data))
+	resp, err := self.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (self *S3) Get(ctx context.Context, name string) (io.ReadCloser, *Info, error) {
+	req, err := self.request(ctx, http.MethodGet, self.prefix+name, nil, nil, emptyHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := self.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	info := &Info{Name: name, Size: resp.ContentLength}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return resp.Body, info, nil
+}
+
+// List 使用 ListObjectsV2 分页列出对象
+func (self *S3) List(ctx context.Context, prefix string) ([]Info, error) {
+	var list []Info
+	var token string
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {self.prefix + prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := self.request(ctx, http.MethodGet, "", query, nil, emptyHash)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := self.do(req)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			IsTruncated           bool
+			NextContinuationToken string
+			Contents              []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("解析对象列表失败: %w", err)
+		}
+		for _, v := range result.Contents {
+			list = append(list, Info{Name: strings.TrimPrefix(v.Key, self.prefix), Size: v.Size, ModTime: v.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	slices.SortFunc(list, func(a, b Info) int { return strings.Compare(a.Name, b.Name) })
+	return list, nil
+}
+
+// Delete 对象不存在时S3也返回成功
+func (self *S3) Delete(ctx context.Context, name string) error {
+	req, err := self.request(ctx, http.MethodDelete, self.prefix+name, nil, nil, emptyHash)
+	if err != nil {
+		return err
+	}
+	resp, err := self.do(req)
+	if IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// request 创建签名后的请求，key为空时访问桶
+func (self *S3) request(ctx context.Context, method, key string, query url.Values, body io.Reader, payloadHash string) (*http.Request, error) {
+	u := *self.endpoint
+	p := "/" + self.bucket + "/" + key
+	if self.virtualHost {
+		u.Host = self.bucket + "." + u.Host
+		p = "/" + key
+	}
+	u.Path = p
+	u.RawPath = escape(p, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	self.sign(req, payloadHash, self.now())
+	return req, nil
+}
+
+// do 发送请求，非2xx时返回错误，404返回 ErrNotExist
+func (self *S3) do(req *http.Request) (*http.Response, error) {
+	resp, err := self.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var e struct {
+		Code    string
+		Message string
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	xml.Unmarshal(data, &e)
+	err = fmt.Errorf("对象存储 %s %s 失败: %s %s %s", req.Method, req.URL.Path, resp.Status, e.Code, e.Message)
+	if resp.StatusCode == http.StatusNotFound && e.Code != "NoSuchBucket" {
+		return nil, fmt.Errorf("%w: %w", ErrNotExist, err)
+	}
+	return nil, err
+}
+
+// sign 按 AWS Signature Version 4 签名，签名的请求头为host和请求中已设置的所有请求头
+func (self *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + self.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+self.secretKey), date)
+	key = hmacSHA256(key, self.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		self.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery 按参数名排序并编码，同时用作请求的查询字符串
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	var parts []string
+	for _, k := range keys {
+		values := slices.Clone(query[k])
+		slices.Sort(values)
+		for _, v := range values {
+			parts = append(parts, escape(k, true)+"="+escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// escape 按SigV4的规则编码：除 A-Z a-z 0-9 - _ . ~ 外都编码，路径中的/不编码
+func escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"db-snapshot/config"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+// ErrNotExist 文件不存在，各存储都返回该错误，用 errors.Is 判断
+var ErrNotExist = fs.ErrNotExist
+
+// Info 文件信息
+type Info struct {
+	Name    string    //相对存储根目录的路径，用/分隔，例如 202501/12/20250101_120000.html.br
+	Size    int64     //文件大小，未知时为-1
+	ModTime time.Time //修改时间
+}
+
+// Storage 快照文件的存储，文件名是相对存储根目录的路径，用/分隔
+type Storage interface {
+	Put(ctx context.Context, name string, data []byte) error
+	Get(ctx context.Context, name string) (io.ReadCloser, *Info, error) //调用方负责关闭
+	List(ctx context.Context, prefix string) ([]Info, error)            //按文件名排序
+	Delete(ctx context.Context, name string) error                      //文件不存在时不报错
+}
+
+// backend 配置的存储，启动时初始化
+var backend Storage = NewLocal("data")
+
+// New 按配置创建存储
+func New(cfg *config.StorageConfig, secretKey string) (Storage, error) {
+	switch cfg.Type {
+	case config.StorageLocal:
+		return NewLocal(cfg.Dir), nil
+	case config.StorageS3:
+		return NewS3(cfg, secretKey)
+	}
+	return nil, fmt.Errorf("不支持的存储类型: %s", cfg.Type)
+}
+
+// Init 按配置初始化存储
+func Init(cfg *config.StorageConfig, secretKey string) error {
+	s, err := New(cfg, secretKey)
+	if err != nil {
+		return err
+	}
+	backend = s
+	return nil
+}
+
+// Put 保存文件，已存在时覆盖
+func Put(ctx context.Context, name string, data []byte) error {
+	if err := check(name); err != nil {
+		return err
+	}
+	return backend.Put(ctx, name, data)
+}
+
+// Get 读取文件，文件不存在时返回 ErrNotExist
+func Get(ctx context.Context, name string) (io.ReadCloser, *Info, error) {
+	if err := check(name); err != nil {
+		return nil, nil, err
+	}
+	return backend.Get(ctx, name)
+}
+
+// List 列出以prefix开头的文件，例如 202501/12/
+func List(ctx context.Context, prefix string) ([]Info, error) {
+	if prefix != "" {
+		if err := check(prefix); err != nil {
+			return nil, err
+		}
+	}
+	return backend.List(ctx, prefix)
+}
+
+// Delete 删除文件
+func Delete(ctx context.Context, name string) error {
+	if err := check(name); err != nil {
+		return err
+	}
+	return backend.Delete(ctx, name)
+}
+
+// ReadFile 读取整个文件
+func ReadFile(ctx context.Context, name string) ([]byte, error) {
+	r, _, err := Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// check 文件名不能是绝对路径，不能包含 . 和 .. ，避免访问存储根目录之外的文件
+func check(name string) error {
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+		return fmt.Errorf("文件名错误: %q", name)
+	}
+	for _, elem := range strings.Split(strings.TrimSuffix(name, "/"), "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			return fmt.Errorf("文件名错误: %q", name)
+		}
+	}
+	return nil
+}
+
+// IsNotExist 判断是否为文件不存在
+func IsNotExist(err error) bool {
+	return errors.Is(err, ErrNotExist)
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"202501/12/20250101_120000.html.br", true},
+		{"202501/12/", true},
+		{"202501", true},
+		{"a..b/c.html", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"../config.ini", false},
+		{"202501/../../config.ini", false},
+		{"202501/./12/a.html", false},
+		{"202501//12/a.html", false},
+		{"202501/..", false},
+		{".", false},
+		{"202501\\12\\a.html", false},
+		{"..\\config.ini", false},
+	}
+	for _, tt := range tests {
+		if err := check(tt.name); (err == nil) != tt.ok {
+			t.Errorf("check(%q) = %v, want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestLocal(t *testing.T) {
+	dir := t.TempDir()
+	saved := backend
+	backend = NewLocal(dir)
+	defer func() { backend = saved }()
+	ctx := context.Background()
+
+	names := []string{
+		"202501/12/20250101_120000.html.br",
+		"202501/12/20250101_120100.html.br",
+		"202501/13/20250101_120000.html.br",
+	}
+	for _, name := range names {
+		if err := Put(ctx, name, []byte(name)); err != nil {
+			t.Fatalf("Put %s: %v", name, err)
+		}
+	}
+	//写了一半的临时文件不列出
+	os.WriteFile(filepath.Join(dir, "202501", "12", "20250101_120200.html.br.tmp"), []byte("x"), 0644)
+
+	data, err := ReadFile(ctx, names[0])
+	if err != nil || string(data) != names[0] {
+		t.Errorf("ReadFile = %q, %v", data, err)
+	}
+	if _, _, err := Get(ctx, "202501/12/20250101_999999.html.br"); !IsNotExist(err) {
+		t.Errorf("Get missing file: err = %v, want ErrNotExist", err)
+	}
+	if _, _, err := Get(ctx, "202501/12"); !IsNotExist(err) {
+		t.Errorf("Get directory: err = %v, want ErrNotExist", err)
+	}
+	if err := Put(ctx, "../escape.html.br", []byte("x")); err == nil {
+		t.Errorf("Put outside the root succeeded")
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"202501/12/", names[:2]},
+		{"202501/", names},
+		{"", names},
+		{"202501/12/20250101_1201", names[1:2]},
+		{"202502/", nil},
+	}
+	for _, tt := range tests {
+		list, err := List(ctx, tt.prefix)
+		if err != nil {
+			t.Fatalf("List %q: %v", tt.prefix, err)
+		}
+		var got []string
+		for _, v := range list {
+			got = append(got, v.Name)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("List(%q) = %v, want %v", tt.prefix, got, tt.want)
+		}
+	}
+
+	if err := Delete(ctx, names[0]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := Delete(ctx, names[0]); err != nil {
+		t.Errorf("Delete missing file: %v", err)
+	}
+	if list, _ := List(ctx, "202501/"); len(list) != len(names)-1 {
+		t.Errorf("List after Delete = %v", list)
+	}
+}
@@ -1,27 +1,79 @@
 package threading
 
 import (
+    "context"
+    "db-snapshot/util"
+    "errors"
     "fmt"
     "github.com/gookit/slog"
     "os"
     "os/signal"
     "sync"
+    "sync/atomic"
     "syscall"
+    "time"
 )
 
 var SignalChan chan os.Signal
 
-// 接收kill 信号15
+// 接收kill 信号15和Ctrl+C，由main统一处理退出
 func init() {
-    SignalChan = make(chan os.Signal)
-    signal.Notify(SignalChan, syscall.SIGTERM)
+    SignalChan = make(chan os.Signal, 1)
+    signal.Notify(SignalChan, syscall.SIGTERM, syscall.SIGINT)
+}
+
+// Priority 任务优先级，高优先级队列中的任务先执行
+type Priority int
+
+const (
+    PriorityNormal Priority = iota
+    PriorityHigh            //核心实例、手动触发的快照
+)
+
+// Task 带名称、优先级和截止时间的任务
+type Task struct {
+    Name     string
+    Priority Priority
+    Timeout  time.Duration //0表示不限制
+    Run      func(ctx context.Context) error
 }
 
 type Pool struct {
-    Queue chan func()
-    Size  int
-    Wg    *sync.WaitGroup
-    Quit  chan struct{}
+    Queue     chan func()
+    High      chan func() //高优先级队列
+    Size      int
+    Wg        *sync.WaitGroup
+    Quit      chan struct{}
+    Ctx       context.Context //退出等待超时后取消，用于中断执行中的任务
+    cancel    context.CancelFunc
+    done      chan struct{} //关闭后不再接收和执行新任务
+    once      sync.Once
+    mu        sync.Mutex //保护Size和worker编号
+    lastID    int
+    running   atomic.Int64
+    completed atomic.Int64
+    failed    atomic.Int64
+    timedOut  atomic.Int64
+    dropped   atomic.Int64
+}
+
+// Stats 线程池计数器
+type Stats struct {
+    Size           int
+    QueueDepth     int
+    HighQueueDepth int
+    Running        int
+    Completed      int64
+    Failed         int64
+    TimedOut       int64
+    Dropped        int64
+}
+
+// ShutdownResult 退出时未完成的任务
+type ShutdownResult struct {
+    Dropped   int  //队列中未执行的任务数
+    Cancelled int  //等待超时后被取消的执行中任务数
+    Abandoned bool //取消后仍未结束，放弃等待
 }
 
 func NewPool(workerNum, queueSize int) *Pool {
@@ -32,11 +84,16 @@ func NewPool(workerNum, queueSize int) *Pool {
         panic("queueSize must > 0")
     }
     var wg sync.WaitGroup
+    ctx, cancel := context.WithCancel(context.Background())
     return &Pool{
-        Queue: make(chan func(), queueSize),
-        Size:  workerNum,
-        Wg:    &wg,
-        Quit:  make(chan struct{}, workerNum),
+        Queue:  make(chan func(), queueSize),
+        High:   make(chan func(), queueSize),
+        Size:   workerNum,
+        Wg:     &wg,
+        Quit:   make(chan struct{}, workerNum),
+        Ctx:    ctx,
+        cancel: cancel,
+        done:   make(chan struct{}),
     }
 }
 
@@ -44,13 +101,33 @@ func (p *Pool) Worker(num int) {
     defer p.Wg.Done()
 
     for {
+        //优先执行高优先级任务
+        select {
+        case task := <-p.High:
+            if !p.exec(task) {
+                return
+            }
+            continue
+        default:
+        }
+
         select {
+        case <-p.done:
+            return
+
+        case task := <-p.High:
+            if !p.exec(task) {
+                return
+            }
+
         case task, ok := <-p.Queue:
             if !ok {
                 slog.Infof(fmt.Sprintf("任务已完成，Worker%d退出", num))
                 return
             }
-            task()
+            if !p.exec(task) {
+                return
+            }
 
         case <-p.Quit:
             slog.Infof(fmt.Sprintf("收到停止信号，Worker%d终止", num))
@@ -60,23 +137,66 @@ func (p *Pool) Worker(num int) {
 
 }
 
+// exec 执行任务，线程池已关闭时丢弃任务并返回false
+func (p *Pool) exec(task func()) bool {
+    //同时就绪时select随机选择，关闭后不再执行新任务
+    select {
+    case <-p.done:
+        p.dropped.Add(1)
+        return false
+    default:
+    }
+    p.running.Add(1)
+    defer p.running.Add(-1)
+    task()
+    return true
+}
+
 func (p *Pool) Start() {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
     slog.Infof("启动线程池，Size=%d", p.Size)
     for i := 1; i <= p.Size; i++ {
         p.Wg.Add(1)
         go p.Worker(i)
     }
+    p.lastID = p.Size
+}
 
-    //接收kill信号，发送停止信号
-    go func() {
-        <-SignalChan
-        slog.Infof("收到kill信号，准备退出程序")
-        for i := 0; i < p.Size; i++ {
-            p.Quit <- struct{}{}
-        }
-        //close(p.Quit)
-    }()
+// Resize 调整worker数量，减少时等待worker执行完当前任务后退出
+func (p *Pool) Resize(size int) error {
+    if size <= 0 {
+        return fmt.Errorf("线程池大小必须大于0")
+    }
 
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    diff := size - p.Size
+    switch {
+    case diff > 0:
+        for i := 0; i < diff; i++ {
+            p.lastID++
+            p.Wg.Add(1)
+            go p.Worker(p.lastID)
+        }
+    case diff < 0:
+        go func() {
+            for i := 0; i < -diff; i++ {
+                select {
+                case p.Quit <- struct{}{}:
+                case <-p.done:
+                    return
+                }
+            }
+        }()
+    default:
+        return nil
+    }
+    slog.Infof("调整线程池大小 %d -> %d", p.Size, size)
+    p.Size = size
+    return nil
 }
 
 func (p *Pool) Close() {
@@ -88,6 +208,103 @@ func (p *Pool) Join() {
     p.Wg.Wait()
 }
 
-func (p *Pool) AddTask(t func()) {
-    p.Queue <- t
+// AddTask 添加普通优先级、不限制时间的任务，线程池关闭后丢弃任务并返回false，队列满时阻塞
+func (p *Pool) AddTask(t func()) bool {
+    return p.Submit(Task{Run: func(ctx context.Context) error {
+        t()
+        return nil
+    }})
+}
+
+// Submit 按优先级添加任务，线程池关闭后丢弃任务并返回false，队列满时阻塞
+func (p *Pool) Submit(t Task) bool {
+    queue := p.Queue
+    if t.Priority == PriorityHigh {
+        queue = p.High
+    }
+
+    select {
+    case <-p.done:
+        p.dropped.Add(1)
+        return false
+    default:
+    }
+    select {
+    case queue <- p.wrap(t):
+        return true
+    case <-p.done:
+        p.dropped.Add(1)
+        return false
+    }
+}
+
+// wrap 为任务设置截止时间并统计执行结果
+func (p *Pool) wrap(t Task) func() {
+    return func() {
+        ctx, cancel := p.Ctx, context.CancelFunc(func() {})
+        if t.Timeout > 0 {
+            ctx, cancel = context.WithTimeout(p.Ctx, t.Timeout)
+        }
+        defer cancel()
+        defer func() {
+            if r := recover(); r != nil {
+                p.failed.Add(1)
+                slog.Errorf("任务%s异常: %v", t.Name, r)
+            }
+        }()
+
+        err := t.Run(ctx)
+        switch {
+        case errors.Is(ctx.Err(), context.DeadlineExceeded):
+            p.timedOut.Add(1)
+            slog.Warnf("任务%s超过截止时间%ds", t.Name, int(t.Timeout.Seconds()))
+        case err != nil:
+            p.failed.Add(1)
+        default:
+            p.completed.Add(1)
+        }
+    }
+}
+
+// Running 返回执行中的任务数
+func (p *Pool) Running() int {
+    return int(p.running.Load())
+}
+
+// Stats 返回线程池计数器
+func (p *Pool) Stats() Stats {
+    p.mu.Lock()
+    size := p.Size
+    p.mu.Unlock()
+    return Stats{
+        Size:           size,
+        QueueDepth:     len(p.Queue),
+        HighQueueDepth: len(p.High),
+        Running:        p.Running(),
+        Completed:      p.completed.Load(),
+        Failed:         p.failed.Load(),
+        TimedOut:       p.timedOut.Load(),
+        Dropped:        p.dropped.Load(),
+    }
+}
+
+// Shutdown 停止接收任务，等待执行中的任务最多grace，超时后取消剩余任务
+func (p *Pool) Shutdown(grace time.Duration) ShutdownResult {
+    p.once.Do(func() { close(p.done) })
+
+    var res ShutdownResult
+    slog.Infof("线程池停止接收任务，等待%d个执行中的任务，最长%ds", p.Running(), int(grace.Seconds()))
+    if !util.WaitTimeout(p.Wg, grace) {
+        res.Cancelled = p.Running()
+        slog.Warnf("等待超时，取消%d个执行中的任务", res.Cancelled)
+        p.cancel()
+        //取消后留出保存结果的时间
+        if !util.WaitTimeout(p.Wg, 10*time.Second) {
+            res.Abandoned = true
+            slog.Errorf("取消后仍有%d个任务未结束，放弃等待", p.Running())
+        }
+    }
+    p.cancel()
+    res.Dropped = len(p.Queue) + len(p.High) + int(p.dropped.Load())
+    return res
 }
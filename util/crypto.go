@@ -0,0 +1,66 @@
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const encPrefix = "enc:"
+
+// Encrypt 使用 AES-256-GCM 加密，密钥由 masterKey 经 sha256 派生
+func Encrypt(masterKey, plainText string) (string, error) {
+	if masterKey == "" {
+		return "", errors.New("未配置master_key")
+	}
+	gcm, err := newGCM(masterKey)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	data := gcm.Seal(nonce, nonce, []byte(plainText), nil)
+	return encPrefix + base64.StdEncoding.EncodeToString(data), nil
+}
+
+func Decrypt(masterKey, cipherText string) (string, error) {
+	if !strings.HasPrefix(cipherText, encPrefix) {
+		return "", errors.New("密文格式错误")
+	}
+	if masterKey == "" {
+		return "", errors.New("未配置master_key")
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(cipherText, encPrefix))
+	if err != nil {
+		return "", fmt.Errorf("密文格式错误: %w", err)
+	}
+	gcm, err := newGCM(masterKey)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("密文长度错误")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("解密失败，请检查master_key: %w", err)
+	}
+	return string(plain), nil
+}
+
+func newGCM(masterKey string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte(masterKey))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -3,45 +3,19 @@ package util
 import (
 	"context"
 	"database/sql"
-	"db-snapshot/model"
 	"fmt"
 	"time"
 )
 
-func PingDB(dbType string, cfg *model.DBConfig) (err error) {
-	var db *sql.DB
-	switch dbType {
-	case "mysql", "polar", "tdsqlc":
-		db, err = NewMysqlDB(cfg)
-	case "oracle":
-		db, err = NewOracleDB(cfg)
-	case "pgsql":
-		db, err = NewPgsqlDB(cfg)
-	case "oceanbase":
-		db, err = NewOceanbaseDB(cfg)
-	default:
-		err = fmt.Errorf("不支持该数据库类型: %s", dbType)
-		return
-	}
-
-	if err != nil {
-		return
-	}
+// AppName 监控会话的程序名，DBA可据此识别采集程序的会话，采集SQL也据此排除自身会话
+const AppName = "db-snapshot"
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-	err = db.PingContext(ctx)
-	if err != nil {
-		return err
-	}
-	return
-}
+// LockTimeout 监控会话的锁等待超时，监控查询只读系统视图，等锁通常是被DDL阻塞，直接放弃
+const LockTimeout = time.Second
 
-func QueryReturnList(db *sql.DB, sqlText string) (rows [][]string, err error) {
-	//执行sql，返回二维数组
+func QueryReturnList(ctx context.Context, db *sql.DB, sqlText string) (rows [][]string, err error) {
+	//执行sql，返回二维数组，超时时间由调用方的ctx控制
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-	defer cancel()
 	var cur *sql.Rows
 	cur, err = db.QueryContext(ctx, sqlText)
 	if err != nil {
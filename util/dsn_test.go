@@ -0,0 +1,82 @@
+package util
+
+import (
+	"db-snapshot/model"
+	"github.com/go-sql-driver/mysql"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// 密码中包含DSN和URL的分隔符
+var dsnPasswords = []string{"abc123", "p@ss:w/rd", "a?b#c%d&e=f", "x@y@z", " 中文 ", "%41"}
+
+func TestMysqlDSN(t *testing.T) {
+	for _, pwd := range dsnPasswords {
+		cfg := &model.DBConfig{Host: "10.0.0.1", Port: 3306, User: "dba_monitor", Password: pwd, QueryTimeout: 3 * time.Second}
+		c, err := mysql.ParseDSN(mysqlDSN(cfg))
+		if err != nil {
+			t.Fatalf("password %q: %v", pwd, err)
+		}
+		if c.User != cfg.User || c.Passwd != pwd || c.Addr != "10.0.0.1:3306" || c.DBName != "information_schema" {
+			t.Errorf("password %q: got user=%q passwd=%q addr=%q db=%q", pwd, c.User, c.Passwd, c.Addr, c.DBName)
+		}
+		if c.Params["max_execution_time"] != "3000" {
+			t.Errorf("password %q: max_execution_time = %q", pwd, c.Params["max_execution_time"])
+		}
+		if c.Loc != time.Local {
+			t.Errorf("password %q: loc = %v", pwd, c.Loc)
+		}
+	}
+}
+
+func TestOceanbaseDSN(t *testing.T) {
+	for _, pwd := range dsnPasswords {
+		cfg := &model.DBConfig{Host: "10.0.0.2", Port: 2881, User: "monitor@sys#obcluster", Password: pwd, Database: "oceanbase"}
+		c, err := mysql.ParseDSN(oceanbaseDSN(cfg))
+		if err != nil {
+			t.Fatalf("password %q: %v", pwd, err)
+		}
+		if c.User != cfg.User || c.Passwd != pwd || c.Addr != "10.0.0.2:2881" || c.DBName != "oceanbase" {
+			t.Errorf("password %q: got user=%q passwd=%q addr=%q db=%q", pwd, c.User, c.Passwd, c.Addr, c.DBName)
+		}
+		if _, ok := c.Params["ob_query_timeout"]; ok {
+			t.Errorf("password %q: ob_query_timeout set without query timeout", pwd)
+		}
+	}
+}
+
+func TestPgsqlDSN(t *testing.T) {
+	for _, pwd := range dsnPasswords {
+		cfg := &model.DBConfig{Host: "10.0.0.3", Port: 5432, User: "dba_monitor", Password: pwd, Database: "postgres", QueryTimeout: time.Second}
+		u, err := url.Parse(pgsqlDSN(cfg))
+		if err != nil {
+			t.Fatalf("password %q: %v", pwd, err)
+		}
+		got, _ := u.User.Password()
+		if u.User.Username() != cfg.User || got != pwd || u.Host != "10.0.0.3:5432" || u.Path != "/postgres" {
+			t.Errorf("password %q: got user=%q passwd=%q host=%q path=%q", pwd, u.User.Username(), got, u.Host, u.Path)
+		}
+		q := u.Query()
+		if q.Get("statement_timeout") != "1000" || q.Get("application_name") != AppName || q.Get("sslmode") != "disable" {
+			t.Errorf("password %q: query = %v", pwd, q)
+		}
+	}
+}
+
+func TestOracleDSN(t *testing.T) {
+	for _, pwd := range dsnPasswords {
+		cfg := &model.DBConfig{Host: "10.0.0.4", Port: 1521, User: "dba_monitor", Password: pwd, Database: "orcl"}
+		u, err := url.Parse(oracleDSN(cfg))
+		if err != nil {
+			t.Fatalf("password %q: %v", pwd, err)
+		}
+		got, _ := u.User.Password()
+		if u.User.Username() != cfg.User || got != pwd || u.Host != "10.0.0.4:1521" || u.Path != "/orcl" {
+			t.Errorf("password %q: got user=%q passwd=%q host=%q path=%q", pwd, u.User.Username(), got, u.Host, u.Path)
+		}
+		if q := u.Query(); q.Get("prefetch_rows") != "10000" || q.Get("program") != AppName {
+			t.Errorf("password %q: query = %v", pwd, q)
+		}
+	}
+}
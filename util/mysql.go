@@ -1,18 +1,41 @@
 package util
 
 import (
+	"context"
 	"database/sql"
 	"db-snapshot/model"
 	"fmt"
+	mysqldriver "github.com/go-sql-driver/mysql"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"gorm.io/gorm/schema"
+	"net"
+	"strconv"
 	"time"
 )
 
-func NewMysqlORM(cfg *model.DBConfig) (*gorm.DB, error) {
+func NewMysqlORM(cfg *model.DBConfig, password func() string) (*gorm.DB, error) {
 
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?timeout=5s&loc=Local", cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.Database)
+	dsnConf := mysqldriver.NewConfig()
+	dsnConf.User = cfg.User
+	dsnConf.Net = "tcp"
+	dsnConf.Addr = fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	dsnConf.DBName = cfg.Database
+	dsnConf.Timeout = 5 * time.Second
+	dsnConf.Loc = time.Local
+	//每次建立新连接时获取最新密码，密码轮换后无需重启
+	err := dsnConf.Apply(mysqldriver.BeforeConnect(func(ctx context.Context, c *mysqldriver.Config) error {
+		c.Passwd = password()
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	connector, err := mysqldriver.NewConnector(dsnConf)
+	if err != nil {
+		return nil, err
+	}
 
 	config := &gorm.Config{
 		PrepareStmt:            true,
@@ -20,7 +43,7 @@ func NewMysqlORM(cfg *model.DBConfig) (*gorm.DB, error) {
 		NamingStrategy:         schema.NamingStrategy{SingularTable: true},
 	}
 
-	db, err := gorm.Open(mysql.Open(dsn), config)
+	db, err := gorm.Open(mysql.New(mysql.Config{Conn: sql.OpenDB(connector), DSNConfig: dsnConf}), config)
 	if err != nil {
 		return nil, err
 	}
@@ -42,9 +65,7 @@ func NewMysqlORM(cfg *model.DBConfig) (*gorm.DB, error) {
 }
 
 func NewMysqlDB(cfg *model.DBConfig) (*sql.DB, error) {
-	//获取数据库连接
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?timeout=5s&loc=Local", cfg.User, cfg.Password, cfg.Host, cfg.Port, "information_schema")
-	db, err := sql.Open("mysql", dsn)
+	db, err := sql.Open("mysql", mysqlDSN(cfg))
 
 	if err != nil {
 		return nil, err
@@ -56,3 +77,21 @@ func NewMysqlDB(cfg *model.DBConfig) (*sql.DB, error) {
 	db.SetConnMaxIdleTime(time.Second * 5)  //最大空闲保持时间
 	return db, nil
 }
+
+// mysqlDSN 由驱动拼接DSN，账号密码中的特殊字符不会破坏DSN，program_name可在performance_schema.session_connect_attrs中查看
+func mysqlDSN(cfg *model.DBConfig) string {
+	c := mysqldriver.NewConfig()
+	c.User = cfg.User
+	c.Passwd = cfg.Password
+	c.Net = "tcp"
+	c.Addr = net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	c.DBName = "information_schema"
+	c.Timeout = 5 * time.Second
+	c.Loc = time.Local
+	c.ConnectionAttributes = "program_name:" + AppName
+	if cfg.QueryTimeout > 0 {
+		//只对select生效，需要MySQL 5.7.8及以上版本
+		c.Params = map[string]string{"max_execution_time": strconv.FormatInt(cfg.QueryTimeout.Milliseconds(), 10)}
+	}
+	return c.FormatDSN()
+}
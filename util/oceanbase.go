@@ -3,16 +3,15 @@ package util
 import (
 	"database/sql"
 	"db-snapshot/model"
-	"fmt"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
+	"net"
+	"strconv"
 	"time"
 )
 
 func NewOceanbaseDB(cfg *model.DBConfig) (db *sql.DB, err error) {
 	//获取数据库连接
-	//sessionVariables=ob_query_timeout=3600000000
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?timeout=5s", cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.Database)
-	db, err = sql.Open("mysql", dsn)
+	db, err = sql.Open("mysql", oceanbaseDSN(cfg))
 	if err != nil {
 		return
 	}
@@ -22,3 +21,20 @@ func NewOceanbaseDB(cfg *model.DBConfig) (db *sql.DB, err error) {
 	db.SetConnMaxIdleTime(time.Second * 5)  //最大空闲保持时间
 	return
 }
+
+// oceanbaseDSN 由驱动拼接DSN，账号中的租户和集群名（user@tenant#cluster）和密码中的特殊字符不会破坏DSN
+func oceanbaseDSN(cfg *model.DBConfig) string {
+	c := mysql.NewConfig()
+	c.User = cfg.User
+	c.Passwd = cfg.Password
+	c.Net = "tcp"
+	c.Addr = net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	c.DBName = cfg.Database
+	c.Timeout = 5 * time.Second
+	c.ConnectionAttributes = "program_name:" + AppName
+	if cfg.QueryTimeout > 0 {
+		//ob_query_timeout单位为微秒
+		c.Params = map[string]string{"ob_query_timeout": strconv.FormatInt(cfg.QueryTimeout.Microseconds(), 10)}
+	}
+	return c.FormatDSN()
+}
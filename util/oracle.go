@@ -1,21 +1,20 @@
 package util
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"db-snapshot/model"
 	"fmt"
-	_ "github.com/sijms/go-ora/v2"
+	"github.com/gookit/slog"
+	go_ora "github.com/sijms/go-ora/v2"
 	"time"
 )
 
 func NewOracleDB(cfg *model.DBConfig) (db *sql.DB, err error) {
 	//获取数据库连接
 	// prefetch_rows设置太大会报错：driver: bad connection
-	dsn := fmt.Sprintf("oracle://%s:%s@%s:%d/%s?prefetch_rows=10000", cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.Database)
-	db, err = sql.Open("oracle", dsn)
-	if err != nil {
-		return
-	}
+	db = sql.OpenDB(oracleConnector{go_ora.NewConnector(oracleDSN(cfg))})
 
 	db.SetMaxOpenConns(64)                  //最大连接数
 	db.SetMaxIdleConns(32)                  //连接池里最大空闲连接数。必须要比maxOpenConns小
@@ -24,3 +23,31 @@ func NewOracleDB(cfg *model.DBConfig) (db *sql.DB, err error) {
 
 	return
 }
+
+// oracleDSN 由驱动拼接连接串，账号密码和服务名按URL编码
+func oracleDSN(cfg *model.DBConfig) string {
+	return go_ora.BuildUrl(cfg.Host, cfg.Port, cfg.Database, cfg.User, cfg.Password, map[string]string{
+		"prefetch_rows": "10000",
+		"program":       AppName,
+	})
+}
+
+// oracleConnector 建立连接后设置module/action，Oracle没有会话级语句超时，由调用方的ctx中断查询
+type oracleConnector struct {
+	driver.Connector
+}
+
+func (self oracleConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := self.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if ex, ok := conn.(driver.ExecerContext); ok {
+		_, err = ex.ExecContext(ctx, fmt.Sprintf("begin dbms_application_info.set_module('%s', 'snapshot'); end;", AppName), nil)
+		if err != nil {
+			//没有dbms_application_info权限时不影响采集
+			slog.Warnf("设置会话module失败: %v", err)
+		}
+	}
+	return conn, nil
+}
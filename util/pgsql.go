@@ -3,15 +3,16 @@ package util
 import (
 	"database/sql"
 	"db-snapshot/model"
-	"fmt"
 	_ "github.com/lib/pq"
+	"net"
+	"net/url"
+	"strconv"
 	"time"
 )
 
 func NewPgsqlDB(cfg *model.DBConfig) (db *sql.DB, err error) {
 	//获取数据库连接
-	dsn := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=disable", cfg.User, cfg.Password, cfg.Host, cfg.Port, cfg.Database)
-	db, err = sql.Open("postgres", dsn)
+	db, err = sql.Open("postgres", pgsqlDSN(cfg))
 	if err != nil {
 		return
 	}
@@ -21,3 +22,22 @@ func NewPgsqlDB(cfg *model.DBConfig) (db *sql.DB, err error) {
 	db.SetConnMaxIdleTime(time.Second * 5)  //最大空闲保持时间
 	return
 }
+
+// pgsqlDSN 账号密码按URL编码，未识别的参数作为会话参数在建立连接时发送
+func pgsqlDSN(cfg *model.DBConfig) string {
+	query := url.Values{}
+	query.Set("sslmode", "disable")
+	query.Set("application_name", AppName)
+	query.Set("lock_timeout", strconv.FormatInt(LockTimeout.Milliseconds(), 10))
+	if cfg.QueryTimeout > 0 {
+		query.Set("statement_timeout", strconv.FormatInt(cfg.QueryTimeout.Milliseconds(), 10))
+	}
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(cfg.User, cfg.Password),
+		Host:     net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		Path:     "/" + cfg.Database,
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
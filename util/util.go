@@ -4,17 +4,13 @@ import (
 	"fmt"
 	"github.com/gookit/slog"
 	"os"
-	"path/filepath"
+	"sync"
 	"time"
 )
 
-func EnterWorkDir() {
-	fullpath, err := os.Executable()
-	if err != nil {
-		panic(err)
-	}
-	dir, _ := filepath.Split(fullpath)
-	err = os.Chdir(dir)
+// EnterWorkDir 进入工作目录，快照文件等相对路径以此为准
+func EnterWorkDir(dir string) {
+	err := os.Chdir(dir)
 	if err != nil {
 		panic(err)
 	}
@@ -53,3 +49,18 @@ func GetManyOfChan[T any](ch *chan T, size int) (rows []T) {
 	}
 	return rows
 }
+
+// WaitTimeout 等待wg完成，超时返回false
+func WaitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	ch := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	select {
+	case <-ch:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}